@@ -0,0 +1,514 @@
+package main
+
+/* queued
+ * Author: Tim Henderson
+ * Email: tadh@case.edu
+ * Copyright 2013 All Right Reserved
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ *  * Neither the name of the queued nor the names of its contributors may be
+ *    used to endorse or promote products derived from this software without
+ *    specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/bits"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+import (
+	"github.com/timtadh/getopt"
+)
+
+import (
+	"github.com/timtadh/queued/client"
+)
+
+var BenchUsageMessage string = "queued bench [options]"
+var BenchExtendedMessage string = `
+runs a load test against a queued server. Producers ENQUE as fast as they can
+and consumers DEQUE as fast as they can, each on its own connection, and then
+the throughput and latency of both are reported. The server may use any kind
+of queue.
+
+Options
+    -h, --help                          print this message
+    -s, --server=<addr>                 the server's host:port (default
+                                        localhost:9001)
+    -p, --producers=<n>                 producer connections (default 4)
+    -c, --consumers=<n>                 consumer connections (default 4)
+    -q, --queues=<n>                    spread the load over this many queues
+                                        named bench-0, bench-1, ... (default 1).
+                                        Producer (and consumer) i uses
+                                        bench-(i mod n)
+    --size=<size>                       the payload size in bytes, either N
+                                        or MIN-MAX for sizes picked at random
+                                        (default 64)
+    -d, --duration=<duration>           how long to run (default 10s)
+    -j, --json                          print the report as JSON
+
+Payloads are unique so servers which dedupe keep every one. Items which are
+not consumed are left on the queues. Latency percentiles are nearest rank,
+accurate to within 2%.
+`
+
+func bench_usage(code int) {
+	fmt.Fprintln(os.Stderr, BenchUsageMessage)
+	if code == 0 {
+		fmt.Fprintln(os.Stderr, BenchExtendedMessage)
+		code = ErrorCodes["usage"]
+	} else {
+		fmt.Fprintln(os.Stderr, "Try -h or --help for help")
+	}
+	os.Exit(code)
+}
+
+/* The round trips of one kind of command made by one worker. */
+type samples struct {
+	latency histogram
+	bytes   int64
+	errors  int
+	empty   int
+}
+
+func (self *samples) merge(other *samples) {
+	self.latency.merge(&other.latency)
+	self.bytes += other.bytes
+	self.errors += other.errors
+	self.empty += other.empty
+}
+
+type OpReport struct {
+	Op        string             `json:"op"`
+	Count     int                `json:"count"`
+	PerSecond float64            `json:"per_second"`
+	MBPerSec  float64            `json:"mb_per_second"`
+	Errors    int                `json:"errors"`
+	Empty     int                `json:"empty,omitempty"`
+	Latency   map[string]float64 `json:"latency_ms"`
+}
+
+type BenchReport struct {
+	Server    string     `json:"server"`
+	Producers int        `json:"producers"`
+	Consumers int        `json:"consumers"`
+	Queues    int        `json:"queues"`
+	Size      string     `json:"size"`
+	Seconds   float64    `json:"seconds"`
+	Ops       []OpReport `json:"ops"`
+	Left      int        `json:"left_on_queues"`
+}
+
+var percentiles = []struct {
+	name string
+	p    float64
+}{
+	{"p50", 50},
+	{"p90", 90},
+	{"p99", 99},
+	{"p99.9", 99.9},
+	{"max", 100},
+}
+
+func report_op(op string, s *samples, elapsed time.Duration) OpReport {
+	latency := make(map[string]float64)
+	for _, p := range percentiles {
+		latency[p.name] = float64(s.latency.percentile(p.p)) / float64(time.Millisecond)
+	}
+	secs := elapsed.Seconds()
+	return OpReport{
+		Op:        op,
+		Count:     int(s.latency.count),
+		PerSecond: float64(s.latency.count) / secs,
+		MBPerSec:  float64(s.bytes) / secs / (1024 * 1024),
+		Errors:    s.errors,
+		Empty:     s.empty,
+		Latency:   latency,
+	}
+}
+
+/* How many of the high bits of a duration a histogram keeps. */
+const histBits = 7
+
+const histHalf = 1 << (histBits - 1)
+
+/*
+A histogram of durations which takes the same (fixed) memory however many it
+counts. Durations under 2*histHalf ns are counted exactly, longer ones keep
+their top histBits bits so they are within 1/histHalf of the real value. A
+(positive) duration has at most 63 bits.  */
+type histogram struct {
+	counts [(63 - histBits + 2) * histHalf]int64
+	count  int64
+	max    time.Duration
+}
+
+/*
+The bucket of a duration. A duration whose top bits are top once shifted
+right by shift goes in bucket shift*histHalf + top.  */
+func histBucket(d time.Duration) int {
+	v := uint64(d)
+	if d < 0 {
+		v = 0
+	}
+	shift := 0
+	if n := bits.Len64(v); n > histBits {
+		shift = n - histBits
+	}
+	return shift*histHalf + int(v>>uint(shift))
+}
+
+/* The largest duration in bucket i. */
+func histUpper(i int) time.Duration {
+	shift := 0
+	if i >= 2*histHalf {
+		shift = i/histHalf - 1
+	}
+	top := uint64(i - shift*histHalf)
+	return time.Duration((top+1)<<uint(shift) - 1)
+}
+
+func (self *histogram) add(d time.Duration) {
+	self.counts[histBucket(d)] += 1
+	self.count += 1
+	if d > self.max {
+		self.max = d
+	}
+}
+
+func (self *histogram) merge(other *histogram) {
+	for i, n := range other.counts {
+		self.counts[i] += n
+	}
+	self.count += other.count
+	if other.max > self.max {
+		self.max = other.max
+	}
+}
+
+/*
+The pth percentile (nearest rank: the smallest duration at least p% of the
+durations are at or under), to the accuracy of the buckets.  */
+func (self *histogram) percentile(p float64) time.Duration {
+	if self.count == 0 {
+		return 0
+	}
+	// the epsilon keeps eg. 99.9% of 1000 from rounding up past 999
+	rank := int64(math.Ceil(p/100*float64(self.count) - 1e-9))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, n := range self.counts {
+		seen += n
+		if seen < rank {
+			continue
+		}
+		if upper := histUpper(i); upper < self.max {
+			return upper
+		}
+		return self.max
+	}
+	return self.max
+}
+
+/* Parse N or MIN-MAX. */
+func parse_size(str string) (int, int) {
+	parts := strings.SplitN(str, "-", 2)
+	min, err := strconv.Atoi(parts[0])
+	max := min
+	if err == nil && len(parts) == 2 {
+		max, err = strconv.Atoi(parts[1])
+	}
+	if err != nil || min < 8 || max < min {
+		fmt.Fprintf(os.Stderr, "Error parsing '%v' expected N or MIN-MAX (at least 8)\n", str)
+		bench_usage(ErrorCodes["badint"])
+	}
+	return min, max
+}
+
+type bench struct {
+	addr      string
+	producers int
+	consumers int
+	queues    int
+	min, max  int
+	duration  time.Duration
+	seq       uint64
+}
+
+/* The queue the ith producer (or the ith consumer) uses. */
+func (self *bench) queue(i int) string {
+	return fmt.Sprintf("bench-%d", i%self.queues)
+}
+
+/* A unique payload: a sequence number followed by random filler. */
+func (self *bench) payload(rnd *rand.Rand) []byte {
+	size := self.min
+	if self.max > self.min {
+		size += rnd.Intn(self.max - self.min + 1)
+	}
+	data := make([]byte, size)
+	rnd.Read(data[8:])
+	binary.BigEndian.PutUint64(data, atomic.AddUint64(&self.seq, 1))
+	return data
+}
+
+func (self *bench) dial(i int) (*client.Client, error) {
+	c, err := client.Dial(self.addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Use(self.queue(i)); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (self *bench) produce(c *client.Client, stop <-chan struct{}, s *samples) {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		data := self.payload(rnd)
+		start := time.Now()
+		if _, err := c.Enque(data, nil); err != nil {
+			if !self.failed(err, s) {
+				return
+			}
+			continue
+		}
+		s.latency.add(time.Since(start))
+		s.bytes += int64(len(data))
+	}
+}
+
+func (self *bench) consume(c *client.Client, stop <-chan struct{}, s *samples) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		start := time.Now()
+		item, err := c.Deque()
+		if err == client.ErrEmpty {
+			s.empty += 1
+			time.Sleep(time.Millisecond)
+			continue
+		} else if err != nil {
+			if !self.failed(err, s) {
+				return
+			}
+			continue
+		}
+		s.latency.add(time.Since(start))
+		s.bytes += int64(len(item.Data))
+	}
+}
+
+/*
+Count a failed command. An ERROR from the server (eg. a full queue) backs off
+briefly, any other error means the connection is broken: it is reported and
+false is returned to stop the worker.  */
+func (self *bench) failed(err error, s *samples) bool {
+	s.errors += 1
+	if _, ok := err.(*client.ServerError); ok {
+		time.Sleep(time.Millisecond)
+		return true
+	}
+	fmt.Fprintln(os.Stderr, "connection failed:", err)
+	return false
+}
+
+func (self *bench) run() (*BenchReport, error) {
+	conns := make([]*client.Client, 0, self.producers+self.consumers)
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	for i := 0; i < self.producers+self.consumers; i++ {
+		q := i
+		if i >= self.producers {
+			q = i - self.producers
+		}
+		c, err := self.dial(q)
+		if err != nil {
+			return nil, err
+		}
+		conns = append(conns, c)
+	}
+	results := make([]*samples, len(conns))
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i, c := range conns {
+		results[i] = new(samples)
+		wg.Add(1)
+		go func(i int, c *client.Client) {
+			defer wg.Done()
+			if i < self.producers {
+				self.produce(c, stop, results[i])
+			} else {
+				self.consume(c, stop, results[i])
+			}
+		}(i, c)
+	}
+	time.Sleep(self.duration)
+	close(stop)
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	enque, deque := new(samples), new(samples)
+	for i, s := range results {
+		if i < self.producers {
+			enque.merge(s)
+		} else {
+			deque.merge(s)
+		}
+	}
+	left := 0
+	for i := 0; i < self.queues; i++ {
+		conns[0].Use(self.queue(i))
+		if size, err := conns[0].Size(); err == nil {
+			left += size
+		}
+	}
+	size := strconv.Itoa(self.min)
+	if self.max > self.min {
+		size = fmt.Sprintf("%v-%v", self.min, self.max)
+	}
+	return &BenchReport{
+		Server:    self.addr,
+		Producers: self.producers,
+		Consumers: self.consumers,
+		Queues:    self.queues,
+		Size:      size,
+		Seconds:   elapsed.Seconds(),
+		Ops: []OpReport{
+			report_op("ENQUE", enque, elapsed),
+			report_op("DEQUE", deque, elapsed),
+		},
+		Left: left,
+	}, nil
+}
+
+func print_report(r *BenchReport) {
+	fmt.Printf("server %v, %v producers, %v consumers, %v queues, %v byte payloads, %.1fs\n\n",
+		r.Server, r.Producers, r.Consumers, r.Queues, r.Size, r.Seconds)
+	fmt.Printf("%-6v %10v %10v %8v", "op", "count", "ops/s", "MB/s")
+	for _, p := range percentiles {
+		fmt.Printf(" %8v", p.name)
+	}
+	fmt.Printf(" %7v %7v\n", "errors", "empty")
+	for _, op := range r.Ops {
+		fmt.Printf("%-6v %10v %10.0f %8.2f", op.Op, op.Count, op.PerSecond, op.MBPerSec)
+		for _, p := range percentiles {
+			fmt.Printf(" %6.3fms", op.Latency[p.name])
+		}
+		fmt.Printf(" %7v %7v\n", op.Errors, op.Empty)
+	}
+	fmt.Printf("\n%v items left on the queues\n", r.Left)
+}
+
+func bench_main(argv []string) {
+	short := "hs:p:c:q:d:j"
+	long := []string{
+		"help",
+		"server=",
+		"producers=",
+		"consumers=",
+		"queues=",
+		"size=",
+		"duration=",
+		"json",
+	}
+	_, optargs, err := getopt.GetOpt(argv, short, long)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		bench_usage(ErrorCodes["opts"])
+	}
+
+	b := &bench{
+		addr:      "localhost:9001",
+		producers: 4,
+		consumers: 4,
+		queues:    1,
+		min:       64,
+		max:       64,
+		duration:  10 * time.Second,
+	}
+	asJSON := false
+	for _, oa := range optargs {
+		switch oa.Opt() {
+		case "-h", "--help":
+			bench_usage(0)
+		case "-s", "--server":
+			b.addr = oa.Arg()
+		case "-p", "--producers":
+			b.producers = parse_int(oa.Arg())
+		case "-c", "--consumers":
+			b.consumers = parse_int(oa.Arg())
+		case "-q", "--queues":
+			b.queues = parse_int(oa.Arg())
+		case "--size":
+			b.min, b.max = parse_size(oa.Arg())
+		case "-d", "--duration":
+			b.duration = parse_duration(oa.Arg())
+		case "-j", "--json":
+			asJSON = true
+		}
+	}
+	if b.producers < 0 || b.consumers < 0 || b.producers+b.consumers == 0 || b.queues < 1 {
+		fmt.Fprintln(os.Stderr, "You need at least one producer or consumer and at least one queue")
+		bench_usage(ErrorCodes["opts"])
+	}
+
+	report, err := b.run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(ErrorCodes["bench"])
+	}
+	if asJSON {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(data))
+	} else {
+		print_report(report)
+	}
+}
@@ -0,0 +1,440 @@
+/*
+A Go client for queued. A Client is a single connection to the server and, like
+the connection, it is not safe to use from more than one goroutine at a time.
+
+    c, err := client.Dial("localhost:9001")
+    if err != nil {
+        ...
+    }
+    defer c.Close()
+    c.Use("jobs")
+    id, err := c.Enque([]byte("some work"), nil)
+    item, err := c.Deque()
+
+Deque and Move return ErrEmpty when there is nothing on the queue and Enque
+returns ErrDuplicate when a queue which dedupes drops the item. Any other
+ERROR the server sends back is returned as a *ServerError.
+*/
+package client
+
+/* queued
+ * Author: Tim Henderson
+ * Email: tadh@case.edu
+ * Copyright 2013 All Right Reserved
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ *  * Neither the name of the queued nor the names of its contributors may be
+ *    used to endorse or promote products derived from this software without
+ *    specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	qnet "github.com/timtadh/queued/net"
+	"github.com/timtadh/queued/queue"
+)
+
+var ErrEmpty = errors.New("queue is empty")
+
+/*
+Returned by Enque and EnqueFront, along with the id of the item already on the
+queue, when the queue dedupes and already holds an item with the same data.
+The new item was dropped.  */
+var ErrDuplicate = errors.New("duplicate item")
+
+/* An ERROR response from the server. */
+type ServerError struct {
+	Msg string
+}
+
+func (self *ServerError) Error() string {
+	return self.Msg
+}
+
+/*
+A MOVED response: the queue is owned by another node of a cluster, at Addr.  */
+type MovedError struct {
+	Addr string
+}
+
+func (self *MovedError) Error() string {
+	return "MOVED " + self.Addr
+}
+
+/* How many MOVED responses a command follows before giving up. */
+const maxRedirects = 5
+
+type Client struct {
+	con   io.ReadWriteCloser
+	r     *bufio.Reader
+	w     *bufio.Writer
+	addr  string
+	queue string
+}
+
+/*
+Connect to the server at addr (host:port). A client made by Dial follows
+MOVED responses to USE (see Use).  */
+func Dial(addr string) (*Client, error) {
+	con, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c := New(con)
+	c.addr = addr
+	return c, nil
+}
+
+/* The address the client is connected to ("" if it was made by New). */
+func (self *Client) Addr() string {
+	return self.addr
+}
+
+/* Hang up and connect to addr instead. */
+func (self *Client) redirect(addr string) error {
+	con, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	self.con.Close()
+	self.con = con
+	self.r.Reset(con)
+	self.w.Reset(con)
+	self.addr = addr
+	return nil
+}
+
+/* Make a client which talks to a server over an existing connection. */
+func New(con io.ReadWriteCloser) *Client {
+	return &Client{
+		con: con,
+		r:   bufio.NewReader(con),
+		w:   bufio.NewWriter(con),
+	}
+}
+
+func (self *Client) Close() error {
+	return self.con.Close()
+}
+
+/*
+Send a command and read the response. An ERROR response is returned as an
+error. A MOVED response is followed (see Use) if the client was made by Dial.  */
+func (self *Client) call(cmd string, msg []byte) (string, []byte, error) {
+	for i := 0; ; i++ {
+		rcmd, rest, err := self.roundtrip(cmd, msg)
+		moved, is := err.(*MovedError)
+		if !is || self.addr == "" {
+			return rcmd, rest, err
+		} else if i >= maxRedirects {
+			return "", nil, fmt.Errorf("too many redirects (last to %v)", moved.Addr)
+		}
+		if err := self.redirect(moved.Addr); err != nil {
+			return "", nil, err
+		}
+		if self.queue != "" && cmd != "USE" {
+			if _, _, err := self.roundtrip("USE", []byte(self.queue)); err != nil {
+				return "", nil, err
+			}
+		}
+	}
+}
+
+func (self *Client) roundtrip(cmd string, msg []byte) (string, []byte, error) {
+	self.w.WriteString(cmd)
+	if msg != nil {
+		self.w.WriteByte(' ')
+		self.w.Write(msg)
+	}
+	self.w.WriteByte('\n')
+	if err := self.w.Flush(); err != nil {
+		return "", nil, err
+	}
+	line, err := self.r.ReadBytes('\n')
+	if err != nil {
+		return "", nil, err
+	}
+	rcmd, rest := qnet.DecodeCmd(line)
+	if rcmd == "ERROR" {
+		msg, err := qnet.DecodeB64(rest)
+		if err != nil {
+			return "", nil, err
+		}
+		if string(msg) == ErrEmpty.Error() {
+			return "", nil, ErrEmpty
+		}
+		return "", nil, &ServerError{Msg: string(msg)}
+	} else if rcmd == "MOVED" {
+		return "", nil, &MovedError{Addr: string(bytes.TrimSpace(rest))}
+	}
+	return rcmd, rest, nil
+}
+
+func (self *Client) expect(expected string, cmd string, msg []byte) ([]byte, error) {
+	rcmd, rest, err := self.call(cmd, msg)
+	if err != nil {
+		return nil, err
+	}
+	if rcmd != expected {
+		return nil, fmt.Errorf("expected %v got '%v'", expected, rcmd)
+	}
+	return rest, nil
+}
+
+func (self *Client) item(cmd string, msg []byte) (*queue.Item, error) {
+	rest, err := self.expect("ITEM", cmd, msg)
+	if err != nil {
+		return nil, err
+	}
+	return qnet.DecodeItem(rest)
+}
+
+/*
+Use the named queue for the rest of the commands on this connection. If the
+queue is owned by another node of a cluster the client reconnects to that node
+(so the commands which follow go there too) when it was made by Dial, and
+returns a *MovedError when it was made by New. Other commands which are
+redirected (eg. to the leader of a replicated queue) are followed the same way:
+the client reconnects, uses its queue again and resends the command.  */
+func (self *Client) Use(name string) error {
+	if name == "" || strings.ContainsAny(name, " \t\r\n") {
+		return fmt.Errorf("bad queue name '%v'", name)
+	}
+	if _, err := self.expect("OK", "USE", []byte(name)); err != nil {
+		return err
+	}
+	self.queue = name
+	return nil
+}
+
+/* Enque an item. Returns the id the server gave it. */
+func (self *Client) Enque(data []byte, headers map[string]string) (string, error) {
+	return self.enque("ENQUE", data, headers)
+}
+
+/* Send an ENQUE (or ENQUEFRONT), returning ErrDuplicate for a DUPLICATE. */
+func (self *Client) enque(cmd string, data []byte, headers map[string]string) (string, error) {
+	rcmd, rest, err := self.call(cmd, enqueMsg(data, headers))
+	if err != nil {
+		return "", err
+	}
+	id := string(bytes.TrimSpace(rest))
+	switch rcmd {
+	case "OK":
+		return id, nil
+	case "DUPLICATE":
+		return id, ErrDuplicate
+	}
+	return "", fmt.Errorf("expected OK got '%v'", rcmd)
+}
+
+/* The body of an ENQUE (or ENQUEFRONT or RETRY): the data and headers. */
+func enqueMsg(data []byte, headers map[string]string) []byte {
+	msg := make([]byte, base64.StdEncoding.EncodedLen(len(data)))
+	base64.StdEncoding.Encode(msg, data)
+	if len(headers) > 0 {
+		msg = append(msg, ' ')
+		msg = append(msg, qnet.EncodeHeaders(headers)...)
+	}
+	return msg
+}
+
+/* Enque an item onto the front of the queue so it is dequeued next. */
+func (self *Client) EnqueFront(data []byte, headers map[string]string) (string, error) {
+	return self.enque("ENQUEFRONT", data, headers)
+}
+
+func (self *Client) Deque() (*queue.Item, error) {
+	return self.item("DEQUE", nil)
+}
+
+/* Deque the newest item (from the back of the queue). */
+func (self *Client) DequeBack() (*queue.Item, error) {
+	return self.item("DEQUEBACK", nil)
+}
+
+/*
+Tell the server the client is done with an item from a queue of message groups
+(see net.GroupQueue) so the next item of its group can be dequeued. Items which
+aren't acked are redelivered when the connection closes.  */
+func (self *Client) Ack(id string) error {
+	_, err := self.expect("OK", "ACK", []byte(id))
+	return err
+}
+
+/*
+Put back an item the client failed to process. Pass the headers the item was
+dequeued with so the server can count its attempts. It is redelivered after
+the queue's backoff or goes to the queue's failure queue once it is out of
+attempts (see net.RetryPolicy). Returns the item's new id.  */
+func (self *Client) Retry(data []byte, headers map[string]string) (string, error) {
+	rest, err := self.expect("OK", "RETRY", enqueMsg(data, headers))
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSpace(rest)), nil
+}
+
+/* Atomically move the item at the head of src onto dst. */
+func (self *Client) Move(src, dst string) (*queue.Item, error) {
+	return self.item("MOVE", []byte(src+" "+dst))
+}
+
+/*
+Does the queue have an item with this data? Only the (locally computed) hash
+of the data is sent.  */
+func (self *Client) Has(data []byte) (bool, error) {
+	return self.HasHash(queue.Hash(data))
+}
+
+func (self *Client) HasHash(hash []byte) (bool, error) {
+	msg := make([]byte, base64.StdEncoding.EncodedLen(len(hash)))
+	base64.StdEncoding.Encode(msg, hash)
+	rcmd, _, err := self.call("HAS", msg)
+	if err != nil {
+		return false, err
+	}
+	switch rcmd {
+	case "TRUE":
+		return true, nil
+	case "FALSE":
+		return false, nil
+	}
+	return false, fmt.Errorf("expected TRUE or FALSE got '%v'", rcmd)
+}
+
+func (self *Client) Size() (int, error) {
+	rest, err := self.expect("SIZE", "SIZE", nil)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(bytes.TrimSpace(rest)))
+}
+
+/*
+What the queue is holding, as the key=value pairs the server sends back (see
+net.EncodeStats).  */
+func (self *Client) Stats() (map[string]string, error) {
+	rest, err := self.expect("STATS", "STATS", nil)
+	if err != nil {
+		return nil, err
+	}
+	stats := make(map[string]string)
+	for _, field := range bytes.Fields(rest) {
+		kv := bytes.SplitN(field, []byte("="), 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("bad stat '%v'", string(field))
+		}
+		stats[string(kv[0])] = string(kv[1])
+	}
+	return stats, nil
+}
+
+/* The names of all the queues on the server. */
+func (self *Client) Queues() ([]string, error) {
+	rest, err := self.expect("QUEUES", "QUEUES", nil)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, 10)
+	for _, name := range bytes.Fields(rest) {
+		names = append(names, string(name))
+	}
+	return names, nil
+}
+
+/*
+Create a temporary queue with a unique name, eg. for replies. An exclusive
+queue belongs to this client (only it may dequeue from it) and is removed when
+the client closes. If idle > 0 the queue is removed once it hasn't been used
+for that long. The client keeps using its current queue.  */
+func (self *Client) NewQueue(exclusive bool, idle time.Duration) (string, error) {
+	var opts []string
+	if exclusive {
+		opts = append(opts, "exclusive")
+	}
+	if idle > 0 {
+		opts = append(opts, "idle="+strconv.FormatFloat(idle.Seconds(), 'f', -1, 64))
+	}
+	var msg []byte
+	if len(opts) > 0 {
+		msg = []byte(strings.Join(opts, " "))
+	}
+	rest, err := self.expect("QUEUE", "NEWQUEUE", msg)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSpace(rest)), nil
+}
+
+/*
+Watch the named queue (see WATCH). threshold is the size at which above and
+below events are sent, 0 for none. The first event is the queue's current
+size. The client is given over to the watch: don't use it for anything else
+and Close it to stop watching, which closes the channel.  */
+func (self *Client) Watch(name string, threshold int) (<-chan qnet.Event, error) {
+	msg := name
+	if threshold > 0 {
+		msg += " " + strconv.Itoa(threshold)
+	}
+	rest, err := self.expect("EVENT", "WATCH", []byte(msg))
+	if err != nil {
+		return nil, err
+	}
+	first, err := qnet.DecodeEvent(rest)
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan qnet.Event, 16)
+	events <- first
+	go func() {
+		defer close(events)
+		for {
+			line, err := self.r.ReadBytes('\n')
+			if err != nil {
+				return
+			}
+			cmd, rest := qnet.DecodeCmd(line)
+			if cmd != "EVENT" {
+				continue
+			}
+			if ev, err := qnet.DecodeEvent(rest); err == nil {
+				events <- ev
+			}
+		}
+	}()
+	return events, nil
+}
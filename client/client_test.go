@@ -0,0 +1,229 @@
+package client
+
+/* queued
+ * Author: Tim Henderson
+ * Email: tadh@case.edu
+ * Copyright 2013 All Right Reserved
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ *  * Neither the name of the queued nor the names of its contributors may be
+ *    used to endorse or promote products derived from this software without
+ *    specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+import "testing"
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"reflect"
+	"time"
+)
+
+import (
+	qnet "github.com/timtadh/queued/net"
+	"github.com/timtadh/queued/queue"
+)
+
+func connect() *Client {
+	server := qnet.NewServer(func() qnet.Queue { return queue.NewQueue(false) })
+	a, b := net.Pipe()
+	go server.Connection(a).Serve()
+	return New(b)
+}
+
+func TestClient(t *testing.T) {
+	c := connect()
+	defer c.Close()
+	if err := c.Use("jobs"); err != nil {
+		t.Fatal(err)
+	}
+	id, err := c.Enque([]byte("hello"), map[string]string{"kind": "greeting"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Enque([]byte("world"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if dup, err := c.Enque([]byte("hello"), nil); err != ErrDuplicate || dup != id {
+		t.Fatal("expected the id of the first hello", dup, id, err)
+	}
+	if size, err := c.Size(); err != nil || size != 2 {
+		t.Fatal("expected a size of 2", size, err)
+	}
+	if has, err := c.Has([]byte("hello")); err != nil || !has {
+		t.Fatal("expected the queue to have hello", has, err)
+	}
+	if has, err := c.Has([]byte("goodbye")); err != nil || has {
+		t.Fatal("expected the queue not to have goodbye", has, err)
+	}
+	if stats, err := c.Stats(); err != nil || stats["items"] != "2" || stats["ratio"] != "1.00" {
+		t.Fatal("bad stats", stats, err)
+	}
+	if names, err := c.Queues(); err != nil || !reflect.DeepEqual(names, []string{"default", "jobs"}) {
+		t.Fatal("bad queues", names, err)
+	}
+	item, err := c.Deque()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Id != id || !bytes.Equal(item.Data, []byte("hello")) || item.Headers["kind"] != "greeting" {
+		t.Fatal("bad item", item)
+	}
+	item, err = c.Move("jobs", "done")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(item.Data, []byte("world")) {
+		t.Fatal("bad item", item)
+	}
+	if _, err := c.Deque(); err != ErrEmpty {
+		t.Fatal("expected the queue to be empty", err)
+	}
+	c.Enque([]byte("old"), nil)
+	c.EnqueFront([]byte("urgent"), nil)
+	if item, err := c.DequeBack(); err != nil || string(item.Data) != "old" {
+		t.Fatal("expected the newest item", item, err)
+	}
+	if item, err := c.Deque(); err != nil || string(item.Data) != "urgent" {
+		t.Fatal("expected the urgent item", item, err)
+	}
+	if _, err := c.Move("jobs", "done"); err != ErrEmpty {
+		t.Fatal("expected the queue to be empty", err)
+	}
+	if err := c.Use("bad name"); err == nil {
+		t.Fatal("expected an error for a bad name")
+	}
+	name, err := c.NewQueue(true, time.Minute)
+	if err != nil || name == "" {
+		t.Fatal("expected a new queue", name, err)
+	}
+	if err := c.Use(name); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.call("NOPE", nil); err == nil {
+		t.Fatal("expected an error for a bad command")
+	} else if _, ok := err.(*ServerError); !ok {
+		t.Fatal("expected a server error", err)
+	}
+}
+
+/* Serve a node on a free localhost port. */
+func listen(t *testing.T, server *qnet.Server) (string, net.Listener) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			con, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go server.Connection(con).Serve()
+		}
+	}()
+	return ln.Addr().String(), ln
+}
+
+func TestCluster(t *testing.T) {
+	servers := make(map[string]*qnet.Server)
+	var nodes []string
+	for i := 0; i < 3; i++ {
+		server := qnet.NewServer(func() qnet.Queue { return queue.NewQueue(false) })
+		addr, ln := listen(t, server)
+		defer ln.Close()
+		servers[addr] = server
+		nodes = append(nodes, addr)
+	}
+	for addr, server := range servers {
+		if err := server.SetCluster(addr, nodes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := Dial(nodes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("jobs-%d", i)
+		if err := c.Use(name); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Enque([]byte(name), nil); err != nil {
+			t.Fatal(err)
+		}
+		owner, _ := servers[nodes[0]].Owner(name)
+		if c.Addr() != owner {
+			t.Fatal("expected to be redirected to", owner, "got", c.Addr())
+		}
+		if q, has := servers[owner].Lookup(name); !has || q.Size() != 1 {
+			t.Fatal("the item should be on", owner)
+		}
+	}
+
+	// a client made by New doesn't follow redirects
+	a, b := net.Pipe()
+	go servers[nodes[0]].Connection(a).Serve()
+	p := New(b)
+	defer p.Close()
+	for i := 0; ; i++ {
+		name := fmt.Sprintf("jobs-%d", i)
+		if owner, local := servers[nodes[0]].Owner(name); !local {
+			if moved, is := p.Use(name).(*MovedError); !is || moved.Addr != owner {
+				t.Fatal("expected a MOVED error", moved)
+			}
+			break
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	server := qnet.NewServer(func() qnet.Queue { return queue.NewQueue(false) })
+	pipe := func() *Client {
+		a, b := net.Pipe()
+		go server.Connection(a).Serve()
+		return New(b)
+	}
+	w := pipe()
+	events, err := w.Watch("jobs", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev := <-events; ev.Kind != "size" || ev.Size != 0 {
+		t.Fatal("expected the current size", ev)
+	}
+	c := pipe()
+	defer c.Close()
+	c.Use("jobs")
+	c.Enque([]byte("job"), nil)
+	if ev := <-events; ev.Kind != "size" || ev.Size != 1 {
+		t.Fatal("expected the new size", ev)
+	}
+	w.Close()
+	for _ = range events {
+	}
+}
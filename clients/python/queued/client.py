@@ -147,21 +147,29 @@ class Queue(object):
         else:
             raise Exception("bad server response %s %s" % (cmd, data))
 
-    def enque(self, data):
+    def enque(self, data, headers=None):
+        msg = "ENQUE " + data.encode('base64').replace('\n', '')
+        if headers:
+            for key, value in sorted(headers.iteritems()):
+                msg += " %s=%s" % (key, value.encode('base64').replace('\n', ''))
         with self.queue_lock:
-            msg = "ENQUE " + data.encode('base64').replace('\n', '') + '\n'
-            self.conn.send(msg)
-            self.get_enque_response()
+            self.conn.send(msg + '\n')
+            return self.get_enque_response()
 
     def get_enque_response(self):
+        # a DUPLICATE carries the id of the copy already on the queue
         cmd, data = self.get_line()
         if cmd == "ERROR":
             data = data.decode('base64')
             raise Exception(data)
-        elif cmd != "OK":
+        elif cmd != "OK" and cmd != "DUPLICATE":
             raise Exception, "bad command recieved %s" % cmd
+        return data
 
     def deque(self):
+        return self.deque_item()['data']
+
+    def deque_item(self):
         with self.queue_lock:
             self.conn.send("DEQUE\n")
             return self.get_deque_response()
@@ -176,8 +184,18 @@ class Queue(object):
         elif cmd != "ITEM":
             raise Exception, "bad command recieved %s" % cmd
         assert cmd == "ITEM"
-        data = data.decode('base64')
-        return data
+        fields = data.split(' ')
+        headers = dict()
+        for field in fields[4:]:
+            key, value = field.split('=', 1)
+            headers[key] = value.decode('base64')
+        return {
+            'data': fields[0].decode('base64'),
+            'id': fields[1],
+            'enqueued': int(fields[2]),
+            'deliveries': int(fields[3]),
+            'headers': headers,
+        }
 
     def listen(self):
         chunk = ''
@@ -109,19 +109,21 @@ class Queued(host:String, port:Int) {
     }
   }
 
-  def enque(data:String) {
+  def enque(data:String):String = {
     send("ENQUE " + new String(Base64.encodeBase64(data.getBytes())) + "\n")
     check_enque_response()
   }
 
-  def check_enque_response() {
+  def check_enque_response():String = {
+    // a DUPLICATE carries the id of the copy already on the queue
     val line = get_line()
     if (line._1 == "ERROR") {
       val err = new String(Base64.decodeBase64(line._2.getBytes()));
       throw new Exception(err)
-    } else if (line._1 != "OK") {
+    } else if (line._1 != "OK" && line._1 != "DUPLICATE") {
       throw new Exception("Bad command recieved")
     }
+    line._2
   }
 
   def deque():String = {
@@ -140,7 +142,7 @@ class Queued(host:String, port:Int) {
     } else if (line._1 != "ITEM") {
       throw new Exception("Bad command recieved")
     }
-    val data = new String(Base64.decodeBase64(line._2.getBytes()));
+    val data = new String(Base64.decodeBase64(line._2.split(" ")(0).getBytes()));
     return data
   }
 
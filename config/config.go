@@ -0,0 +1,953 @@
+/*
+Package config reads the queued configuration file and applies it to a server.
+The file is JSON. Every field is optional (although a port must come from
+somewhere) and unknown fields are an error:
+
+    {
+        "port": 9001,
+        "resp_port": 6379,
+        "ws_port": 9002,
+        "cluster": {
+            "self": "10.0.0.1:9001",
+            "nodes": ["10.0.0.1:9001", "10.0.0.2:9001", "10.0.0.3:9001"]
+        },
+        "raft": {
+            "self": "10.0.0.1:9001",
+            "nodes": {
+                "10.0.0.1:9001": "10.0.0.1:9101",
+                "10.0.0.2:9001": "10.0.0.2:9101",
+                "10.0.0.3:9001": "10.0.0.3:9101"
+            },
+            "dir": "/var/lib/queued/raft"
+        },
+        "log": {"level": "info", "format": "text", "commands": false},
+        "limits": {
+            "max_item_size": 1048576,
+            "max_line_length": 2097152,
+            "read_timeout": "30s",
+            "write_timeout": "30s",
+            "idle_timeout": "5m",
+            "max_connections": 1000,
+            "hold_timeout": "10m",
+            "conn_rate": "1000:100"
+        },
+        "defaults": {"dedupe": true, "enque_rate": "100"},
+        "queues": {
+            "jobs": {"max_size": 10000, "ttl": "1h", "max_attempts": 5,
+                     "retry_backoff": "1s", "failure_queue": "failed"},
+            "events": {"dedupe": false, "enque_rate": "500:50"},
+            "recent": {"lifo": true},
+            "archive": {"type": "spill", "memory_limit": 67108864},
+            "billing": {"type": "raft"}
+        },
+        "webhooks": [
+            {"url": "https://example.com/hooks/jobs", "queues": ["jobs"],
+             "events": ["enqueued", "above"], "threshold": 5000,
+             "max_attempts": 5, "backoff": "1s"}
+        ]
+    }
+
+The defaults are used for every queue which isn't declared under queues and
+fill in the options a declared queue leaves out. See Queue for the options.
+Rates and durations are written as they are on the command line. A cluster
+splits the named queues between its nodes (see net.SetCluster); self is this
+node's address as the other nodes (and clients) know it. A raft group
+replicates the queues of type raft (see Raft). Each webhook is sent events
+about its queues (see Webhook).
+*/
+package config
+
+/* queued
+ * Author: Tim Henderson
+ * Email: tadh@case.edu
+ * Copyright 2013 All Right Reserved
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ *  * Neither the name of the queued nor the names of its contributors may be
+ *    used to endorse or promote products derived from this software without
+ *    specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	gonet "net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/timtadh/queued/net"
+	"github.com/timtadh/queued/queue"
+	"github.com/timtadh/queued/raft"
+)
+
+type Config struct {
+	Port     int               `json:"port"`
+	RESPPort int               `json:"resp_port"`
+	WSPort   int               `json:"ws_port"`
+	Cluster  Cluster           `json:"cluster"`
+	Raft     Raft              `json:"raft"`
+	Log      Log               `json:"log"`
+	Limits   Limits            `json:"limits"`
+	Defaults Queue             `json:"defaults"`
+	Queues   map[string]*Queue `json:"queues"`
+	Webhooks []Webhook         `json:"webhooks"`
+}
+
+/* Static cluster membership. No nodes, no cluster. */
+type Cluster struct {
+	Self  string   `json:"self"`
+	Nodes []string `json:"nodes"`
+}
+
+/*
+The raft group which replicates the queues of type raft. No nodes, no group.
+
+    self        this node's id: the address clients reach its queued
+                listener on (so it can be sent in MOVED redirects)
+    nodes       every node's id mapped to the address the group talks to it
+                on. This node listens on the port of its own address
+    dir         where the node keeps its log (required)
+    election_timeout
+                how long a follower waits to hear from the leader before
+                starting an election (300ms by default)
+    heartbeat   how often the leader sends heartbeats (50ms by default)  */
+type Raft struct {
+	Self            string            `json:"self"`
+	Nodes           map[string]string `json:"nodes"`
+	Dir             string            `json:"dir"`
+	ElectionTimeout Duration          `json:"election_timeout"`
+	Heartbeat       Duration          `json:"heartbeat"`
+}
+
+/*
+An HTTP endpoint which is sent events about some queues (see net.Webhook).
+
+    url         where the events are POSTed
+    queues      the queues to send events about
+    events      the kinds of event to send: enqueued, above, below, expired,
+                size, empty or nonempty
+    threshold   the queue size for above and below events
+    max_attempts
+                how many times to try to deliver an event (0, the default,
+                keeps trying)
+    backoff     how long to wait before the first retry (1s by default), it
+                doubles with every retry
+    max_backoff the longest to wait between retries (no limit by default)
+    timeout     how long a request may take (10s by default)  */
+type Webhook struct {
+	URL         string   `json:"url"`
+	Queues      []string `json:"queues"`
+	Events      []string `json:"events"`
+	Threshold   int      `json:"threshold"`
+	MaxAttempts int      `json:"max_attempts"`
+	Backoff     Duration `json:"backoff"`
+	MaxBackoff  Duration `json:"max_backoff"`
+	Timeout     Duration `json:"timeout"`
+}
+
+/* The webhook as the server wants it. */
+func (self Webhook) Net() net.Webhook {
+	return net.Webhook{
+		URL:         self.URL,
+		Queues:      self.Queues,
+		Events:      self.Events,
+		Threshold:   self.Threshold,
+		MaxAttempts: self.MaxAttempts,
+		Backoff:     time.Duration(self.Backoff),
+		MaxBackoff:  time.Duration(self.MaxBackoff),
+		Timeout:     time.Duration(self.Timeout),
+	}
+}
+
+type Log struct {
+	Level    string `json:"level"`
+	Format   string `json:"format"`
+	Commands bool   `json:"commands"`
+}
+
+/* The server wide limits. See net.Limits. */
+type Limits struct {
+	MaxItemSize    int      `json:"max_item_size"`
+	MaxLineLength  int      `json:"max_line_length"`
+	ReadTimeout    Duration `json:"read_timeout"`
+	WriteTimeout   Duration `json:"write_timeout"`
+	IdleTimeout    Duration `json:"idle_timeout"`
+	MaxConnections int      `json:"max_connections"`
+	HoldTimeout    Duration `json:"hold_timeout"`
+	ConnRate       Rate     `json:"conn_rate"`
+}
+
+/*
+The options for a queue. A declared queue gets any option it leaves out from
+the defaults.
+
+    type        how the queue is stored. memory (the default) keeps every item
+                in memory. spill keeps about memory_limit bytes of items in
+                memory and writes the rest to files under spill_dir (see
+                queue.SpillQueue). grouped keeps items in message groups
+                (see queue.GroupQueue). raft replicates the queue across the
+                raft group (see raft.Queues); it can't be the default
+    dedupe      ignore an item if an identical one is already on the queue
+                (true by default)
+    max_size    the most items the queue may hold. An ENQUE onto a full queue
+                gets an ERROR. A negative size means no limit
+    ttl         items which have waited longer than this are dropped instead of
+                being dequeued. A negative ttl means no limit
+    enque_rate  the ENQUEs per second allowed on the queue
+    deque_rate  the DEQUEs per second allowed on the queue
+    spill_dir   where a spill queue writes its files (the system temporary
+                directory by default)
+    memory_limit
+                the bytes of items a spill queue keeps in memory (64MB by
+                default)
+    compress    compress (with flate) the data of items while they are on the
+                queue (false by default)
+    compress_min_size
+                items smaller than this are not compressed (128 by default)
+    max_attempts
+                how many times an item may be RETRYed before it goes to the
+                failure queue. A negative number means no limit
+    retry_backoff
+                how long the first RETRY of an item waits before it is enqued
+                again. Each RETRY after that waits twice as long
+    retry_max_backoff
+                the longest a RETRY waits. A negative duration means no limit
+    failure_queue
+                where items go once they are out of attempts (they are
+                dropped if there isn't one)
+    lifo        DEQUE hands out the newest item rather than the oldest (false
+                by default). Only memory queues can be LIFO  */
+type Queue struct {
+	Type         string   `json:"type"`
+	Dedupe       *bool    `json:"dedupe"`
+	MaxSize      int      `json:"max_size"`
+	TTL          Duration `json:"ttl"`
+	EnqueRate    *Rate    `json:"enque_rate"`
+	DequeRate    *Rate    `json:"deque_rate"`
+	SpillDir     string   `json:"spill_dir"`
+	MemoryLimit  int      `json:"memory_limit"`
+	Compress     *bool    `json:"compress"`
+	CompressMin  int      `json:"compress_min_size"`
+	MaxAttempts  int      `json:"max_attempts"`
+	Backoff      Duration `json:"retry_backoff"`
+	MaxBackoff   Duration `json:"retry_max_backoff"`
+	FailureQueue string   `json:"failure_queue"`
+	LIFO         *bool    `json:"lifo"`
+}
+
+/* A time.Duration written as a string, eg. "30s". */
+type Duration time.Duration
+
+func (self Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(self).String())
+}
+
+func (self *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("expected a duration (eg. \"30s\") got %v", string(data))
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*self = Duration(d)
+	return nil
+}
+
+/* A net.Rate written as a string, eg. "100" or "0.5:10". */
+type Rate net.Rate
+
+func (self Rate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(net.Rate(self).String())
+}
+
+func (self *Rate) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("expected a rate (eg. \"100:10\") got %v", string(data))
+	}
+	rate, err := net.ParseRate(s)
+	if err != nil {
+		return err
+	}
+	*self = Rate(rate)
+	return nil
+}
+
+var log *slog.Logger
+
+func init() {
+	SetLogger(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+}
+
+/*
+Set the logger for this package. Every record gets a pkg=queued/config
+attribute.  */
+func SetLogger(logger *slog.Logger) {
+	log = logger.With("pkg", "queued/config")
+}
+
+const defaultMemoryLimit = 64 * 1024 * 1024
+const defaultCompressMin = 128
+
+/* The queues which can compress their items. */
+type compressor interface {
+	SetCompression(minSize int)
+}
+
+/* The queues which can be LIFO. */
+type stack interface {
+	SetLIFO(on bool)
+}
+
+/*
+The ways a queue may be stored. Each maker is given the queue's name and its
+options (with the defaults filled in).  */
+var types = map[string]func(name string, opts *Queue) (net.Queue, error){
+	"memory": func(name string, opts *Queue) (net.Queue, error) {
+		return queue.NewQueue(!*opts.Dedupe), nil
+	},
+	"spill": func(name string, opts *Queue) (net.Queue, error) {
+		dir := opts.SpillDir
+		if dir == "" {
+			dir = os.TempDir()
+		}
+		limit := opts.MemoryLimit
+		if limit == 0 {
+			limit = defaultMemoryLimit
+		}
+		return queue.NewSpillQueue(dir, name, limit, !*opts.Dedupe)
+	},
+	"grouped": func(name string, opts *Queue) (net.Queue, error) {
+		return queue.NewGroupQueue(!*opts.Dedupe), nil
+	},
+	"raft": func(name string, opts *Queue) (net.Queue, error) {
+		group := raftGroup()
+		if group == nil {
+			return nil, fmt.Errorf("the raft group isn't started")
+		}
+		return group.Queue(name, !*opts.Dedupe), nil
+	},
+}
+
+var group struct {
+	sync.Mutex
+	queues *raft.Queues
+}
+
+func raftGroup() *raft.Queues {
+	group.Lock()
+	defer group.Unlock()
+	return group.queues
+}
+
+/*
+Start this node of the raft group (if there is one) which the queues of type
+raft are made in. Call it before Apply. The node serves the other nodes on the
+port of its own address.  */
+func (self *Config) StartRaft() (*raft.Queues, error) {
+	conf := self.Raft
+	if len(conf.Nodes) == 0 {
+		return nil, nil
+	}
+	group.Lock()
+	defer group.Unlock()
+	if group.queues != nil {
+		return nil, fmt.Errorf("the raft group is already started")
+	}
+	_, port, err := gonet.SplitHostPort(conf.Nodes[conf.Self])
+	if err != nil {
+		return nil, err
+	}
+	ln, err := gonet.Listen("tcp", ":"+port)
+	if err != nil {
+		return nil, err
+	}
+	storage, err := raft.NewFileStorage(conf.Dir)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	rconf := raft.DefaultConfig()
+	if conf.ElectionTimeout > 0 {
+		rconf.ElectionTimeout = time.Duration(conf.ElectionTimeout)
+	}
+	if conf.Heartbeat > 0 {
+		rconf.Heartbeat = time.Duration(conf.Heartbeat)
+	}
+	ids := make([]string, 0, len(conf.Nodes))
+	for id := range conf.Nodes {
+		ids = append(ids, id)
+	}
+	transport := raft.NewRPCTransport(conf.Nodes, rconf.ElectionTimeout)
+	queues, err := raft.NewQueues(conf.Self, ids, transport, storage, rconf)
+	if err != nil {
+		ln.Close()
+		storage.Close()
+		return nil, err
+	}
+	go raft.Serve(ln, queues.Node())
+	group.queues = queues
+	return queues, nil
+}
+
+/* The configuration used when there is no configuration file. */
+func Default() *Config {
+	dedupe := true
+	return &Config{
+		Log: Log{
+			Level:  "info",
+			Format: "text",
+		},
+		Defaults: Queue{
+			Type:   "memory",
+			Dedupe: &dedupe,
+		},
+		Queues: make(map[string]*Queue),
+	}
+}
+
+/* Read and validate the configuration file at path. */
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	conf, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return conf, nil
+}
+
+/*
+Parse and validate a configuration. Anything the configuration leaves out is
+taken from Default().  */
+func Parse(data []byte) (*Config, error) {
+	conf := Default()
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(conf); err != nil {
+		return nil, err
+	}
+	if conf.Queues == nil {
+		conf.Queues = make(map[string]*Queue)
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func (self *Config) Validate() error {
+	if self.Port < 0 || self.Port > 65535 {
+		return fmt.Errorf("bad port %v", self.Port)
+	}
+	if self.RESPPort < 0 || self.RESPPort > 65535 {
+		return fmt.Errorf("bad resp_port %v", self.RESPPort)
+	}
+	if self.WSPort < 0 || self.WSPort > 65535 {
+		return fmt.Errorf("bad ws_port %v", self.WSPort)
+	}
+	if err := self.Cluster.validate(); err != nil {
+		return err
+	}
+	if err := self.Raft.validate(); err != nil {
+		return err
+	}
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(self.Log.Level)); err != nil {
+		return fmt.Errorf("bad log level '%v'", self.Log.Level)
+	}
+	if self.Log.Format != "text" && self.Log.Format != "json" {
+		return fmt.Errorf("bad log format '%v' expected text or json", self.Log.Format)
+	}
+	l := self.Limits
+	if l.MaxItemSize < 0 || l.MaxLineLength < 0 || l.MaxConnections < 0 {
+		return fmt.Errorf("limits can't be negative")
+	}
+	if l.ReadTimeout < 0 || l.WriteTimeout < 0 || l.IdleTimeout < 0 || l.HoldTimeout < 0 {
+		return fmt.Errorf("timeouts can't be negative")
+	}
+	if self.Defaults.Type == "" {
+		self.Defaults.Type = "memory"
+	}
+	if self.Defaults.Dedupe == nil {
+		dedupe := true
+		self.Defaults.Dedupe = &dedupe
+	}
+	if err := self.Defaults.validate(); err != nil {
+		return fmt.Errorf("defaults: %v", err)
+	}
+	if self.Defaults.Type == "raft" {
+		return fmt.Errorf("defaults: raft queues must be declared")
+	}
+	for _, hook := range self.Webhooks {
+		h := hook.Net()
+		if err := h.Validate(); err != nil {
+			return err
+		}
+	}
+	for name, q := range self.Queues {
+		if q == nil {
+			return fmt.Errorf("queue '%v' has no options", name)
+		}
+		if err := q.validate(); err != nil {
+			return fmt.Errorf("queue '%v': %v", name, err)
+		}
+		if q.Type == "raft" && len(self.Raft.Nodes) == 0 {
+			return fmt.Errorf("queue '%v': raft queues need a raft group", name)
+		}
+		if q.FailureQueue == name {
+			return fmt.Errorf("queue '%v' can't be its own failure queue", name)
+		}
+	}
+	return nil
+}
+
+func (self *Cluster) validate() error {
+	if len(self.Nodes) == 0 {
+		if self.Self != "" {
+			return fmt.Errorf("cluster self given without any nodes")
+		}
+		return nil
+	}
+	seen := make(map[string]bool)
+	for _, node := range self.Nodes {
+		if _, _, err := gonet.SplitHostPort(node); err != nil {
+			return fmt.Errorf("bad cluster node '%v', %v", node, err)
+		}
+		if seen[node] {
+			return fmt.Errorf("cluster node %v is listed twice", node)
+		}
+		seen[node] = true
+	}
+	if !seen[self.Self] {
+		return fmt.Errorf("cluster self '%v' is not one of the nodes", self.Self)
+	}
+	return nil
+}
+
+func (self *Raft) validate() error {
+	if len(self.Nodes) == 0 {
+		if self.Self != "" || self.Dir != "" {
+			return fmt.Errorf("raft self or dir given without any nodes")
+		}
+		return nil
+	}
+	for id, addr := range self.Nodes {
+		if _, _, err := gonet.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("bad raft address '%v' for %v, %v", addr, id, err)
+		}
+	}
+	if _, has := self.Nodes[self.Self]; !has {
+		return fmt.Errorf("raft self '%v' is not one of the nodes", self.Self)
+	}
+	if self.Dir == "" {
+		return fmt.Errorf("raft needs a dir")
+	}
+	if self.ElectionTimeout < 0 || self.Heartbeat < 0 {
+		return fmt.Errorf("raft timeouts can't be negative")
+	}
+	return nil
+}
+
+func (self *Raft) equal(other *Raft) bool {
+	if self.Self != other.Self || self.Dir != other.Dir || len(self.Nodes) != len(other.Nodes) ||
+		self.ElectionTimeout != other.ElectionTimeout || self.Heartbeat != other.Heartbeat {
+		return false
+	}
+	for id, addr := range self.Nodes {
+		if other.Nodes[id] != addr {
+			return false
+		}
+	}
+	return true
+}
+
+func (self *Cluster) equal(other *Cluster) bool {
+	if self.Self != other.Self || len(self.Nodes) != len(other.Nodes) {
+		return false
+	}
+	for i := range self.Nodes {
+		if self.Nodes[i] != other.Nodes[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (self *Queue) validate() error {
+	if _, has := types[self.Type]; self.Type != "" && !has {
+		return fmt.Errorf("unknown queue type '%v'", self.Type)
+	}
+	if self.MemoryLimit < 0 {
+		return fmt.Errorf("memory_limit can't be negative")
+	}
+	if self.CompressMin < 0 {
+		return fmt.Errorf("compress_min_size can't be negative")
+	}
+	if self.Backoff < 0 {
+		return fmt.Errorf("retry_backoff can't be negative")
+	}
+	if self.LIFO != nil && *self.LIFO && self.Type != "" && self.Type != "memory" {
+		return fmt.Errorf("only memory queues can be lifo")
+	}
+	return nil
+}
+
+/* The log level. Only valid after Validate. */
+func (self Log) SlogLevel() slog.Level {
+	var lvl slog.Level
+	lvl.UnmarshalText([]byte(self.Level))
+	return lvl
+}
+
+/* The limits as the server wants them. */
+func (self Limits) Net() net.Limits {
+	return net.Limits{
+		MaxItemSize:    self.MaxItemSize,
+		MaxLineLength:  self.MaxLineLength,
+		ReadTimeout:    time.Duration(self.ReadTimeout),
+		WriteTimeout:   time.Duration(self.WriteTimeout),
+		IdleTimeout:    time.Duration(self.IdleTimeout),
+		MaxConnections: self.MaxConnections,
+		HoldTimeout:    time.Duration(self.HoldTimeout),
+	}
+}
+
+/*
+The options for the named queue: its declared options with the defaults
+filled in or the defaults if it isn't declared.  */
+func (self *Config) Queue(name string) *Queue {
+	q, has := self.Queues[name]
+	if !has {
+		d := self.Defaults
+		return &d
+	}
+	opts := *q
+	if opts.Type == "" {
+		opts.Type = self.Defaults.Type
+	}
+	if opts.Dedupe == nil {
+		opts.Dedupe = self.Defaults.Dedupe
+	}
+	if opts.MaxSize == 0 {
+		opts.MaxSize = self.Defaults.MaxSize
+	}
+	if opts.TTL == 0 {
+		opts.TTL = self.Defaults.TTL
+	}
+	if opts.EnqueRate == nil {
+		opts.EnqueRate = self.Defaults.EnqueRate
+	}
+	if opts.DequeRate == nil {
+		opts.DequeRate = self.Defaults.DequeRate
+	}
+	if opts.SpillDir == "" {
+		opts.SpillDir = self.Defaults.SpillDir
+	}
+	if opts.MemoryLimit == 0 {
+		opts.MemoryLimit = self.Defaults.MemoryLimit
+	}
+	if opts.Compress == nil {
+		opts.Compress = self.Defaults.Compress
+	}
+	if opts.CompressMin == 0 {
+		opts.CompressMin = self.Defaults.CompressMin
+	}
+	if opts.MaxAttempts == 0 {
+		opts.MaxAttempts = self.Defaults.MaxAttempts
+	}
+	if opts.Backoff == 0 {
+		opts.Backoff = self.Defaults.Backoff
+	}
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = self.Defaults.MaxBackoff
+	}
+	if opts.FailureQueue == "" {
+		opts.FailureQueue = self.Defaults.FailureQueue
+	}
+	if opts.LIFO == nil {
+		opts.LIFO = self.Defaults.LIFO
+	}
+	return &opts
+}
+
+/*
+A creator (see net.NewServer) for the named queue. Queues are wrapped in a
+net.BoundedQueue so their max size and ttl can be changed by a reload. If the
+queue can't be made (eg. a spill queue's directory can't be created) the error
+is logged and an in memory queue is used instead, except for a raft queue: an
+unreplicated copy would quietly lose what it was declared to keep, so every
+ENQUE and DEQUE on it fails instead.  */
+func (self *Config) Creator(name string) func() net.Queue {
+	return creator(name, self.Queue(name))
+}
+
+/* A queue which couldn't be made. Every ENQUE and DEQUE on it fails with err. */
+type brokenQueue struct {
+	err error
+}
+
+func (self *brokenQueue) Enque(item *queue.Item) error {
+	return self.err
+}
+
+func (self *brokenQueue) Deque() (*queue.Item, error) {
+	return nil, self.err
+}
+
+/* Never empty, so that a DEQUE gets err rather than being told to wait. */
+func (self *brokenQueue) Empty() bool {
+	return false
+}
+
+func (self *brokenQueue) Has(hash []byte) bool {
+	return false
+}
+
+func (self *brokenQueue) Size() int {
+	return 0
+}
+
+func creator(name string, opts *Queue) func() net.Queue {
+	return func() net.Queue {
+		q, err := types[opts.Type](name, opts)
+		if err != nil && opts.Type == "raft" {
+			log.Error("could not create queue, refusing its commands", "queue", name, "type", opts.Type, "err", err)
+			return &brokenQueue{err: fmt.Errorf("queue '%v' is unavailable: %v", name, err)}
+		} else if err != nil {
+			log.Error("could not create queue, using an in memory queue", "queue", name, "type", opts.Type, "err", err)
+			q = queue.NewQueue(!*opts.Dedupe)
+		}
+		if c, ok := q.(compressor); ok {
+			c.SetCompression(opts.compression())
+		}
+		if s, ok := q.(stack); ok {
+			s.SetLIFO(opts.lifo())
+		}
+		return net.NewBoundedQueue(q, opts.bound(), opts.ttl())
+	}
+}
+
+func (self *Queue) bound() int {
+	if self.MaxSize < 0 {
+		return 0
+	}
+	return self.MaxSize
+}
+
+/* The minSize for SetCompression, 0 if compression is off. */
+func (self *Queue) compression() int {
+	if self.Compress == nil || !*self.Compress {
+		return 0
+	}
+	if self.CompressMin <= 0 {
+		return defaultCompressMin
+	}
+	return self.CompressMin
+}
+
+func (self *Queue) lifo() bool {
+	return self.LIFO != nil && *self.LIFO
+}
+
+func (self *Queue) ttl() time.Duration {
+	if self.TTL < 0 {
+		return 0
+	}
+	return time.Duration(self.TTL)
+}
+
+/* The queue's net.RetryPolicy. */
+func (self *Queue) retry() net.RetryPolicy {
+	policy := net.RetryPolicy{
+		Backoff:      time.Duration(self.Backoff),
+		FailureQueue: self.FailureQueue,
+	}
+	if self.MaxAttempts > 0 {
+		policy.MaxAttempts = self.MaxAttempts
+	}
+	if self.MaxBackoff > 0 {
+		policy.MaxBackoff = time.Duration(self.MaxBackoff)
+	}
+	return policy
+}
+
+func rate(r *Rate) net.Rate {
+	if r == nil {
+		return net.Rate{}
+	}
+	return net.Rate(*r)
+}
+
+/*
+Apply the configuration to a server. Everything except the listener ports and
+the logger (which belong to whoever starts the server) is applied:
+
+    - the limits, rates, retry policies and command logging
+    - the webhooks (which are restarted, dropping undelivered events)
+    - the declared queues are created if they don't exist
+    - queues created from now on use the new options
+    - existing queues get their new max size, ttl, compression and lifo
+
+It is safe to apply a configuration to a running server. Use Reload to replace
+one configuration with another.  */
+func (self *Config) Apply(server *net.Server) {
+	if err := server.SetCluster(self.Cluster.Self, self.Cluster.Nodes); err != nil {
+		log.Error("could not join the cluster", "err", err)
+	}
+	server.SetLimits(self.Limits.Net())
+	server.SetCommandLogging(self.Log.Commands)
+	server.SetConnectionRate(net.Rate(self.Limits.ConnRate))
+	server.SetDefaultQueueRate(rate(self.Defaults.EnqueRate), rate(self.Defaults.DequeRate))
+	server.SetDefaultRetryPolicy(self.Defaults.retry())
+	hooks := make([]net.Webhook, 0, len(self.Webhooks))
+	for _, hook := range self.Webhooks {
+		hooks = append(hooks, hook.Net())
+	}
+	if err := server.SetWebhooks(hooks); err != nil {
+		log.Error("could not set the webhooks", "err", err)
+	}
+	server.SetCreator(creator("", &self.Defaults))
+	for _, name := range self.names() {
+		opts := self.Queue(name)
+		if _, local := server.Owner(name); local {
+			server.Declare(name, creator(name, opts))
+		}
+		q := self.Queues[name]
+		if q.EnqueRate != nil || q.DequeRate != nil {
+			server.SetQueueRate(name, rate(opts.EnqueRate), rate(opts.DequeRate))
+		} else {
+			server.ClearQueueRate(name)
+		}
+		server.SetRetryPolicy(name, opts.retry())
+	}
+	for _, name := range server.Names() {
+		q, has := server.Lookup(name)
+		if !has {
+			continue
+		}
+		if bq, ok := q.(*net.BoundedQueue); ok {
+			opts := self.Queue(name)
+			bq.SetMaxSize(opts.bound())
+			bq.SetTTL(opts.ttl())
+			if c, ok := bq.Unwrap().(compressor); ok {
+				c.SetCompression(opts.compression())
+			}
+			if s, ok := bq.Unwrap().(stack); ok {
+				s.SetLIFO(opts.lifo())
+			}
+		}
+	}
+}
+
+/*
+Replace the old configuration of a running server with this one. Queues which
+are no longer declared are left alone but lose their own rates and retry
+policies (and will be created like any other queue if they are removed).
+Returns a description of every change which could not be applied to the
+running server (and those changes, such as to the cluster, are dropped from
+this configuration).  */
+func (self *Config) Reload(server *net.Server, old *Config) []string {
+	var skipped []string
+	if raftGroup() == nil {
+		// a raft queue can't be added without a group (the old declaration,
+		// if there is one, is kept)
+		for _, name := range self.names() {
+			if self.Queues[name].Type != "raft" {
+				continue
+			}
+			skipped = append(skipped, fmt.Sprintf("queue '%v' is of type raft but the raft group isn't running", name))
+			if was, has := old.Queues[name]; has {
+				self.Queues[name] = was
+			} else {
+				delete(self.Queues, name)
+			}
+		}
+	}
+	for name := range old.Queues {
+		if _, has := self.Queues[name]; !has {
+			server.Undeclare(name)
+			server.ClearQueueRate(name)
+			server.ClearRetryPolicy(name)
+		}
+	}
+	if !self.Cluster.equal(&old.Cluster) {
+		skipped = append(skipped, "cluster changed")
+		self.Cluster = old.Cluster
+	}
+	if !self.Raft.equal(&old.Raft) {
+		skipped = append(skipped, "raft changed")
+		self.Raft = old.Raft
+	}
+	self.Apply(server)
+	if self.Port != old.Port {
+		skipped = append(skipped, fmt.Sprintf("port changed from %v to %v", old.Port, self.Port))
+	}
+	if self.RESPPort != old.RESPPort {
+		skipped = append(skipped, fmt.Sprintf("resp_port changed from %v to %v", old.RESPPort, self.RESPPort))
+	}
+	if self.WSPort != old.WSPort {
+		skipped = append(skipped, fmt.Sprintf("ws_port changed from %v to %v", old.WSPort, self.WSPort))
+	}
+	if self.Log.Format != old.Log.Format {
+		skipped = append(skipped, fmt.Sprintf("log format changed from %v to %v", old.Log.Format, self.Log.Format))
+	}
+	for _, name := range server.Names() {
+		was, now := old.Queue(name), self.Queue(name)
+		if was.Type != now.Type {
+			skipped = append(skipped, fmt.Sprintf(
+				"queue '%v' type changed from %v to %v", name, was.Type, now.Type))
+		}
+		if was.Type == "spill" && now.Type == "spill" &&
+			(was.SpillDir != now.SpillDir || was.MemoryLimit != now.MemoryLimit) {
+			skipped = append(skipped, fmt.Sprintf(
+				"queue '%v' spill_dir or memory_limit changed", name))
+		}
+		if *was.Dedupe != *now.Dedupe {
+			skipped = append(skipped, fmt.Sprintf(
+				"queue '%v' dedupe changed from %v to %v", name, *was.Dedupe, *now.Dedupe))
+		}
+	}
+	return skipped
+}
+
+/* The declared queue names, sorted. */
+func (self *Config) names() []string {
+	names := make([]string, 0, len(self.Queues))
+	for name := range self.Queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
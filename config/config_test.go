@@ -0,0 +1,218 @@
+package config
+
+/* queued
+ * Author: Tim Henderson
+ * Email: tadh@case.edu
+ * Copyright 2013 All Right Reserved
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ *  * Neither the name of the queued nor the names of its contributors may be
+ *    used to endorse or promote products derived from this software without
+ *    specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+import "testing"
+
+import (
+	"bytes"
+	"time"
+)
+
+import (
+	"github.com/timtadh/queued/net"
+	"github.com/timtadh/queued/queue"
+)
+
+func TestParse(t *testing.T) {
+	conf, err := Parse([]byte(`{
+		"port": 9001,
+		"limits": {"max_item_size": 1024, "idle_timeout": "5m", "hold_timeout": "1m", "conn_rate": "10:5"},
+		"defaults": {"enque_rate": "100", "retry_backoff": "1s"},
+		"queues": {
+			"jobs": {"max_size": 10, "ttl": "1h", "max_attempts": 3, "failure_queue": "failed"},
+			"events": {"dedupe": false, "max_size": -1},
+			"archive": {"type": "spill", "spill_dir": "/tmp"}
+		},
+		"webhooks": [
+			{"url": "http://localhost:8080/hook", "queues": ["jobs"], "events": ["enqueued", "above"],
+			 "threshold": 5, "max_attempts": 3, "backoff": "2s", "timeout": "1s"}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Port != 9001 || conf.Log.Level != "info" {
+		t.Fatal("expected the port and the default log level", conf.Port, conf.Log.Level)
+	}
+	limits := conf.Limits.Net()
+	if limits.MaxItemSize != 1024 || limits.IdleTimeout != 5*time.Minute || limits.HoldTimeout != time.Minute {
+		t.Fatal("bad limits", limits)
+	}
+	if net.Rate(conf.Limits.ConnRate) != (net.Rate{PerSecond: 10, Burst: 5}) {
+		t.Fatal("bad conn rate", conf.Limits.ConnRate)
+	}
+	jobs := conf.Queue("jobs")
+	if jobs.Type != "memory" || !*jobs.Dedupe || jobs.bound() != 10 || jobs.ttl() != time.Hour {
+		t.Fatal("bad jobs options", jobs)
+	}
+	if jobs.EnqueRate == nil || jobs.EnqueRate.PerSecond != 100 {
+		t.Fatal("expected jobs to get the default enque rate")
+	}
+	policy := net.RetryPolicy{MaxAttempts: 3, Backoff: time.Second, FailureQueue: "failed"}
+	if jobs.retry() != policy {
+		t.Fatal("bad jobs retry policy", jobs.retry())
+	}
+	events := conf.Queue("events")
+	if *events.Dedupe || events.bound() != 0 {
+		t.Fatal("bad events options", events)
+	}
+	if archive := conf.Queue("archive"); archive.Type != "spill" || archive.SpillDir != "/tmp" {
+		t.Fatal("bad archive options", archive)
+	}
+	if len(conf.Webhooks) != 1 {
+		t.Fatal("expected a webhook", conf.Webhooks)
+	}
+	hook := conf.Webhooks[0].Net()
+	if hook.URL != "http://localhost:8080/hook" || hook.Threshold != 5 || hook.MaxAttempts != 3 ||
+		hook.Backoff != 2*time.Second || hook.Timeout != time.Second || len(hook.Events) != 2 {
+		t.Fatal("bad webhook", hook)
+	}
+	if other := conf.Queue("other"); other.Type != "memory" || !*other.Dedupe {
+		t.Fatal("expected other to get the defaults", other)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	bad := []string{
+		`{"port": 70000}`,
+		`{"prot": 9001}`,
+		`{"limits": {"read_timeout": 30}}`,
+		`{"limits": {"hold_timeout": "-1s"}}`,
+		`{"limits": {"conn_rate": "fast"}}`,
+		`{"log": {"format": "xml"}}`,
+		`{"queues": {"jobs": {"type": "paper"}}}`,
+		`{"queues": {"jobs": null}}`,
+		`{"cluster": {"self": "a:1", "nodes": ["b:1", "c:1"]}}`,
+		`{"cluster": {"self": "a:1", "nodes": ["a:1", "a:1"]}}`,
+		`{"cluster": {"self": "a", "nodes": ["a"]}}`,
+		`{"queues": {"billing": {"type": "raft"}}}`,
+		`{"defaults": {"type": "raft"}, "raft": {"self": "a:1", "nodes": {"a:1": "a:2"}, "dir": "/tmp"}}`,
+		`{"raft": {"self": "a:1", "nodes": {"a:1": "a:2"}}}`,
+		`{"queues": {"jobs": {"failure_queue": "jobs"}}}`,
+		`{"defaults": {"retry_backoff": "-1s"}}`,
+		`{"queues": {"archive": {"type": "spill", "lifo": true}}}`,
+		`{"webhooks": [{"url": "localhost", "queues": ["jobs"], "events": ["enqueued"]}]}`,
+		`{"webhooks": [{"url": "http://localhost", "queues": ["jobs"], "events": ["deleted"]}]}`,
+		`{"webhooks": [{"url": "http://localhost", "queues": ["jobs"], "events": ["above"]}]}`,
+		`{"webhooks": [{"url": "http://localhost", "events": ["enqueued"]}]}`,
+	}
+	for _, conf := range bad {
+		if _, err := Parse([]byte(conf)); err == nil {
+			t.Fatal("expected an error for", conf)
+		}
+	}
+}
+
+func TestApplyAndReload(t *testing.T) {
+	old, err := Parse([]byte(`{"port": 9001, "queues": {"jobs": {"max_size": 1}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := net.NewServer(old.Creator("default"))
+	old.Apply(server)
+	q, has := server.Lookup("jobs")
+	if !has {
+		t.Fatal("expected jobs to be declared")
+	}
+	if err := q.Enque(queue.NewItem([]byte("a"), nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Enque(queue.NewItem([]byte("b"), nil)); err == nil {
+		t.Fatal("expected jobs to be full")
+	}
+
+	next, err := Parse([]byte(`{
+		"port": 9002,
+		"limits": {"max_connections": 5},
+		"queues": {"jobs": {"max_size": 3, "dedupe": false, "compress": true, "compress_min_size": 16}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	skipped := next.Reload(server, old)
+	if len(skipped) != 2 {
+		t.Fatal("expected the port and dedupe changes to be skipped", skipped)
+	}
+	if server.Limits().MaxConnections != 5 {
+		t.Fatal("expected the new limits to be applied")
+	}
+	if err := q.Enque(queue.NewItem([]byte("b"), nil)); err != nil {
+		t.Fatal("expected the new max size to be applied", err)
+	}
+	big := bytes.Repeat([]byte(`{"key": "value"} `), 100)
+	if err := q.Enque(queue.NewItem(big, nil)); err != nil {
+		t.Fatal(err)
+	}
+	stats := net.QueueStats(q)
+	if stats.Compressed != 1 || stats.Ratio() < 2 {
+		t.Fatal("expected the new compression to be applied", stats)
+	}
+
+	// without a running raft group a raft queue can't be added by a reload
+	withRaft, err := Parse([]byte(`{
+		"port": 9002,
+		"raft": {"self": "a:1", "nodes": {"a:1": "a:2"}, "dir": "/tmp"},
+		"queues": {"jobs": {"dedupe": false}, "billing": {"type": "raft"}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	skipped = withRaft.Reload(server, next)
+	if len(skipped) != 2 || skipped[0] != "queue 'billing' is of type raft but the raft group isn't running" {
+		t.Fatal("expected the raft queue and group to be skipped", skipped)
+	}
+	if _, has := withRaft.Queues["billing"]; has {
+		t.Fatal("expected billing to be dropped from the configuration")
+	}
+}
+
+func TestRaftQueueWithoutGroup(t *testing.T) {
+	conf, err := Parse([]byte(`{
+		"raft": {"self": "a:1", "nodes": {"a:1": "a:2"}, "dir": "/tmp"},
+		"queues": {"billing": {"type": "raft"}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := conf.Creator("billing")()
+	if err := q.Enque(queue.NewItem([]byte("a"), nil)); err == nil {
+		t.Fatal("a raft queue without a group shouldn't accept items")
+	}
+	if q.Empty() {
+		t.Fatal("a DEQUE should get the error rather than an empty queue")
+	}
+	if _, err := q.Deque(); err == nil {
+		t.Fatal("a raft queue without a group shouldn't be dequeued from")
+	}
+}
@@ -39,8 +39,13 @@ package main
 
 import (
 	"fmt"
+	"log/slog"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 import (
@@ -48,8 +53,10 @@ import (
 )
 
 import (
+	"github.com/timtadh/queued/config"
 	"github.com/timtadh/queued/net"
 	"github.com/timtadh/queued/queue"
+	"github.com/timtadh/queued/raft"
 )
 
 var ErrorCodes map[string]int = map[string]int{
@@ -57,19 +64,71 @@ var ErrorCodes map[string]int = map[string]int{
 	"version": 2,
 	"opts":    3,
 	"badint":  5,
+	"badrate": 6,
+	"baddur":  7,
+	"badlog":  8,
+	"badconf": 9,
+	"bench":   10,
+	"raft":    11,
 }
 
-var UsageMessage string = "queued <port>"
+var UsageMessage string = "queued [--config=<file>] <port>\n       queued bench [options]"
 var ExtendedMessage string = `
-starts a queued daemon, a simple queue exposed on the network.
+starts a queued daemon, a simple queue exposed on the network. queued bench
+load tests a running daemon (see queued bench --help).
 
 Options
     -h, --help                          print this message
+    --config=<file>                     read the configuration from this
+                                        (JSON) file. The options below
+                                        override the file. Send the server a
+                                        SIGHUP to reload it
     --allow-dups                        allow duplicate items in the queue.
                                         This setting effects every queue
+                                        which doesn't set its own dedupe
+    --resp-port=<port>                  also serve a subset of the Redis
+                                        (RESP) protocol on this port
+    --ws-port=<port>                    also serve the queued protocol over
+                                        WebSockets on this port
+    --cluster-self=<host:port>          this node's address in the cluster
+    --cluster-nodes=<host:port,...>     every node in the cluster (including
+                                        this one). The named queues are
+                                        split between the nodes by
+                                        consistent hashing
+    --conn-rate=<rate>                  limit the commands per second of each
+                                        connection. Commands over the limit
+                                        are delayed
+    --enque-rate=<rate>                 limit the ENQUEs per second on each
+                                        queue. ENQUEs over the limit get an
+                                        ERROR
+    --deque-rate=<rate>                 limit the DEQUEs per second on each
+                                        queue. DEQUEs over the limit get an
+                                        ERROR
+    --max-item-size=<bytes>             the largest item which may be enqued
+    --max-line-length=<bytes>           the longest command line the server
+                                        will read
+    --read-timeout=<duration>           how long a client may take to finish
+                                        sending a command
+    --write-timeout=<duration>          how long a write to a client may block
+    --idle-timeout=<duration>           disconnect clients which go this long
+                                        without sending a command
+    --max-connections=<n>               the most clients which may be
+                                        connected at once
+    --hold-timeout=<duration>           release a grouped item a client hasn't
+                                        acked within this long
+    --log-level=<level>                 debug, info (the default), warn or
+                                        error
+    --log-format=<format>               text (the default) or json
+    --log-commands                      log every command clients send
+                                        (without its payload)
 
 Specs
-    <port>  A bindable port number.
+    <port>  A bindable port number. It may be left out if the configuration
+            file has a port.
+    <rate>  N or N:BURST. N is the (decimal) number allowed per second and
+            BURST is how many are allowed back to back. eg. 100 or 0.5:10
+    <duration>
+            A number with a unit. eg. 30s, 1m or 250ms
 `
 
 func Usage(code int) {
@@ -92,11 +151,96 @@ func parse_int(str string) int {
 	return i
 }
 
+func parse_rate(str string) net.Rate {
+	rate, err := net.ParseRate(str)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error parsing '%v' expected a rate\n", str)
+		Usage(ErrorCodes["badrate"])
+	}
+	return rate
+}
+
+func parse_duration(str string) time.Duration {
+	d, err := time.ParseDuration(str)
+	if err != nil || d < 0 {
+		fmt.Fprintf(os.Stderr, "Error parsing '%v' expected a duration\n", str)
+		Usage(ErrorCodes["baddur"])
+	}
+	return d
+}
+
+func new_logger(format string, level *slog.LevelVar) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, opts))
+}
+
+func load_config(path string, overrides []func(*config.Config)) (*config.Config, error) {
+	conf := config.Default()
+	if path != "" {
+		var err error
+		conf, err = config.Load(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, override := range overrides {
+		override(conf)
+	}
+	return conf, conf.Validate()
+}
+
+/*
+Reload the configuration file every time the process gets a SIGHUP. A file
+which can't be loaded is logged and the current configuration is kept.  */
+func reload_on_hup(server *net.Server, path string, overrides []func(*config.Config), conf *config.Config, level *slog.LevelVar, logger *slog.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		next, err := load_config(path, overrides)
+		if err != nil {
+			logger.Error("reload failed, keeping the current configuration", "config", path, "err", err)
+			continue
+		}
+		level.Set(next.Log.SlogLevel())
+		for _, change := range next.Reload(server, conf) {
+			logger.Warn("change needs a restart", "config", path, "change", change)
+		}
+		logger.Info("reloaded configuration", "config", path)
+		conf = next
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		bench_main(os.Args[2:])
+		return
+	}
+
 	short := "h"
 	long := []string{
 		"help",
+		"config=",
 		"allow-dups",
+		"resp-port=",
+		"ws-port=",
+		"cluster-self=",
+		"cluster-nodes=",
+		"conn-rate=",
+		"enque-rate=",
+		"deque-rate=",
+		"max-item-size=",
+		"max-line-length=",
+		"read-timeout=",
+		"write-timeout=",
+		"idle-timeout=",
+		"max-connections=",
+		"hold-timeout=",
+		"log-level=",
+		"log-format=",
+		"log-commands",
 	}
 	args, optargs, err := getopt.GetOpt(os.Args[1:], short, long)
 	if err != nil {
@@ -104,25 +248,116 @@ func main() {
 		Usage(ErrorCodes["opts"])
 	}
 
-	port := -1
-	dups := false
+	path := ""
+	var overrides []func(*config.Config)
+	set := func(override func(*config.Config)) {
+		overrides = append(overrides, override)
+	}
 	for _, oa := range optargs {
 		switch oa.Opt() {
 		case "-h", "--help":
 			Usage(0)
+		case "--config":
+			path = oa.Arg()
 		case "--allow-dups":
-			dups = true
+			set(func(c *config.Config) {
+				dedupe := false
+				c.Defaults.Dedupe = &dedupe
+			})
+		case "--resp-port":
+			port := parse_int(oa.Arg())
+			set(func(c *config.Config) { c.RESPPort = port })
+		case "--ws-port":
+			port := parse_int(oa.Arg())
+			set(func(c *config.Config) { c.WSPort = port })
+		case "--cluster-self":
+			node := oa.Arg()
+			set(func(c *config.Config) { c.Cluster.Self = node })
+		case "--cluster-nodes":
+			nodes := strings.Split(oa.Arg(), ",")
+			set(func(c *config.Config) { c.Cluster.Nodes = nodes })
+		case "--conn-rate":
+			rate := parse_rate(oa.Arg())
+			set(func(c *config.Config) { c.Limits.ConnRate = config.Rate(rate) })
+		case "--enque-rate":
+			rate := config.Rate(parse_rate(oa.Arg()))
+			set(func(c *config.Config) { c.Defaults.EnqueRate = &rate })
+		case "--deque-rate":
+			rate := config.Rate(parse_rate(oa.Arg()))
+			set(func(c *config.Config) { c.Defaults.DequeRate = &rate })
+		case "--max-item-size":
+			n := parse_int(oa.Arg())
+			set(func(c *config.Config) { c.Limits.MaxItemSize = n })
+		case "--max-line-length":
+			n := parse_int(oa.Arg())
+			set(func(c *config.Config) { c.Limits.MaxLineLength = n })
+		case "--read-timeout":
+			d := config.Duration(parse_duration(oa.Arg()))
+			set(func(c *config.Config) { c.Limits.ReadTimeout = d })
+		case "--write-timeout":
+			d := config.Duration(parse_duration(oa.Arg()))
+			set(func(c *config.Config) { c.Limits.WriteTimeout = d })
+		case "--idle-timeout":
+			d := config.Duration(parse_duration(oa.Arg()))
+			set(func(c *config.Config) { c.Limits.IdleTimeout = d })
+		case "--max-connections":
+			n := parse_int(oa.Arg())
+			set(func(c *config.Config) { c.Limits.MaxConnections = n })
+		case "--hold-timeout":
+			d := config.Duration(parse_duration(oa.Arg()))
+			set(func(c *config.Config) { c.Limits.HoldTimeout = d })
+		case "--log-level":
+			level := oa.Arg()
+			set(func(c *config.Config) { c.Log.Level = level })
+		case "--log-format":
+			format := oa.Arg()
+			set(func(c *config.Config) { c.Log.Format = format })
+		case "--log-commands":
+			set(func(c *config.Config) { c.Log.Commands = true })
 		}
 	}
 
-	if len(args) != 1 {
+	if len(args) > 1 {
+		fmt.Fprintln(os.Stderr, "Too many arguments")
+		Usage(ErrorCodes["opts"])
+	} else if len(args) == 1 {
+		port := parse_int(args[0])
+		set(func(c *config.Config) { c.Port = port })
+	}
+
+	conf, err := load_config(path, overrides)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error in configuration:", err)
+		Usage(ErrorCodes["badconf"])
+	}
+	if conf.Port == 0 {
 		fmt.Fprintln(os.Stderr, "You must specify a port")
 		Usage(ErrorCodes["opts"])
 	}
-	port = parse_int(args[0])
 
-	fmt.Println("starting")
-	server := net.NewServer(func() net.Queue { return queue.NewQueue(dups) })
-	server.Start(port)
-}
+	level := new(slog.LevelVar)
+	level.Set(conf.Log.SlogLevel())
+	logger := new_logger(conf.Log.Format, level)
+	net.SetLogger(logger)
+	queue.SetLogger(logger)
+	config.SetLogger(logger)
+	raft.SetLogger(logger)
 
+	logger.Info("starting", "port", conf.Port, "config", path)
+	if _, err := conf.StartRaft(); err != nil {
+		logger.Error("could not start the raft group", "err", err)
+		os.Exit(ErrorCodes["raft"])
+	}
+	server := net.NewServer(conf.Creator("default"))
+	conf.Apply(server)
+	if path != "" {
+		go reload_on_hup(server, path, overrides, conf, level, logger)
+	}
+	if conf.RESPPort != 0 {
+		go server.StartRESP(conf.RESPPort)
+	}
+	if conf.WSPort != 0 {
+		go server.StartWebSocket(conf.WSPort)
+	}
+	server.Start(conf.Port)
+}
@@ -0,0 +1,178 @@
+package net
+
+/* queued
+ * Author: Tim Henderson
+ * Email: tadh@case.edu
+ * Copyright 2013 All Right Reserved
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ *  * Neither the name of the queued nor the names of its contributors may be
+ *    used to endorse or promote products derived from this software without
+ *    specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/timtadh/queued/queue"
+)
+
+/*
+A BoundedQueue wraps another Queue and limits how many items it may hold
+(MaxSize) and how long an item may wait on it (TTL). A zero limit means no
+limit. An ENQUE onto a full queue gets an error. Items older than the TTL are
+dropped (lazily, as they reach the head of the queue) so Size and Has may count
+expired items which haven't been reached yet. Both limits may be changed while
+the queue is in use.  */
+type BoundedQueue struct {
+	Queue
+	lock    *sync.Mutex
+	maxSize int
+	ttl     time.Duration
+	expired int
+}
+
+func NewBoundedQueue(q Queue, maxSize int, ttl time.Duration) *BoundedQueue {
+	return &BoundedQueue{
+		Queue:   q,
+		lock:    new(sync.Mutex),
+		maxSize: maxSize,
+		ttl:     ttl,
+	}
+}
+
+func (self *BoundedQueue) SetMaxSize(maxSize int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.maxSize = maxSize
+}
+
+func (self *BoundedQueue) SetTTL(ttl time.Duration) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.ttl = ttl
+}
+
+func (self *BoundedQueue) Limits() (maxSize int, ttl time.Duration) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.maxSize, self.ttl
+}
+
+/* How many items have been dropped because they expired. */
+func (self *BoundedQueue) Expired() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.expired
+}
+
+func (self *BoundedQueue) Enque(item *queue.Item) error {
+	_, err := self.EnqueUnique(item)
+	return err
+}
+
+/* Enque onto the front of the wrapped queue if it is a DoubleEndedQueue. */
+func (self *BoundedQueue) EnqueFront(item *queue.Item) error {
+	_, err := self.EnqueFrontUnique(item)
+	return err
+}
+
+/* Enque, reporting a dropped duplicate if the wrapped queue does. */
+func (self *BoundedQueue) EnqueUnique(item *queue.Item) (string, error) {
+	return self.enque(item, false)
+}
+
+/* EnqueFront, reporting a dropped duplicate if the wrapped queue does. */
+func (self *BoundedQueue) EnqueFrontUnique(item *queue.Item) (string, error) {
+	return self.enque(item, true)
+}
+
+func (self *BoundedQueue) enque(item *queue.Item, front bool) (string, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.maxSize > 0 && self.Queue.Size() >= self.maxSize {
+		return "", fmt.Errorf("queue is full (max size %v)", self.maxSize)
+	}
+	return enqueUnique(self.Queue, item, front)
+}
+
+func (self *BoundedQueue) Deque() (*queue.Item, error) {
+	return self.deque(self.Queue.Deque)
+}
+
+/* Deque from the back of the wrapped queue if it is a DoubleEndedQueue. */
+func (self *BoundedQueue) DequeBack() (*queue.Item, error) {
+	d, err := doubleEnded(self.Queue)
+	if err != nil {
+		return nil, err
+	}
+	return self.deque(d.DequeBack)
+}
+
+/* Take an item with pop, dropping expired items. */
+func (self *BoundedQueue) deque(pop func() (*queue.Item, error)) (*queue.Item, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for {
+		if self.Queue.Empty() {
+			return nil, fmt.Errorf("queue is empty")
+		}
+		item, err := pop()
+		if err != nil {
+			return nil, err
+		}
+		if self.ttl <= 0 || time.Since(item.Enqueued) <= self.ttl {
+			return item, nil
+		}
+		if g, ok := groupQueue(self.Queue); ok && item.Headers[queue.GroupHeader] != "" {
+			g.Ack(item.Id)
+		}
+		self.expired += 1
+	}
+}
+
+/* Close the wrapped queue if it can be closed. */
+func (self *BoundedQueue) Close() error {
+	if c, ok := self.Queue.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+/* The wrapped queue. */
+func (self *BoundedQueue) Unwrap() Queue {
+	return self.Queue
+}
+
+/* The wrapped queue's stats (see QueueStats) and how many items expired. */
+func (self *BoundedQueue) Stats() queue.Stats {
+	stats := QueueStats(self.Queue)
+	stats.Expired = self.Expired()
+	return stats
+}
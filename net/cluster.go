@@ -0,0 +1,184 @@
+package net
+
+/* queued
+ * Author: Tim Henderson
+ * Email: tadh@case.edu
+ * Copyright 2013 All Right Reserved
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ *  * Neither the name of the queued nor the names of its contributors may be
+ *    used to endorse or promote products derived from this software without
+ *    specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+/*
+Clustering. Several queued nodes can split the named queues between them. The
+nodes (host:port addresses of their queued listeners) are placed on a
+consistent hash ring and each queue belongs to the node which follows the hash
+of its name on the ring. So adding or removing a node only moves the queues
+next to it on the ring. Membership is static: every node must be given the
+same list.
+
+A node which is asked to USE a queue it doesn't own responds with
+
+    MOVED host:port
+
+where host:port is the owner, and the client should reconnect there. Every
+node has its own default queue, it isn't sharded.  */
+
+/* How many points each node gets on the ring (more points, more even split). */
+const ringReplicas = 128
+
+type ringPoint struct {
+	hash uint64
+	node string
+}
+
+/* A consistent hash ring of node addresses. */
+type Ring struct {
+	points []ringPoint
+	nodes  []string
+}
+
+func ringHash(s string) uint64 {
+	h := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(h[:8])
+}
+
+func NewRing(nodes []string) *Ring {
+	r := &Ring{
+		points: make([]ringPoint, 0, len(nodes)*ringReplicas),
+		nodes:  append([]string(nil), nodes...),
+	}
+	for _, node := range nodes {
+		for i := 0; i < ringReplicas; i++ {
+			r.points = append(r.points, ringPoint{ringHash(node + "#" + strconv.Itoa(i)), node})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash == r.points[j].hash {
+			return r.points[i].node < r.points[j].node
+		}
+		return r.points[i].hash < r.points[j].hash
+	})
+	return r
+}
+
+func (self *Ring) Nodes() []string {
+	return append([]string(nil), self.nodes...)
+}
+
+/* The node which owns the named queue ("" if the ring is empty). */
+func (self *Ring) Owner(name string) string {
+	if len(self.points) == 0 {
+		return ""
+	}
+	h := ringHash(name)
+	i := sort.Search(len(self.points), func(i int) bool {
+		return self.points[i].hash >= h
+	})
+	if i == len(self.points) {
+		i = 0
+	}
+	return self.points[i].node
+}
+
+/*
+An error which sends the client to another node. The client gets MOVED and the
+address Redirect returns (or an ERROR if it returns "").  */
+type Redirect interface {
+	error
+	Redirect() string
+}
+
+/* The queue is owned by another node, at Addr. */
+type MovedError struct {
+	Name string
+	Addr string
+}
+
+func (self *MovedError) Error() string {
+	return "MOVED " + self.Addr
+}
+
+func (self *MovedError) Redirect() string {
+	return self.Addr
+}
+
+/*
+Join a (static) cluster of nodes as self. self must be one of the nodes. With
+no nodes the server owns every queue again.  */
+func (self *Server) SetCluster(me string, nodes []string) error {
+	var ring *Ring
+	if len(nodes) > 0 {
+		found := false
+		seen := make(map[string]bool)
+		for _, node := range nodes {
+			if seen[node] {
+				return fmt.Errorf("node %v is in the cluster twice", node)
+			}
+			seen[node] = true
+			found = found || node == me
+		}
+		if !found {
+			return fmt.Errorf("this node (%v) is not one of the cluster's nodes", me)
+		}
+		ring = NewRing(nodes)
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.node = me
+	self.ring = ring
+	return nil
+}
+
+/*
+The address of the node which owns the named queue and whether that is this
+node. Without a cluster every queue is local.  */
+func (self *Server) Owner(name string) (string, bool) {
+	self.lock.Lock()
+	ring, me := self.ring, self.node
+	self.lock.Unlock()
+	if ring == nil || name == "default" {
+		return me, true
+	}
+	owner := ring.Owner(name)
+	return owner, owner == me
+}
+
+/* A *MovedError if the named queue is owned by another node, else nil. */
+func (self *Server) moved(name string) *MovedError {
+	if owner, local := self.Owner(name); !local {
+		return &MovedError{Name: name, Addr: owner}
+	}
+	return nil
+}
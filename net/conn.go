@@ -0,0 +1,339 @@
+package net
+
+/* queued
+ * Author: Tim Henderson
+ * Email: tadh@case.edu
+ * Copyright 2013 All Right Reserved
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ *  * Neither the name of the queued nor the names of its contributors may be
+ *    used to endorse or promote products derived from this software without
+ *    specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+import (
+	netutils "github.com/timtadh/netutils"
+)
+
+/*
+Limits protect the server from clients which send too much or too slowly or
+which never go away. A zero value for any field means no limit.
+
+    MaxItemSize     the largest (decoded) item which may be enqued, in bytes
+    MaxLineLength   the longest command line which will be read, in bytes. A
+                    longer line gets an ERROR and is skipped
+    ReadTimeout     how long a client may take to send the rest of a command
+                    once it has started sending it (or a WebSocket client
+                    its upgrade request)
+    WriteTimeout    how long a write to the client may block
+    IdleTimeout     how long a client may go between commands
+    MaxConnections  the most clients which may be connected at once (across
+                    the queued, RESP and WebSocket listeners)
+    HoldTimeout     how long a client may hold an item of a message group
+                    without acking it. The item is then released, as if the
+                    client had disconnected
+
+Changing the limits while the server runs effects new connections.  */
+type Limits struct {
+	MaxItemSize    int
+	MaxLineLength  int
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+	IdleTimeout    time.Duration
+	MaxConnections int
+	HoldTimeout    time.Duration
+}
+
+func (self *Server) SetLimits(limits Limits) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.limits = limits
+}
+
+func (self *Server) Limits() Limits {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.limits
+}
+
+/*
+Count a new connection. Returns false if the server is already at its
+maximum number of connections.  */
+func (self *Server) acquire() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.limits.MaxConnections > 0 && self.conns >= self.limits.MaxConnections {
+		return false
+	}
+	self.conns += 1
+	return true
+}
+
+func (self *Server) release() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.conns -= 1
+}
+
+/* Turn away a connection when the server is full. */
+func reject(con net.Conn, msg []byte, timeout time.Duration) {
+	defer con.Close()
+	log.Warn("rejected connection", "reason", "too many connections", "remote", con.RemoteAddr().String())
+	if timeout > 0 {
+		con.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	con.Write(msg)
+}
+
+/* The backoff after a failed accept, doubling up to maxAcceptDelay. */
+const minAcceptDelay = 5 * time.Millisecond
+const maxAcceptDelay = time.Second
+
+/* What accept needs of a listener. */
+type tcpListener interface {
+	AcceptTCP() (*net.TCPConn, error)
+	Addr() net.Addr
+}
+
+/*
+Accept the next connection. A temporary error (eg. running out of file
+descriptors) is logged and the accept retried after a backoff, rather than
+taking the server down. Returns false once the listener is closed or fails
+with an error which isn't temporary (which is logged).  */
+func accept(ln tcpListener) (*net.TCPConn, bool) {
+	var delay time.Duration
+	for {
+		con, err := ln.AcceptTCP()
+		if err == nil {
+			return con, true
+		} else if netutils.IsEOF(err) || errors.Is(err, net.ErrClosed) {
+			return nil, false
+		}
+		if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+			log.Error("accept failed, no longer accepting connections", "addr", ln.Addr().String(), "err", err)
+			return nil, false
+		}
+		if delay == 0 {
+			delay = minAcceptDelay
+		} else {
+			delay = min(2*delay, maxAcceptDelay)
+		}
+		log.Warn("accept failed, retrying", "addr", ln.Addr().String(), "err", err, "delay", delay)
+		time.Sleep(delay)
+	}
+}
+
+type lineError struct {
+	msg     string
+	timeout bool
+}
+
+func (self *lineError) Error() string {
+	return self.msg
+}
+
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+/* The deadline d from now, no deadline if d is 0. */
+func deadline(d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
+func isTimeout(err error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
+
+const bufferSize = 64 * 1024
+
+/*
+Connections get their buffered readers and writers (and the scratch space for
+encoding responses) from these pools and put them back when they close. This
+keeps a server with lots of short lived connections from allocating (and
+collecting) a pair of large buffers per connection.  */
+var readers = sync.Pool{
+	New: func() interface{} { return bufio.NewReaderSize(nil, bufferSize) },
+}
+
+var writers = sync.Pool{
+	New: func() interface{} { return bufio.NewWriterSize(nil, bufferSize) },
+}
+
+var scratch = sync.Pool{
+	New: func() interface{} { return new([]byte) },
+}
+
+func getReader(r io.Reader) *bufio.Reader {
+	br := readers.Get().(*bufio.Reader)
+	br.Reset(r)
+	return br
+}
+
+func putReader(br *bufio.Reader) {
+	br.Reset(nil)
+	readers.Put(br)
+}
+
+func getWriter(w io.Writer) *bufio.Writer {
+	bw := writers.Get().(*bufio.Writer)
+	bw.Reset(w)
+	return bw
+}
+
+func putWriter(bw *bufio.Writer) {
+	bw.Reset(nil)
+	writers.Put(bw)
+}
+
+/* Get a scratch buffer of length n. Put it back with putScratch. */
+func getScratch(n int) *[]byte {
+	buf := scratch.Get().(*[]byte)
+	if cap(*buf) < n {
+		*buf = make([]byte, n)
+	}
+	*buf = (*buf)[:n]
+	return buf
+}
+
+func putScratch(buf *[]byte) {
+	scratch.Put(buf)
+}
+
+/*
+Read a line (without its trailing "\r\n"). Lines which fit in r's buffer are
+returned without copying. Longer lines are gathered in *buf (which may be nil)
+which is grown as needed and reused by the next call. Either way the line is
+only valid until the next read from r. If the line is longer than max (and
+max > 0) the rest of it is skipped and a (recoverable) *lineError is returned.
+A final line without a newline is returned as is; the next call returns
+io.EOF.  */
+func readLine(r *bufio.Reader, max int, buf *[]byte) ([]byte, error) {
+	var line []byte
+	var overflow, gathered bool
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if !overflow {
+			if err == bufio.ErrBufferFull || gathered {
+				if buf == nil {
+					buf = new([]byte)
+				}
+				if !gathered {
+					*buf = (*buf)[:0]
+					gathered = true
+				}
+				*buf = append(*buf, chunk...)
+				line = *buf
+			} else {
+				line = chunk
+			}
+			if max > 0 && len(bytes.TrimRight(line, "\r\n")) > max {
+				overflow = true
+				line = nil
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		} else if err == io.EOF && len(line) > 0 {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		break
+	}
+	if overflow {
+		return nil, &lineError{msg: fmt.Sprintf("line too long (max %v bytes)", max)}
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
+
+/*
+Read the next command line from the client enforcing the connection's limits.
+Timeouts are returned as a *lineError with timeout set.  */
+func (c *Connection) readLine() ([]byte, error) {
+	timeouts := c.dl != nil && (c.limits.IdleTimeout > 0 || c.limits.ReadTimeout > 0)
+	if timeouts {
+		c.dl.SetReadDeadline(deadline(c.limits.IdleTimeout))
+		if _, err := c.r.Peek(1); isTimeout(err) {
+			return nil, &lineError{msg: "idle timeout", timeout: true}
+		} else if err != nil {
+			return nil, err
+		}
+		c.dl.SetReadDeadline(deadline(c.limits.ReadTimeout))
+	}
+	line, err := readLine(c.r, c.limits.MaxLineLength, &c.buf)
+	if isTimeout(err) {
+		return nil, &lineError{msg: "read timeout", timeout: true}
+	}
+	return line, err
+}
+
+/*
+Is there another complete command already buffered? If so the response to this
+one doesn't need to be flushed yet.  */
+func (c *Connection) pipelined() bool {
+	buf, _ := c.r.Peek(c.r.Buffered())
+	return bytes.IndexByte(buf, '\n') >= 0
+}
+
+/*
+Write a message (see EncodeMessage) straight into the connection's buffer
+without allocating.  */
+func (c *Connection) writeMessage(cmd string, msg []byte, enc Encoder) {
+	c.w.WriteString(cmd)
+	if msg != nil {
+		c.w.WriteByte(' ')
+		buf := getScratch(enc.EncodedLen(len(msg)))
+		enc.Encode(*buf, msg)
+		c.w.Write(*buf)
+		putScratch(buf)
+	}
+	c.w.WriteByte('\n')
+}
+
+func (c *Connection) flush() error {
+	if c.w.Buffered() == 0 {
+		return nil
+	}
+	if c.dl != nil && c.limits.WriteTimeout > 0 {
+		c.dl.SetWriteDeadline(deadline(c.limits.WriteTimeout))
+	}
+	return c.w.Flush()
+}
@@ -0,0 +1,287 @@
+package net
+
+/* queued
+ * Author: Tim Henderson
+ * Email: tadh@case.edu
+ * Copyright 2013 All Right Reserved
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ *  * Neither the name of the queued nor the names of its contributors may be
+ *    used to endorse or promote products derived from this software without
+ *    specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+A Rate limits how often something may happen. PerSecond is the sustained rate
+and Burst is how many may happen back to back. A Rate with a PerSecond <= 0 is
+unlimited. If Burst < 1 it defaults to PerSecond (rounded up).  */
+type Rate struct {
+	PerSecond float64
+	Burst     int
+}
+
+/* Parse a rate of the form "N" or "N:BURST", eg. "100" or "0.5:10". */
+func ParseRate(s string) (Rate, error) {
+	split := strings.SplitN(s, ":", 2)
+	n, err := strconv.ParseFloat(split[0], 64)
+	if err != nil || n < 0 {
+		return Rate{}, fmt.Errorf("bad rate '%v'", s)
+	}
+	rate := Rate{PerSecond: n}
+	if len(split) > 1 {
+		burst, err := strconv.Atoi(split[1])
+		if err != nil || burst < 0 {
+			return Rate{}, fmt.Errorf("bad rate '%v'", s)
+		}
+		rate.Burst = burst
+	}
+	return rate, nil
+}
+
+func (self Rate) Unlimited() bool {
+	return self.PerSecond <= 0
+}
+
+func (self Rate) burst() float64 {
+	if self.Burst < 1 {
+		return math.Max(1, math.Ceil(self.PerSecond))
+	}
+	return float64(self.Burst)
+}
+
+func (self Rate) String() string {
+	if self.Unlimited() {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%v:%v", self.PerSecond, self.burst())
+}
+
+/*
+A token bucket. The rate is passed in on every call (rather than stored) so a
+rate change at runtime applies to every existing bucket.  */
+type bucket struct {
+	lock   *sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newBucket() *bucket {
+	return &bucket{lock: new(sync.Mutex)}
+}
+
+func (self *bucket) refill(rate Rate, now time.Time) {
+	burst := rate.burst()
+	if self.last.IsZero() {
+		self.tokens = burst
+	} else if elapsed := now.Sub(self.last).Seconds(); elapsed > 0 {
+		self.tokens = math.Min(burst, self.tokens+elapsed*rate.PerSecond)
+	}
+	self.last = now
+}
+
+/*
+Take a token if one is available. If not, returns false and how long until one
+will be.  */
+func (self *bucket) take(rate Rate, now time.Time) (bool, time.Duration) {
+	if rate.Unlimited() {
+		return true, 0
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.refill(rate, now)
+	if self.tokens >= 1 {
+		self.tokens -= 1
+		return true, 0
+	}
+	return false, seconds((1 - self.tokens) / rate.PerSecond)
+}
+
+/*
+Take a token even if there isn't one, going into debt. Returns how long the
+caller should wait before acting so it stays within the rate.  */
+func (self *bucket) reserve(rate Rate, now time.Time) time.Duration {
+	if rate.Unlimited() {
+		return 0
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.refill(rate, now)
+	self.tokens -= 1
+	if self.tokens >= 0 {
+		return 0
+	}
+	return seconds(-self.tokens / rate.PerSecond)
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+/* The error sent to a client which exceeds a queue's rate limit. */
+type ThrottleError struct {
+	Queue string
+	Op    string
+	Wait  time.Duration
+}
+
+func (self *ThrottleError) Error() string {
+	return fmt.Sprintf(
+		"rate limited, %v on queue '%v' retry in %.3fs",
+		self.Op, self.Queue, self.Wait.Seconds())
+}
+
+type queueLimit struct {
+	enque   Rate
+	deque   Rate
+	custom  bool
+	enqueBk *bucket
+	dequeBk *bucket
+}
+
+/*
+The rate limits for a server. There is a rate of commands per connection and
+ENQUE and DEQUE rates per named queue. Queues without their own rates use the
+default queue rates. Everything can be changed while the server runs.  */
+type limiter struct {
+	lock   *sync.Mutex
+	conn   Rate
+	enque  Rate
+	deque  Rate
+	queues map[string]*queueLimit
+}
+
+func newLimiter() *limiter {
+	return &limiter{
+		lock:   new(sync.Mutex),
+		queues: make(map[string]*queueLimit),
+	}
+}
+
+func (self *limiter) connRate() Rate {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.conn
+}
+
+func (self *limiter) queue(name string) *queueLimit {
+	q, has := self.queues[name]
+	if !has {
+		q = &queueLimit{
+			enque:   self.enque,
+			deque:   self.deque,
+			enqueBk: newBucket(),
+			dequeBk: newBucket(),
+		}
+		self.queues[name] = q
+	}
+	return q
+}
+
+/*
+Take an op (ENQUE or DEQUE) from the named queue's rate. This makes an entry
+for the queue, so only check queues which exist (it is removed with the
+queue, see forget).  */
+func (self *limiter) check(name, op string) error {
+	self.lock.Lock()
+	q := self.queue(name)
+	rate, bk := q.enque, q.enqueBk
+	if op == "DEQUE" {
+		rate, bk = q.deque, q.dequeBk
+	}
+	self.lock.Unlock()
+	if ok, wait := bk.take(rate, time.Now()); !ok {
+		return &ThrottleError{Queue: name, Op: op, Wait: wait}
+	}
+	return nil
+}
+
+func (self *limiter) forget(name string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if q, has := self.queues[name]; has && !q.custom {
+		delete(self.queues, name)
+	}
+}
+
+/*
+Limit the number of commands each connection may issue. A connection which
+goes over the limit has its commands delayed (it is not sent an error).  */
+func (self *Server) SetConnectionRate(rate Rate) {
+	self.rates.lock.Lock()
+	defer self.rates.lock.Unlock()
+	self.rates.conn = rate
+}
+
+/* Set the ENQUE and DEQUE rates for every queue without its own rates. */
+func (self *Server) SetDefaultQueueRate(enque, deque Rate) {
+	self.rates.lock.Lock()
+	defer self.rates.lock.Unlock()
+	self.rates.enque = enque
+	self.rates.deque = deque
+	for _, q := range self.rates.queues {
+		if !q.custom {
+			q.enque = enque
+			q.deque = deque
+		}
+	}
+}
+
+/*
+Set the ENQUE and DEQUE rates for the named queue. A client which goes over
+the limit gets a ThrottleError.  */
+func (self *Server) SetQueueRate(name string, enque, deque Rate) {
+	self.rates.lock.Lock()
+	defer self.rates.lock.Unlock()
+	q := self.rates.queue(name)
+	q.enque = enque
+	q.deque = deque
+	q.custom = true
+}
+
+/* Remove the named queue's own rates so it uses the default queue rates. */
+func (self *Server) ClearQueueRate(name string) {
+	self.rates.lock.Lock()
+	defer self.rates.lock.Unlock()
+	if q, has := self.rates.queues[name]; has {
+		q.enque = self.rates.enque
+		q.deque = self.rates.deque
+		q.custom = false
+	}
+}
+
+/* Delay the caller until the connection is within the command rate. */
+func (self *Server) throttle(bk *bucket) {
+	if wait := bk.reserve(self.rates.connRate(), time.Now()); wait > 0 {
+		time.Sleep(wait)
+	}
+}
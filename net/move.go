@@ -0,0 +1,209 @@
+package net
+
+/* queued
+ * Author: Tim Henderson
+ * Email: tadh@case.edu
+ * Copyright 2013 All Right Reserved
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ *  * Neither the name of the queued nor the names of its contributors may be
+ *    used to endorse or promote products derived from this software without
+ *    specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+import (
+	"github.com/timtadh/queued/queue"
+)
+
+/*
+Atomically move the item at the head of the src queue onto the tail of the dst
+queue. The moved item is returned and its delivery count is incremented (it is
+being delivered to whoever asked for the move). dst gets a copy of it, so the
+returned item is the caller's even once dst's consumers have the copy. If the
+item can't be put on dst
+(including when dst dedupes and already has a copy of it) it is put back on
+src so it is never lost. In a cluster both queues must be on this node.  */
+func (self *Server) Move(src, dst string) (*queue.Item, error) {
+	if moved := self.moved(src); moved != nil {
+		return nil, moved
+	}
+	if owner, local := self.Owner(dst); !local {
+		return nil, fmt.Errorf("queue '%v' is on another node (%v)", dst, owner)
+	}
+	from, err := self.queue(src)
+	if err != nil {
+		return nil, err
+	}
+	to, err := self.queue(dst)
+	if err != nil {
+		return nil, err
+	}
+	if err := self.rates.check(src, "DEQUE"); err != nil {
+		return nil, err
+	}
+	if err := self.rates.check(dst, "ENQUE"); err != nil {
+		return nil, err
+	}
+	if from.Empty() {
+		return nil, fmt.Errorf("queue is empty")
+	}
+	item, err := from.Deque()
+	if err != nil {
+		self.changed(src)
+	}
+	if err != nil && from.Empty() {
+		return nil, fmt.Errorf("queue is empty")
+	} else if err != nil {
+		return nil, err
+	}
+	item.Deliveries += 1
+	dup, err := enqueUnique(to, item.Copy(), false)
+	if err == nil && dup != "" {
+		err = fmt.Errorf("queue '%v' already has the item (as %v)", dst, dup)
+	}
+	if err != nil {
+		item.Deliveries -= 1
+		if err2 := restore(from, item); err2 != nil {
+			return nil, fmt.Errorf("%v (could not restore item %v: %v)", err, item.Id, err2)
+		}
+		self.signal(src)
+		return nil, err
+	}
+	self.changed(src)
+	self.enqueued(dst, 1)
+	self.signal(dst)
+	return item, nil
+}
+
+/*
+Put an item which was just dequeued from q back where it came from: the front
+of the queue (the back of a LIFO queue) or the head of its message group.
+Queues which can't be used from both ends get it back on the tail. Limits
+(see BoundedQueue) don't apply since the item was only just taken off.  */
+func restore(q Queue, item *queue.Item) error {
+	if g, ok := groupQueue(q); ok && item.Headers[queue.GroupHeader] != "" {
+		return g.Release(item.Id)
+	}
+	for {
+		u, ok := q.(interface{ Unwrap() Queue })
+		if !ok {
+			break
+		}
+		q = u.Unwrap()
+	}
+	if s, ok := q.(interface{ LIFO() bool }); ok && s.LIFO() {
+		return q.Enque(item)
+	}
+	if d, ok := q.(DoubleEndedQueue); ok {
+		return d.EnqueFront(item)
+	}
+	return q.Enque(item)
+}
+
+/*
+The blocking variant of Move. If src is empty it waits for up to timeout for an
+item to be enqueued on it. A timeout of 0 waits forever.  */
+func (self *Server) BlockingMove(src, dst string, timeout time.Duration) (*queue.Item, error) {
+	return self.blockingMove(src, dst, timeout, nil)
+}
+
+/* BlockingMove which gives up (with an error) when cancel is closed. */
+func (self *Server) blockingMove(src, dst string, timeout time.Duration, cancel <-chan struct{}) (*queue.Item, error) {
+	var timer <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		timer = t.C
+	}
+	for {
+		signaled := self.wait(src)
+		item, err := self.Move(src, dst)
+		if err == nil || err.Error() != "queue is empty" {
+			return item, err
+		}
+		select {
+		case <-signaled:
+		case <-timer:
+			return nil, fmt.Errorf("queue is empty")
+		case <-cancel:
+			return nil, fmt.Errorf("cancelled")
+		}
+	}
+}
+
+func decodeMoveArgs(rest []byte, n int) ([]string, error) {
+	fields := bytes.Fields(rest)
+	if len(fields) != n {
+		return nil, fmt.Errorf("expected %v arguments got %v", n, len(fields))
+	}
+	args := make([]string, 0, n)
+	for _, f := range fields {
+		args = append(args, string(f))
+	}
+	return args, nil
+}
+
+func (c *Connection) Move(rest []byte) (string, []byte, error) {
+	args, err := decodeMoveArgs(rest, 2)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := c.s.consumer(args[0], c.id); err != nil {
+		return "", nil, err
+	}
+	item, err := c.s.Move(args[0], args[1])
+	if err != nil {
+		return "", nil, err
+	}
+	c.hold(args[0], item)
+	return "ITEM", EncodeItem(item), nil
+}
+
+func (c *Connection) BlockingMove(rest []byte) (string, []byte, error) {
+	args, err := decodeMoveArgs(rest, 3)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := c.s.consumer(args[0], c.id); err != nil {
+		return "", nil, err
+	}
+	seconds, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || seconds < 0 {
+		return "", nil, fmt.Errorf("bad timeout '%v'", args[2])
+	}
+	timeout := time.Duration(seconds * float64(time.Second))
+	item, err := c.s.blockingMove(args[0], args[1], timeout, c.done)
+	if err != nil {
+		return "", nil, err
+	}
+	c.hold(args[0], item)
+	return "ITEM", EncodeItem(item), nil
+}
@@ -6,6 +6,15 @@
 //  - HAS
 //  - SIZE
 //  - USE
+//  - MOVE
+//  - BMOVE
+//  - ACK
+//  - RETRY
+//  - NEWQUEUE
+//  - ENQUEFRONT
+//  - DEQUEBACK
+//  - WATCH
+//  - UNWATCH
 //
 // the server can send the following reponse status words
 //
@@ -15,6 +24,10 @@
 //  - TRUE
 //  - FALSE
 //  - SIZE
+//  - QUEUE
+//  - EVENT
+//  - MOVED
+//  - DUPLICATE
 //
 // All messages have the following format:
 //
@@ -25,9 +38,12 @@
 // reponse it is ASCII.
 //
 // The client can send any command at any time. The server may at any command
-// respond with ERROR if there was a problem processing the command.
+// respond with ERROR if there was a problem processing the command. If the
+// server has rate limits an ENQUE, DEQUE or MOVE over a queue's limit gets an
+// ERROR whose message starts with "rate limited". Commands over a
+// connection's limit are delayed rather than rejected.
 //
-// USE name
+// USE name [exclusive] [idle=SECONDS]
 //
 //     Use the named queue. You never have to issue this command. If you do not
 //     you will automatically be using a queue named "default". If the queue does
@@ -35,20 +51,49 @@
 //
 //          OK
 //
-//     name should have no spaces and should be utf8.
+//     name should have no spaces and should be utf8. If the server is part
+//     of a cluster and another node owns the queue it responds with that
+//     node's address instead (and the connection keeps using its queue):
 //
-// ENQUE XXXXXXXXXXXXXXXX
+//          MOVED host:port
+//
+//     MOVE and BMOVE respond the same way when another node owns src, as do
+//     ENQUE and DEQUE on a replicated queue when this node isn't the leader.
+//
+//     With options USE creates a temporary queue (it is an ERROR if the queue
+//     already exists, unless it is the same temporary queue). An exclusive
+//     queue belongs to the connection: only it may DEQUE (or MOVE) from the
+//     queue (others may ENQUE onto it) and the queue is removed when the
+//     connection closes. A queue with an idle timeout is removed once it
+//     hasn't been used for that many seconds (a decimal number). A queue
+//     named tmp.* is only made this way (or by NEWQUEUE), so using one which
+//     has been removed is an ERROR.
+//
+// ENQUE XXXXXXXXXXXXXXXX [key=VVVVVVVV ...]
 //
 //     XXXXXXXXXXXXXXXXXX should be base64 encoded data. If it is not the server
-//     will respond with and ERROR.
+//     will respond with and ERROR. The data may optionally be followed by
+//     headers, space separated key=value pairs where the value is base64
+//     encoded. Keys should have no spaces and no '='.
 //
-//     Otherwise the server will repond
+//     An item with a group header (group=VVVVVVVV) on a queue of message
+//     groups (see GroupQueue) is kept in order with the other items of its
+//     group.
 //
-//          OK
+//     Otherwise the server will repond with the unique id it assigned to the
+//     item
+//
+//          OK 5f0e3c1a9b7d4e2f8a6c0b1d3e5f7a9c
 //
-//     The server should always respond with OK if the command is properly
-//     formated. If it does not that means there is an internal error in the
-//     server.
+//     If the queue dedupes (see queue.NewQueue) and already holds an item
+//     with the same data the new item is dropped and the server responds with
+//     the id of the one on the queue
+//
+//          DUPLICATE 9c7a5f3e1d0b6c8a2f4e7d9b1a3c5e0f
+//
+//     The server should always respond with OK (or DUPLICATE) if the command
+//     is properly formated. If it does not that means there is an internal
+//     error in the server.
 //
 // DEQUE
 //
@@ -62,7 +107,26 @@
 //
 //     Otherwise it repondes with
 //
-//         ITEM XXXXXXXXXXXXXXX
+//         ITEM XXXXXXXXXXXXXXX ID ENQUEUED DELIVERIES [key=VVVVVVVV ...]
+//
+//     XXXXXXXXXXXXXXX is the base64 encoded data, ID is the id returned by
+//     ENQUE, ENQUEUED is the time the item was enqueued in nanoseconds since
+//     the unix epoch, DELIVERIES is the number of times the item has been
+//     delivered (including this one) and the headers are encoded as they were
+//     for ENQUE.
+//
+//     A queue in LIFO mode hands out its newest item instead.
+//
+// ENQUEFRONT XXXXXXXXXXXXXXXX [key=VVVVVVVV ...]
+// DEQUEBACK
+//
+//     ENQUE and DEQUE at the other ends of the queue: ENQUEFRONT puts an
+//     urgent item at the front of the queue so it is dequeued next and
+//     DEQUEBACK takes the newest item. They respond as ENQUE and DEQUE do.
+//     Queues which can't be used from both ends (eg. spill, grouped and
+//     replicated queues) respond with
+//
+//         ERROR not supported by this queue
 //
 // HAS XXXXXXXXXXXXXXXXXXXXXXXXXXX
 //
@@ -96,6 +160,126 @@
 //
 //      For a queue that is 9,231 items long.
 //
+// QUEUES
+//
+//      The server responds with the names of all of the queues, sorted and
+//      space separated. eg.
+//
+//          QUEUES default jobs processing
+//
+// NEWQUEUE [exclusive] [idle=SECONDS]
+//
+//      Creates a temporary queue (see USE) with a unique name, for example as
+//      an address for replies. The server responds with the name
+//
+//          QUEUE tmp.5f0e3c1a9b7d4e2f8a6c0b1d3e5f7a9c
+//
+//      The connection keeps using its queue; USE the new one to DEQUE from it.
+//
+// WATCH name [threshold]
+//
+//      Streams events about the named queue to the connection instead of
+//      having to poll SIZE. The server responds with the queue's size
+//
+//          EVENT jobs size 17
+//
+//      and then sends an EVENT whenever the queue changes (in between the
+//      responses to the client's other commands):
+//
+//          EVENT jobs size 18          the size changed
+//          EVENT jobs empty 0          the queue became empty
+//          EVENT jobs nonempty 1       the queue stopped being empty
+//          EVENT jobs above 1000       the size reached the threshold
+//          EVENT jobs below 999        the size dropped below the threshold
+//
+//      Changes are debounced: a queue which keeps changing is only checked
+//      every 50ms or so and the events report where it ended up. If the WATCH
+//      was tagged every EVENT carries its tag. A connection may watch any
+//      number of queues. Events for a client which has fallen 256 behind are
+//      dropped.
+//
+// UNWATCH name
+//
+//      Stops watching the named queue. The server responds with OK and no
+//      more events for the queue follow it.
+//
+// Tagged Requests
+//
+//     Any command may be prefixed with a tag, a '#' followed by up to 32
+//     characters (no spaces), which the server puts on the front of its
+//     response:
+//
+//          #42 ENQUE XXXXXXXXXXXXXXXX
+//          #42 OK 5f0e3c1a9b7d4e2f8a6c0b1d3e5f7a9c
+//
+//     Commands are run in the order they are sent, except that a tagged
+//     command which blocks (BMOVE) runs in the background and is answered
+//     when it is done. So a client may have many tagged BMOVEs outstanding
+//     and keep using the connection meanwhile, matching responses to
+//     requests by their tags.
+//
+// STATS
+//
+//      The server responds with what the queue is holding as space separated
+//      key=value pairs. eg.
+//
+//          STATS items=10 bytes=2048 raw_bytes=8192 compressed=10 ratio=4.00 memory_bytes=2048 disk_bytes=0 segments=0 expired=0
+//
+//      bytes is the size of the item data as it is stored and raw_bytes its
+//      size before compression (ratio is raw_bytes/bytes). disk_bytes and
+//      segments are for queues which spill to disk and expired counts the
+//      items dropped by a ttl. Queues which don't keep stats only report
+//      their items.
+//
+// MOVE src dst
+//
+//      Atomically deques the item at the head of the queue named src and
+//      enques it onto the queue named dst (like Redis's RPOPLPUSH). Both
+//      queues are created if they do not exist. The moved item is sent back
+//      exactly as for DEQUE
+//
+//          ITEM XXXXXXXXXXXXXXX ID ENQUEUED DELIVERIES [key=VVVVVVVV ...]
+//
+//      If src is empty the server responds with
+//
+//          ERROR cXVldWUgaXMgZW1wdHk=
+//
+//      If the item can't be put on dst (eg. dst is full, or dedupes and
+//      already has a copy of the item) the server responds with an ERROR and
+//      the item is put back at the head of src.
+//
+// BMOVE src dst timeout
+//
+//      The blocking form of MOVE. If src is empty the server waits up to
+//      timeout seconds (a decimal number, 0 waits forever) for an item to be
+//      enqued on src before responding with the queue is empty ERROR.
+//
+// ACK id
+//
+//      On a queue of message groups DEQUE (and MOVE) hands out at most one
+//      item of each group at a time and the group is held until the item is
+//      acked. ACK says the client is done with the item and lets the next item
+//      of its group go. The server responds
+//
+//          OK
+//
+//      Items a client hasn't acked when it disconnects, or within the hold
+//      timeout (see Limits), go back to the head of their group to be
+//      delivered again. ACKing such an item gets an ERROR.
+//
+// RETRY XXXXXXXXXXXXXXXX [key=VVVVVVVV ...]
+//
+//      Put back an item the client failed to process. The data and headers
+//      are sent as for ENQUE (send the headers the item was dequeued with)
+//      and the server responds as for ENQUE. The attempt header
+//      (attempt=VVVVVVVV, a base10 number) counts the item's delivery
+//      attempts, starting from 1 if it is missing. The item is enqued with
+//      its attempt one higher after the queue's backoff (see RetryPolicy)
+//      which doubles with every attempt. Once the item has used up its
+//      queue's attempts it is enqued on the queue's failure queue instead
+//      (or dropped if the queue has none). An item from a queue of message
+//      groups should still be acked.
+//
 package net
 
 /* queued
@@ -131,41 +315,192 @@ package net
  */
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
-	logpkg "log"
+	"io"
+	"log/slog"
 	"net"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 import (
-	netutils "github.com/timtadh/netutils"
+	"github.com/timtadh/queued/queue"
 )
 
-var log *logpkg.Logger
+var log *slog.Logger
 
 func init() {
-	log = logpkg.New(os.Stderr, "queued/net> ", logpkg.Ltime|logpkg.Lshortfile)
+	SetLogger(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+}
+
+/*
+Set the logger for this package. Every record gets a pkg=queued/net attribute
+and records about a connection also get its id (conn), the remote address
+(remote) and the queue it is using (queue). Call this before starting a
+server.  */
+func SetLogger(logger *slog.Logger) {
+	log = logger.With("pkg", "queued/net")
+}
+
+var connIds uint64
+
+/* A new connection id and logger for a connection. */
+func connLogger(con io.ReadWriteCloser, protocol string) (uint64, *slog.Logger) {
+	id := atomic.AddUint64(&connIds, 1)
+	remote := "unknown"
+	if c, ok := con.(net.Conn); ok && c.RemoteAddr() != nil {
+		remote = c.RemoteAddr().String()
+	}
+	return id, log.With("conn", id, "remote", remote, "protocol", protocol)
 }
 
 type Server struct {
 	ln    *net.TCPListener
+	respLn *net.TCPListener
+	wsLn  *net.TCPListener
 	newQueue func() Queue
+	creators map[string]func() Queue
+	logCommands int32
+	lock   *sync.Mutex
 	queues map[string]Queue
+	signals map[string]chan struct{}
+	rates *limiter
+	limits Limits
+	conns  int
+	node   string
+	ring   *Ring
+	retries *retrier
+	temps  map[string]*tempQueue
+	events *hub
+	webhooks []*webhook
 }
 
 func NewServer(creator func() Queue) *Server {
 	s := &Server{
 		newQueue: creator,
+		creators: make(map[string]func() Queue),
+		lock: new(sync.Mutex),
 		queues: make(map[string]Queue),
+		signals: make(map[string]chan struct{}),
+		rates: newLimiter(),
+		retries: newRetrier(),
+		temps: make(map[string]*tempQueue),
+		events: newHub(),
 	}
 	s.queues["default"] = s.newQueue()
 	return s
 }
 
+/*
+Log every command (but not its payload) clients send. This is for debugging
+and can be turned on and off while the server runs.  */
+func (self *Server) SetCommandLogging(on bool) {
+	if on {
+		atomic.StoreInt32(&self.logCommands, 1)
+	} else {
+		atomic.StoreInt32(&self.logCommands, 0)
+	}
+}
+
+func (self *Server) commandLogging() bool {
+	return atomic.LoadInt32(&self.logCommands) == 1
+}
+
+/* Get the named queue, creating it if it does not exist. */
+func (self *Server) queue(name string) (Queue, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	q, has := self.queues[name]
+	if !has {
+		if err := self.creatable(name); err != nil {
+			return nil, err
+		}
+		q = self.create(name)
+		self.queues[name] = q
+	}
+	self.touch(name)
+	return q, nil
+}
+
+/* Make a new queue for name. The caller must hold the lock. */
+func (self *Server) create(name string) Queue {
+	if creator, has := self.creators[name]; has {
+		return creator()
+	}
+	return self.newQueue()
+}
+
+/*
+Change how queues which haven't been declared (see Declare) are created.
+Queues which already exist are not effected.  */
+func (self *Server) SetCreator(creator func() Queue) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.newQueue = creator
+}
+
+/*
+Declare the named queue. It is created now (if it doesn't already exist) with
+creator, as it will be if it is ever removed and then used again. Returns the
+queue and whether it was created. An existing queue is left as it is.  */
+func (self *Server) Declare(name string, creator func() Queue) (Queue, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.creators[name] = creator
+	q, has := self.queues[name]
+	if !has {
+		q = creator()
+		self.queues[name] = q
+	}
+	return q, !has
+}
+
+/*
+Forget the named queue's declaration. The queue itself is left alone but if it
+is removed it will be created like any other queue next time it is used.  */
+func (self *Server) Undeclare(name string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.creators, name)
+}
+
+/*
+Returns a channel which will be closed the next time the named queue is
+signaled. Get the channel *before* checking the queue so a signal can't be
+missed.  */
+func (self *Server) wait(name string) <-chan struct{} {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	ch, has := self.signals[name]
+	if !has {
+		ch = make(chan struct{})
+		self.signals[name] = ch
+	}
+	return ch
+}
+
+/*
+Wake everyone waiting on the named queue (and let its watchers know). Called
+after an enque.  */
+func (self *Server) signal(name string) {
+	self.changed(name)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if ch, has := self.signals[name]; has {
+		close(ch)
+		delete(self.signals, name)
+	}
+}
+
 /*
 Starts a server. This is a blocking call it will run until the server shuts
 down. If you want to run this in a seperate thread simply call it in its own
@@ -176,15 +511,12 @@ These include:
     2. The server is unable to bind to the port.
 
 The expectation is for these errors to either cause a hard crash or be caught
-logged and then crashed.  */
+logged and then crashed. Use Listen to get those errors back instead.  */
 func (self *Server) Start(port int) {
 	if self.ln != nil {
 		panic("Server already started")
 	}
-	ln, err := net.ListenTCP(
-		"tcp",
-		&net.TCPAddr{IP: net.ParseIP("0.0.0.0"), Port: port},
-	)
+	ln, err := bind(port)
 	if err != nil {
 		panic(err)
 	}
@@ -193,28 +525,72 @@ func (self *Server) Start(port int) {
 }
 
 /*
-Stop a started server. If there is some problem stopping the server an error
-will be returned.  */
+Starts a server without blocking: it binds the port (0 picks a free one) and
+serves connections in the background until Stop is called. Returns the
+address it is listening on, or an error if the server is already started or
+the port can't be bound.  */
+func (self *Server) Listen(port int) (*net.TCPAddr, error) {
+	if self.ln != nil {
+		return nil, fmt.Errorf("Server already started")
+	}
+	ln, err := bind(port)
+	if err != nil {
+		return nil, err
+	}
+	self.ln = ln
+	go self.listen()
+	return ln.Addr().(*net.TCPAddr), nil
+}
+
+/* Listen on the port on every interface. */
+func bind(port int) (*net.TCPListener, error) {
+	return net.ListenTCP(
+		"tcp",
+		&net.TCPAddr{IP: net.ParseIP("0.0.0.0"), Port: port},
+	)
+}
+
+/*
+Stop a started server (and its RESP and WebSocket listeners if there are any).
+Items waiting out a RETRY backoff are dropped. If there is some problem
+stopping the server an error will be returned.  */
 func (self *Server) Stop() error {
-	if self.ln == nil {
+	if self.ln == nil && self.respLn == nil && self.wsLn == nil {
 		return fmt.Errorf("Can't close non-existent link")
 	}
-	return self.ln.Close()
+	if n := self.retries.stop(); n > 0 {
+		log.Warn("server stopped, items waiting to be retried dropped", "items", n)
+	}
+	var err error
+	if self.respLn != nil {
+		err = self.respLn.Close()
+	}
+	if self.wsLn != nil {
+		if e := self.wsLn.Close(); e != nil {
+			err = e
+		}
+	}
+	if self.ln != nil {
+		if e := self.ln.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
 }
 
 func (self *Server) listen() {
-	errors := ErrorHandler()
-	var EOF bool
-	for !EOF {
-		con, err := self.ln.AcceptTCP()
-		if netutils.IsEOF(err) {
-			EOF = true
-		} else if err != nil {
-			log.Panic(err)
+	for {
+		con, ok := accept(self.ln)
+		if !ok {
+			return
+		} else if !self.acquire() {
+			msg := EncodeB64Message("ERROR", []byte("too many connections"))
+			go reject(con, msg, self.Limits().WriteTimeout)
 		} else {
-			send := netutils.TCPWriter(con, errors)
-			recv := netutils.TCPReader(con, errors)
-			go self.Connection(send, recv).Serve()
+			go func() {
+				defer self.release()
+				self.Connection(con).Serve()
+			}()
 		}
 	}
 }
@@ -245,6 +621,27 @@ func DecodeCmd(line []byte) (string, []byte) {
 	}
 }
 
+/* The longest request tag, including its '#'. */
+const maxTagLength = 33
+
+/*
+Split an optional request tag (eg. #42) off the front of a line. The tag
+(including the '#') is nil if there isn't one.  */
+func DecodeTag(line []byte) (tag []byte, rest []byte, err error) {
+	if len(line) == 0 || line[0] != '#' {
+		return nil, line, nil
+	}
+	i := bytes.IndexByte(line, ' ')
+	if i < 0 {
+		return nil, nil, fmt.Errorf("no command after tag '%v'", string(bytes.TrimSpace(line)))
+	}
+	tag = line[:i]
+	if len(tag) < 2 || len(tag) > maxTagLength {
+		return nil, nil, fmt.Errorf("bad tag, tags are 1 to %v characters after the '#'", maxTagLength-1)
+	}
+	return tag, line[i+1:], nil
+}
+
 /*
 Encode a message for the server. Handles base64ing the msg. It is expected that
 the paramter `cmd` will not have a space in it. If it does problems will occur
@@ -264,6 +661,111 @@ func EncodeMessage(cmd string, msg []byte, enc Encoder) []byte {
 	return msgEnc
 }
 
+/*
+Encode the headers of an item as space separated key=value pairs where the
+value is base64 encoded. Keys are emitted in sorted order. Keys should not
+contain spaces or '='.  */
+func EncodeHeaders(headers map[string]string) []byte {
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v := base64.StdEncoding.EncodeToString([]byte(headers[k]))
+		pairs = append(pairs, k+"="+v)
+	}
+	return []byte(strings.Join(pairs, " "))
+}
+
+/* Decode headers encoded with EncodeHeaders. */
+func DecodeHeaders(fields [][]byte) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, field := range fields {
+		split := bytes.SplitN(field, []byte("="), 2)
+		if len(split) != 2 || len(split[0]) == 0 {
+			return nil, fmt.Errorf("bad header '%v'", string(field))
+		}
+		value, err := DecodeB64(split[1])
+		if err != nil {
+			return nil, fmt.Errorf("bad header '%v'", string(field))
+		}
+		headers[string(split[0])] = string(value)
+	}
+	return headers, nil
+}
+
+/*
+Decode the body of an ENQUE command. The body is the base64 encoded data
+followed by the (optional) headers.  */
+func DecodeEnque(rest []byte) ([]byte, map[string]string, error) {
+	fields := bytes.Fields(rest)
+	if len(fields) == 0 {
+		return nil, nil, fmt.Errorf("no data sent to queue")
+	}
+	data, err := DecodeB64(fields[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("bad line '%v'", string(bytes.TrimSpace(rest)))
+	}
+	headers, err := DecodeHeaders(fields[1:])
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, headers, nil
+}
+
+/*
+Encode the body of an ITEM response. The format is
+
+    DATA ID ENQUEUED DELIVERIES [KEY=VALUE ...]
+
+DATA and the header values are base64 encoded. ENQUEUED is the enqueue time in
+nanoseconds since the unix epoch.  */
+func EncodeItem(item *queue.Item) []byte {
+	fields := []string{
+		base64.StdEncoding.EncodeToString(item.Data),
+		item.Id,
+		strconv.FormatInt(item.Enqueued.UnixNano(), 10),
+		strconv.Itoa(item.Deliveries),
+	}
+	if len(item.Headers) > 0 {
+		fields = append(fields, string(EncodeHeaders(item.Headers)))
+	}
+	return []byte(strings.Join(fields, " "))
+}
+
+/* Decode the body of an ITEM response encoded with EncodeItem. */
+func DecodeItem(rest []byte) (*queue.Item, error) {
+	fields := bytes.Fields(rest)
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("bad item '%v'", string(bytes.TrimSpace(rest)))
+	}
+	data, err := DecodeB64(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	enqueued, err := strconv.ParseInt(string(fields[2]), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	deliveries, err := strconv.Atoi(string(fields[3]))
+	if err != nil {
+		return nil, err
+	}
+	headers, err := DecodeHeaders(fields[4:])
+	if err != nil {
+		return nil, err
+	}
+	return &queue.Item{
+		Id:         string(fields[1]),
+		Enqueued:   time.Unix(0, enqueued),
+		Deliveries: deliveries,
+		Headers:    headers,
+		Data:       data,
+	}, nil
+}
+
 func EncodeB64Message(cmd string, msg []byte) []byte {
 	return EncodeMessage(cmd, msg, base64.StdEncoding)
 }
@@ -291,7 +793,7 @@ func ErrorHandler() chan<- error {
 	errors := make(chan error)
 	go func() {
 		for err := range errors {
-			log.Println(err)
+			log.Error("error", "err", err)
 		}
 	}()
 	return errors
@@ -299,99 +801,303 @@ func ErrorHandler() chan<- error {
 
 type Connection struct {
 	s    *Server
-	send chan<- []byte
-	recv <-chan byte
+	id   uint64
+	log  *slog.Logger
+	con  io.ReadWriteCloser
+	r    *bufio.Reader
+	w    *bufio.Writer
+	dl   deadliner
+	buf  []byte
 	queueName string
+	bucket *bucket
+	limits Limits
+	wlock *sync.Mutex
+	done chan struct{}
+	async *sync.WaitGroup
+	outstanding int32
+	hlock *sync.Mutex
+	held map[string]heldItem
+	owned []string
+	watches map[string]func()
 }
 
-func (self *Server) Connection(send chan<- []byte, recv <-chan byte) *Connection {
-	log.Println("new connection")
+/*
+An item dequeued from a GroupQueue which the client hasn't acked yet. timer
+releases it once the hold timeout is up (nil if there is no timeout).  */
+type heldItem struct {
+	name  string
+	queue GroupQueue
+	timer *time.Timer
+}
+
+/*
+Wrap a client's connection. Commands are read and responses written through
+(pooled) buffers. If con has deadlines (eg. it is a net.Conn) the server's
+timeout Limits are enforced.  */
+func (self *Server) Connection(con io.ReadWriteCloser) *Connection {
+	return self.connection(con, "queued")
+}
+
+func (self *Server) connection(con io.ReadWriteCloser, protocol string) *Connection {
+	id, logger := connLogger(con, protocol)
+	logger.Info("new connection")
+	dl, _ := con.(deadliner)
 	return &Connection{
 		s: self,
-		send: send,
-		recv: recv,
+		id: id,
+		log: logger,
+		con: con,
+		r: getReader(con),
+		w: getWriter(con),
+		dl: dl,
 		queueName: "default",
+		bucket: newBucket(),
+		limits: self.Limits(),
+		wlock: new(sync.Mutex),
+		done: make(chan struct{}),
+		async: new(sync.WaitGroup),
+		hlock: new(sync.Mutex),
+		held: make(map[string]heldItem),
+		watches: make(map[string]func()),
 	}
 }
 
-func (c *Connection) queue() Queue {
-	return c.s.queues[c.queueName]
+func (c *Connection) queue() (Queue, error) {
+	return c.s.queue(c.queueName)
+}
+
+/* The connection's logger with the current queue attached. */
+func (c *Connection) logger() *slog.Logger {
+	return c.log.With("queue", c.queueName)
 }
 
 func (c *Connection) Serve() {
 	defer c.Close()
 	defer func() {
 		if e := recover(); e != nil {
-			c.send <- EncodeB64Message("error", []byte(fmt.Sprintf("%v", e)))
+			c.wlock.Lock()
+			c.writeMessage("error", []byte(fmt.Sprintf("%v", e)), base64.StdEncoding)
+			c.wlock.Unlock()
 		}
 	}()
 
-	enque := c.Respond(c.Enque, base64.StdEncoding)
-	deque := c.Respond(c.Deque, base64.StdEncoding)
-	has := c.Respond(c.Has, echoEncoder{})
-	size := c.Respond(c.Size, echoEncoder{})
-	use := c.Respond(c.Use, echoEncoder{})
-	badDecode := c.Respond(c.BadDecode, base64.StdEncoding)
-
-	b64cmds := func(cmd string, data []byte) {
-		switch cmd {
-		case "ENQUE":
-			enque(data)
-		case "HAS":
-			has(data)
+	for {
+		line, err := c.readLine()
+		if e, ok := err.(*lineError); ok {
+			c.logger().Warn("bad line", "err", e)
+			c.writeError(nil, e)
+			if e.timeout {
+				return
+			}
+		} else if err == io.EOF {
+			return
+		} else if err != nil {
+			c.logger().Error("read failed", "err", err)
+			return
+		} else {
+			c.s.throttle(c.bucket)
+			c.dispatch(line)
+		}
+		if !c.pipelined() {
+			c.wlock.Lock()
+			err := c.flush()
+			c.wlock.Unlock()
+			if err != nil {
+				c.logger().Error("write failed", "err", err)
+				return
+			}
 		}
 	}
+}
 
-	for line := range netutils.Readlines(c.recv) {
-		command, rest := DecodeCmd(line)
-		switch command {
-		case "ENQUE", "HAS":
-			if rest == nil {
-				badDecode(rest)
-			} else {
-				data, err := DecodeB64(rest)
-				if err != nil {
-					badDecode(rest)
-				} else {
-					b64cmds(command, data)
-				}
+/* The function which handles a command, nil if there isn't one. */
+func (c *Connection) handler(command string) func([]byte) (string, []byte, error) {
+	switch command {
+	case "ENQUE":
+		return c.Enque
+	case "HAS":
+		return c.hasEncoded
+	case "DEQUE":
+		return c.Deque
+	case "SIZE":
+		return c.Size
+	case "QUEUES":
+		return c.Queues
+	case "STATS":
+		return c.Stats
+	case "USE":
+		return c.Use
+	case "MOVE":
+		return c.Move
+	case "BMOVE":
+		return c.BlockingMove
+	case "ACK":
+		return c.Ack
+	case "RETRY":
+		return c.Retry
+	case "NEWQUEUE":
+		return c.NewQueue
+	case "ENQUEFRONT":
+		return c.EnqueFront
+	case "DEQUEBACK":
+		return c.DequeBack
+	case "UNWATCH":
+		return c.Unwatch
+	}
+	return nil
+}
+
+/*
+Commands which may block. When they are tagged they run in the background so
+the connection can keep serving other commands.  */
+var blocking = map[string]bool{
+	"BMOVE": true,
+}
+
+/* The most tagged blocking commands a connection may have running. */
+const maxOutstanding = 1024
+
+func (c *Connection) dispatch(line []byte) {
+	tag, line, err := DecodeTag(line)
+	if err != nil {
+		c.writeError(nil, err)
+		return
+	}
+	command, rest := DecodeCmd(line)
+	if c.s.commandLogging() {
+		if tag != nil {
+			c.logger().Info("command", "cmd", command, "tag", string(tag), "bytes", len(rest))
+		} else {
+			c.logger().Info("command", "cmd", command, "bytes", len(rest))
+		}
+	}
+	f := c.handler(command)
+	if command == "WATCH" {
+		c.watch(tag, rest)
+	} else if f == nil {
+		c.logger().Warn("bad command", "cmd", command)
+		c.writeError(tag, fmt.Errorf("bad command recieved, '%v'", command))
+	} else if blocking[command] && tag != nil {
+		c.background(tag, f, rest)
+	} else {
+		if blocking[command] {
+			c.wlock.Lock()
+			err := c.flush()
+			c.wlock.Unlock()
+			if err != nil {
+				c.logger().Error("write failed", "err", err)
 			}
-		case "DEQUE":
-			deque(rest)
-		case "SIZE":
-			size(rest)
-		case "USE":
-			use(rest)
-		default:
-			err := fmt.Errorf("bad command recieved, '%v'", command)
-			log.Println(err.Error())
-			c.send <- EncodeB64Message("ERROR", []byte(err.Error()))
 		}
+		c.respond(tag, f, echoEncoder{}, rest)
 	}
 }
 
+/*
+Run a tagged command in the background. Its response is written (and flushed)
+whenever it is ready.  */
+func (c *Connection) background(tag []byte, f func([]byte) (string, []byte, error), rest []byte) {
+	if atomic.AddInt32(&c.outstanding, 1) > maxOutstanding {
+		atomic.AddInt32(&c.outstanding, -1)
+		c.writeError(tag, fmt.Errorf("too many outstanding requests (max %v)", maxOutstanding))
+		return
+	}
+	tag = append([]byte(nil), tag...)
+	if rest != nil {
+		rest = append([]byte(nil), rest...)
+	}
+	c.async.Add(1)
+	go func() {
+		defer c.async.Done()
+		defer atomic.AddInt32(&c.outstanding, -1)
+		c.respond(tag, f, echoEncoder{}, rest)
+		c.wlock.Lock()
+		defer c.wlock.Unlock()
+		if err := c.flush(); err != nil {
+			c.logger().Error("write failed", "err", err)
+		}
+	}()
+}
+
+/*
+Close the connection once any tagged commands running in the background have
+finished (those which are blocked are cancelled). Items the client dequeued
+from a GroupQueue and didn't ACK are released, the queues exclusive to the
+connection are removed and its watches are stopped.  */
 func (c *Connection) Close() {
-	close(c.send)
-	<-c.recv
-	log.Println("closed connection")
+	close(c.done)
+	c.async.Wait()
+	c.stopWatches()
+	c.releaseHeld()
+	c.s.dropExclusive(c.id, c.owned)
+	if err := c.flush(); err != nil {
+		c.logger().Error("write failed", "err", err)
+	}
+	c.con.Close()
+	putReader(c.r)
+	putWriter(c.w)
+	c.logger().Info("closed connection")
 }
 
 func (c *Connection) Respond(f func([]byte) (string, []byte, error), enc Encoder) (g func([]byte)) {
 	return func(rest []byte) {
-		cmd, data, err := f(rest)
-		if err != nil {
-			if err.Error() != "queue is empty" {
-				log.Println(err)
-			}
-			c.send <- EncodeB64Message("ERROR", []byte(err.Error()))
-		} else if cmd != "" {
-			c.send <- EncodeMessage(cmd, data, enc)
-		} else {
-			c.send <- EncodePlainMessage("OK", nil)
+		c.respond(nil, f, enc, rest)
+	}
+}
+
+/* Run f on rest and write its response, tagged with tag if it isn't nil. */
+func (c *Connection) respond(tag []byte, f func([]byte) (string, []byte, error), enc Encoder, rest []byte) {
+	cmd, data, err := f(rest)
+	if err != nil {
+		if _, throttled := err.(*ThrottleError); throttled {
+			c.logger().Debug("throttled", "err", err)
+		} else if _, moved := err.(Redirect); moved {
+			c.logger().Debug("moved", "err", err)
+		} else if err.Error() != "queue is empty" && err.Error() != "cancelled" {
+			c.logger().Error("command failed", "err", err)
 		}
+		c.writeError(tag, err)
+		return
+	}
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	c.writeTag(tag)
+	if cmd != "" {
+		c.writeMessage(cmd, data, enc)
+	} else {
+		c.writeMessage("OK", nil, echoEncoder{})
+	}
+}
+
+func (c *Connection) writeError(tag []byte, err error) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	c.writeTag(tag)
+	if r, is := err.(Redirect); is && r.Redirect() != "" {
+		c.writeMessage("MOVED", []byte(r.Redirect()), echoEncoder{})
+		return
+	}
+	c.writeMessage("ERROR", []byte(err.Error()), base64.StdEncoding)
+}
+
+func (c *Connection) writeTag(tag []byte) {
+	if tag != nil {
+		c.w.Write(tag)
+		c.w.WriteByte(' ')
 	}
 }
 
+/* HAS with its base64 encoded hash. */
+func (c *Connection) hasEncoded(rest []byte) (string, []byte, error) {
+	if rest == nil {
+		return c.BadDecode(rest)
+	}
+	data, err := DecodeB64(rest)
+	if err != nil {
+		return c.BadDecode(rest)
+	}
+	return c.Has(data)
+}
+
 func (c *Connection) BadDecode(line []byte) (string, []byte, error) {
 	return "", nil, fmt.Errorf("bad line '%v'", string(bytes.TrimSpace(line)))
 }
@@ -400,30 +1106,74 @@ func (c *Connection) Use(rest []byte) (string, []byte, error) {
 	if rest == nil {
 		return "", nil, fmt.Errorf("Must supply a queue name")
 	}
-	name := strings.TrimSpace(string(rest))
-	if name == "" {
+	fields := bytes.Fields(rest)
+	if len(fields) == 0 {
 		return "", nil, fmt.Errorf("Must supply a (non-blank) queue name")
 	}
-	if _, has := c.s.queues[name]; !has {
-		c.s.queues[name] = c.s.newQueue()
+	name := string(fields[0])
+	if moved := c.s.moved(name); moved != nil {
+		return "", nil, moved
+	}
+	if len(fields) > 1 {
+		if err := c.useTemp(name, fields[1:]); err != nil {
+			return "", nil, err
+		}
+	}
+	if _, err := c.s.queue(name); err != nil {
+		return "", nil, err
 	}
 	c.queueName = name
 	return "OK", nil, nil
 }
 
 func (c *Connection) Enque(rest []byte) (string, []byte, error) {
+	return c.enque(rest, false)
+}
+
+/* ENQUE onto the front of the queue. */
+func (c *Connection) EnqueFront(rest []byte) (string, []byte, error) {
+	return c.enque(rest, true)
+}
+
+func (c *Connection) enque(rest []byte, front bool) (string, []byte, error) {
 	if rest == nil {
 		return "", nil, fmt.Errorf("no data sent to queue")
-	} else {
-		return "", nil, c.queue().Enque(rest)
 	}
+	data, headers, err := DecodeEnque(rest)
+	if err != nil {
+		return "", nil, err
+	}
+	if max := c.limits.MaxItemSize; max > 0 && len(data) > max {
+		return "", nil, fmt.Errorf("item too large (%v bytes, max %v)", len(data), max)
+	}
+	q, err := c.queue()
+	if err != nil {
+		return "", nil, err
+	}
+	if err := c.s.rates.check(c.queueName, "ENQUE"); err != nil {
+		return "", nil, err
+	}
+	item := queue.NewItem(data, headers)
+	dup, err := enqueUnique(q, item, front)
+	if err != nil {
+		return "", nil, err
+	} else if dup != "" {
+		return "DUPLICATE", []byte(dup), nil
+	}
+	c.s.enqueued(c.queueName, 1)
+	c.s.signal(c.queueName)
+	return "OK", []byte(item.Id), nil
 }
 
 func (c *Connection) Has(rest []byte) (string, []byte, error) {
 	if len(rest) != sha256.Size {
 		return "", nil, fmt.Errorf("Expected a hash of size %v got %v", sha256.Size, len(rest))
 	}
-	if c.queue().Has(rest) {
+	q, err := c.queue()
+	if err != nil {
+		return "", nil, err
+	}
+	if q.Has(rest) {
 		return "TRUE", nil, nil
 	} else {
 		return "FALSE", nil, nil
@@ -431,20 +1181,163 @@ func (c *Connection) Has(rest []byte) (string, []byte, error) {
 }
 
 func (c *Connection) Size(rest []byte) (string, []byte, error) {
-	return "SIZE", []byte(fmt.Sprint(c.queue().Size())), nil
+	q, err := c.queue()
+	if err != nil {
+		return "", nil, err
+	}
+	return "SIZE", []byte(fmt.Sprint(q.Size())), nil
+}
+
+func (c *Connection) Queues(rest []byte) (string, []byte, error) {
+	if rest != nil {
+		return "", nil, fmt.Errorf("recieved msg data when none was expected")
+	}
+	names := c.s.Names()
+	if len(names) == 0 {
+		return "QUEUES", nil, nil
+	}
+	return "QUEUES", []byte(strings.Join(names, " ")), nil
+}
+
+func (c *Connection) Stats(rest []byte) (string, []byte, error) {
+	if rest != nil {
+		return "", nil, fmt.Errorf("recieved msg data when none was expected")
+	}
+	q, err := c.queue()
+	if err != nil {
+		return "", nil, err
+	}
+	return "STATS", EncodeStats(QueueStats(q)), nil
+}
+
+/* Encode stats as space separated key=value pairs. See STATS. */
+func EncodeStats(stats queue.Stats) []byte {
+	return []byte(fmt.Sprintf(
+		"items=%d bytes=%d raw_bytes=%d compressed=%d ratio=%.2f memory_bytes=%d disk_bytes=%d segments=%d expired=%d",
+		stats.Items, stats.Bytes, stats.RawBytes, stats.Compressed, stats.Ratio(),
+		stats.MemoryBytes, stats.DiskBytes, stats.Segments, stats.Expired))
 }
 
 func (c *Connection) Deque(rest []byte) (string, []byte, error) {
+	return c.deque(rest, false)
+}
+
+/* DEQUE from the back of the queue. */
+func (c *Connection) DequeBack(rest []byte) (string, []byte, error) {
+	return c.deque(rest, true)
+}
+
+func (c *Connection) deque(rest []byte, back bool) (string, []byte, error) {
 	if rest != nil {
 		return "", nil, fmt.Errorf("recieved msg data when none was expected")
 	}
-	if c.queue().Empty() {
+	if err := c.s.consumer(c.queueName, c.id); err != nil {
+		return "", nil, err
+	}
+	q, err := c.queue()
+	if err != nil {
+		return "", nil, err
+	}
+	if err := c.s.rates.check(c.queueName, "DEQUE"); err != nil {
+		return "", nil, err
+	}
+	pop := q.Deque
+	if back {
+		d, err := doubleEnded(q)
+		if err != nil {
+			return "", nil, err
+		}
+		pop = d.DequeBack
+	}
+	if q.Empty() {
 		return "", nil, fmt.Errorf("queue is empty")
 	}
-	data, err := c.queue().Deque()
+	item, err := pop()
+	// even a failed deque may have dropped expired items
+	c.s.changed(c.queueName)
 	if err != nil {
 		return "", nil, err
 	}
-	return "ITEM", data, nil
+	item.Deliveries += 1
+	c.hold(c.queueName, item)
+	return "ITEM", EncodeItem(item), nil
+}
+
+/*
+Remember an item dequeued from the named queue if it is holding its message
+group, so the client can ACK it.  */
+func (c *Connection) hold(name string, item *queue.Item) {
+	if item.Headers[queue.GroupHeader] == "" {
+		return
+	}
+	q, has := c.s.Lookup(name)
+	if !has {
+		return
+	}
+	if g, ok := groupQueue(q); ok {
+		c.hlock.Lock()
+		defer c.hlock.Unlock()
+		var timer *time.Timer
+		if c.limits.HoldTimeout > 0 {
+			id := item.Id
+			timer = time.AfterFunc(c.limits.HoldTimeout, func() { c.expireHold(id) })
+		}
+		c.held[item.Id] = heldItem{name, g, timer}
+	}
+}
+
+/* Release a held item the client didn't ACK within the hold timeout. */
+func (c *Connection) expireHold(id string) {
+	c.hlock.Lock()
+	h, has := c.held[id]
+	delete(c.held, id)
+	c.hlock.Unlock()
+	if !has {
+		return
+	}
+	c.logger().Warn("releasing an item held past the hold timeout", "item", id)
+	if err := h.queue.Release(id); err != nil {
+		c.logger().Error("could not release item", "item", id, "err", err)
+	}
+	c.s.signal(h.name)
+}
+
+func (c *Connection) Ack(rest []byte) (string, []byte, error) {
+	id := string(bytes.TrimSpace(rest))
+	if id == "" {
+		return "", nil, fmt.Errorf("Must supply an item id")
+	}
+	c.hlock.Lock()
+	h, has := c.held[id]
+	delete(c.held, id)
+	c.hlock.Unlock()
+	if !has {
+		return "", nil, fmt.Errorf("item %v is not held by this connection", id)
+	}
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+	if err := h.queue.Ack(id); err != nil {
+		return "", nil, err
+	}
+	// the next item of the group may be dequeued now
+	c.s.signal(h.name)
+	return "OK", nil, nil
+}
+
+/* Release the items the client never acked. */
+func (c *Connection) releaseHeld() {
+	c.hlock.Lock()
+	defer c.hlock.Unlock()
+	for id, h := range c.held {
+		if h.timer != nil {
+			h.timer.Stop()
+		}
+		if err := h.queue.Release(id); err != nil {
+			c.logger().Error("could not release item", "item", id, "err", err)
+		}
+		c.s.signal(h.name)
+		delete(c.held, id)
+	}
 }
 
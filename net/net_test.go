@@ -35,11 +35,27 @@ package net
 import "testing"
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	netutils "github.com/timtadh/netutils"
 )
 
 import (
@@ -52,17 +68,16 @@ func init() {
 }
 
 func rand_bytes(length int) []byte {
-	if urandom, err := os.Open("/dev/urandom"); err != nil {
-		log.Fatal(err)
-	} else {
-		slice := make([]byte, length)
-		if _, err := urandom.Read(slice); err != nil {
-			log.Fatal(err)
-		}
-		urandom.Close()
-		return slice
+	urandom, err := os.Open("/dev/urandom")
+	if err != nil {
+		panic(err)
 	}
-	panic("unreachable")
+	defer urandom.Close()
+	slice := make([]byte, length)
+	if _, err := urandom.Read(slice); err != nil {
+		panic(err)
+	}
+	return slice
 }
 
 func TestEncodeMessage(t *testing.T) {
@@ -99,32 +114,46 @@ func TestDecodeMessage(t *testing.T) {
 	check("OK", "OK", nil)
 }
 
-func sender_to_reciever(recv <-chan []byte) <-chan byte {
-	send := make(chan byte)
+// connect a client to the server over an in memory pipe. Each block sent on
+// the first channel is written to the server and each line the server writes
+// comes back on the second. Close the first channel to hang up, the second is
+// closed once the server has closed the connection.
+func connect(server *Server) (chan<- []byte, <-chan []byte) {
+	client, con := net.Pipe()
+	go server.Connection(con).Serve()
+	send := make(chan []byte)
+	recv := make(chan []byte)
 	go func() {
-		for block := range recv {
-			for _, b := range block {
-				send <- b
+		defer client.Close()
+		for block := range send {
+			if _, err := client.Write(block); err != nil {
+				for _ = range send {
+				}
+				return
+			}
+		}
+	}()
+	go func() {
+		defer close(recv)
+		r := bufio.NewReader(client)
+		for {
+			line, err := r.ReadBytes('\n')
+			if len(line) > 0 {
+				recv <- line
+			}
+			if err != nil {
+				return
 			}
 		}
-		log.Println("Closed")
-		close(send)
 	}()
-	return send
+	return send, recv
 }
 
 func TestConnection(t *testing.T) {
 	server := NewServer(func() Queue { return queue.NewQueue(true) })
-	connect := func() (chan<- []byte, <-chan []byte) {
-		send := make(chan []byte)
-		r := sender_to_reciever(send)
-		s := make(chan []byte)
-		go server.Connection(s, r).Serve()
-		return send, s
-	}
 
 	test := func() {
-		send, recv := connect()
+		send, recv := connect(server)
 		l := make([][]byte, 0, 25)
 		for i := 0; i < rand.Intn(25)+10; i++ {
 			item := rand_bytes(rand.Intn(32) + 2)
@@ -146,11 +175,11 @@ func TestConnection(t *testing.T) {
 			if cmd != "ITEM" || rest == nil {
 				t.Fatal("expected an item")
 			}
-			q_item, err := DecodeB64(rest)
+			q_item, err := DecodeItem(rest)
 			if err != nil {
 				t.Fatal(err)
 			}
-			if !bytes.Equal(q_item, item) {
+			if !bytes.Equal(q_item.Data, item) {
 				t.Fatal("items should have equalled each other")
 			}
 		}
@@ -179,18 +208,107 @@ func TestConnection(t *testing.T) {
 	test()
 }
 
-func TestMultiConnection(t *testing.T) {
+func TestItemMetadata(t *testing.T) {
 	server := NewServer(func() Queue { return queue.NewQueue(true) })
-	connect := func() (chan<- []byte, <-chan []byte) {
-		send := make(chan []byte)
-		r := sender_to_reciever(send)
-		s := make(chan []byte)
-		go server.Connection(s, r).Serve()
-		return send, s
+	send, recv := connect(server)
+
+	item := rand_bytes(rand.Intn(32) + 2)
+	headers := map[string]string{"content-type": "text/plain", "x": "a b=c"}
+	b64 := base64.StdEncoding.EncodeToString(item)
+	send <- []byte("ENQUE " + b64 + " " + string(EncodeHeaders(headers)) + "\n")
+	cmd, id := DecodeCmd(<-recv)
+	if cmd != "OK" || id == nil {
+		t.Fatal("Expected an OK response with an id", cmd, string(id))
+	}
+
+	send <- EncodeB64Message("ENQUE", item)
+	cmd, other := DecodeCmd(<-recv)
+	if cmd != "OK" || bytes.Equal(bytes.TrimSpace(id), bytes.TrimSpace(other)) {
+		t.Fatal("Expected an OK response with a unique id", cmd, string(other))
+	}
+
+	send <- EncodePlainMessage("DEQUE", nil)
+	cmd, rest := DecodeCmd(<-recv)
+	if cmd != "ITEM" {
+		t.Fatal("expected an item", cmd)
+	}
+	q_item, err := DecodeItem(rest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(q_item.Data, item) {
+		t.Fatal("items should have equalled each other")
+	}
+	if q_item.Id != string(bytes.TrimSpace(id)) {
+		t.Fatal("wrong id", q_item.Id, string(id))
+	}
+	if q_item.Deliveries != 1 {
+		t.Fatal("expected one delivery", q_item.Deliveries)
+	}
+	if time.Since(q_item.Enqueued) > time.Minute || time.Since(q_item.Enqueued) < 0 {
+		t.Fatal("bad enqueue time", q_item.Enqueued)
+	}
+	if len(q_item.Headers) != len(headers) {
+		t.Fatal("wrong headers", q_item.Headers)
+	}
+	for k, v := range headers {
+		if q_item.Headers[k] != v {
+			t.Fatal("wrong header", k, q_item.Headers[k])
+		}
+	}
+
+	send <- EncodePlainMessage("DEQUE", nil)
+	cmd, rest = DecodeCmd(<-recv)
+	q_item, err = DecodeItem(rest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd != "ITEM" || len(q_item.Headers) != 0 {
+		t.Fatal("expected an item without headers", cmd, q_item.Headers)
+	}
+
+	send <- append([]byte("ENQUE "), []byte("aGk= bad\n")...)
+	cmd, _ = DecodeCmd(<-recv)
+	if cmd != "ERROR" {
+		t.Fatal("expected an error for a malformed header", cmd)
+	}
+	close(send)
+	<-recv
+}
+
+func TestDuplicates(t *testing.T) {
+	server := NewServer(func() Queue { return NewBoundedQueue(queue.NewQueue(false), 0, 0) })
+	send, recv := connect(server)
+	send <- EncodeB64Message("ENQUE", []byte("a"))
+	cmd, id := DecodeCmd(<-recv)
+	if cmd != "OK" {
+		t.Fatal("expected an OK", cmd)
+	}
+	for _, verb := range []string{"ENQUE", "ENQUEFRONT"} {
+		send <- EncodeB64Message(verb, []byte("a"))
+		if cmd, dup := DecodeCmd(<-recv); cmd != "DUPLICATE" || !bytes.Equal(dup, id) {
+			t.Fatal("expected the id of the item on the queue", verb, cmd, string(dup), string(id))
+		}
+	}
+	send <- []byte("SIZE\n")
+	if cmd, size := DecodeCmd(<-recv); cmd != "SIZE" || string(bytes.TrimSpace(size)) != "1" {
+		t.Fatal("expected the duplicates to be dropped", cmd, string(size))
+	}
+	send <- []byte("DEQUE\n")
+	<-recv
+	send <- EncodeB64Message("ENQUE", []byte("a"))
+	if cmd, _ := DecodeCmd(<-recv); cmd != "OK" {
+		t.Fatal("expected a to be enqueued once the first copy was dequeued", cmd)
 	}
+	close(send)
+	<-recv
+}
+
+func TestMultiConnection(t *testing.T) {
+	server := NewServer(func() Queue { return queue.NewQueue(true) })
 
 	test := func(final bool) {
-		send, recv := connect()
+		send, recv := connect(server)
 		l := make([][]byte, 0, 25)
 		for i := 0; i < rand.Intn(25)+10; i++ {
 			item := []byte("same item for all!") // that way it doesn't matter
@@ -213,11 +331,11 @@ func TestMultiConnection(t *testing.T) {
 			if cmd != "ITEM" || rest == nil {
 				t.Fatal("expected an item")
 			}
-			q_item, err := DecodeB64(rest)
+			q_item, err := DecodeItem(rest)
 			if err != nil {
 				t.Fatal(err)
 			}
-			if !bytes.Equal(q_item, item) {
+			if !bytes.Equal(q_item.Data, item) {
 				t.Fatal("items should have equalled each other")
 			}
 		}
@@ -260,3 +378,1794 @@ func TestMultiConnection(t *testing.T) {
 	go test(false)
 	test(true)
 }
+
+func TestMove(t *testing.T) {
+	server := NewServer(func() Queue { return queue.NewQueue(true) })
+	send, recv := connect(server)
+	l := make([][]byte, 0, 25)
+	for i := 0; i < rand.Intn(25)+10; i++ {
+		item := rand_bytes(rand.Intn(32) + 2)
+		l = append(l, item)
+		send <- EncodeB64Message("ENQUE", item)
+		if cmd, _ := DecodeCmd(<-recv); cmd != "OK" {
+			t.Fatal("Expected an OK response", cmd)
+		}
+	}
+	for _, item := range l {
+		send <- EncodePlainMessage("MOVE", []byte("default processing"))
+		cmd, rest := DecodeCmd(<-recv)
+		if cmd != "ITEM" {
+			t.Fatal("expected an item", cmd)
+		}
+		q_item, err := DecodeItem(rest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(q_item.Data, item) {
+			t.Fatal("items should have equalled each other")
+		}
+	}
+	send <- EncodePlainMessage("MOVE", []byte("default processing"))
+	if cmd, _ := DecodeCmd(<-recv); cmd != "ERROR" {
+		t.Fatal("expected an error", cmd)
+	}
+	send <- EncodePlainMessage("USE", []byte("processing"))
+	<-recv
+	for _, item := range l {
+		send <- EncodePlainMessage("DEQUE", nil)
+		cmd, rest := DecodeCmd(<-recv)
+		if cmd != "ITEM" {
+			t.Fatal("expected an item", cmd)
+		}
+		q_item, err := DecodeItem(rest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(q_item.Data, item) {
+			t.Fatal("items should have equalled each other")
+		}
+		if q_item.Deliveries != 2 {
+			t.Fatal("expected two deliveries", q_item.Deliveries)
+		}
+	}
+	close(send)
+	<-recv
+}
+
+func TestMoveWhileDequeing(t *testing.T) {
+	server := NewServer(func() Queue { return queue.NewQueue(true) })
+	const n = 200
+	src, _ := server.queue("src")
+	for i := 0; i < n; i++ {
+		src.Enque(queue.NewItem([]byte(fmt.Sprint(i)), nil))
+	}
+	mover, mrecv := connect(server)
+	consumer, crecv := connect(server)
+	consumer <- []byte("USE dst\n")
+	<-crecv
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			mover <- []byte("MOVE src dst\n")
+			if cmd, _ := DecodeCmd(<-mrecv); cmd != "ITEM" {
+				t.Error("move failed", cmd)
+				return
+			}
+		}
+	}()
+	// dequeuing (and so changing) the moved items as they arrive on dst
+	// mustn't touch the items MOVE hands back
+	for got := 0; got < n; {
+		consumer <- []byte("DEQUE\n")
+		if cmd, _ := DecodeCmd(<-crecv); cmd == "ITEM" {
+			got += 1
+		}
+	}
+	<-done
+	close(mover)
+	close(consumer)
+	for _ = range mrecv {
+	}
+	for _ = range crecv {
+	}
+}
+
+func TestMoveRestores(t *testing.T) {
+	server := NewServer(func() Queue { return NewBoundedQueue(queue.NewQueue(false), 2, 0) })
+	src, _ := server.queue("src")
+	dst, _ := server.queue("dst")
+	for _, data := range []string{"a", "b"} {
+		src.Enque(queue.NewItem([]byte(data), nil))
+	}
+	dst.Enque(queue.NewItem([]byte("a"), nil))
+	if _, err := server.Move("src", "dst"); err == nil || !strings.Contains(err.Error(), "already has the item") {
+		t.Fatal("expected the duplicate to be refused", err)
+	}
+	dst.Enque(queue.NewItem([]byte("c"), nil))
+	if _, err := server.Move("src", "dst"); err == nil || !strings.Contains(err.Error(), "full") {
+		t.Fatal("expected dst to be full", err)
+	}
+	for _, data := range []string{"a", "b"} {
+		item, err := src.Deque()
+		if err != nil || string(item.Data) != data || item.Deliveries != 0 {
+			t.Fatal("expected src to be left as it was", data, item, err)
+		}
+	}
+}
+
+func TestBlockingMove(t *testing.T) {
+	server := NewServer(func() Queue { return queue.NewQueue(true) })
+	send, recv := connect(server)
+	send <- EncodePlainMessage("BMOVE", []byte("work processing 0.05"))
+	cmd, rest := DecodeCmd(<-recv)
+	if cmd != "ERROR" {
+		t.Fatal("expected an error", cmd)
+	}
+	if msg, err := DecodeB64(rest); err != nil || string(msg) != "queue is empty" {
+		t.Fatal("expected queue empty message", string(msg), err)
+	}
+
+	item := rand_bytes(rand.Intn(32) + 2)
+	send <- EncodePlainMessage("BMOVE", []byte("work processing 0"))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		producer, precv := connect(server)
+		producer <- EncodePlainMessage("USE", []byte("work"))
+		<-precv
+		producer <- EncodeB64Message("ENQUE", item)
+		<-precv
+		close(producer)
+		<-precv
+	}()
+	cmd, rest = DecodeCmd(<-recv)
+	if cmd != "ITEM" {
+		t.Fatal("expected an item", cmd)
+	}
+	q_item, err := DecodeItem(rest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(q_item.Data, item) {
+		t.Fatal("items should have equalled each other")
+	}
+	close(send)
+	<-recv
+}
+
+func respEncode(args ...string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return buf.Bytes()
+}
+
+// reads a reply and renders it as a string. nil replies are "(nil)" and
+// arrays are rendered as [a b c]
+func respReply(t *testing.T, r *bufio.Reader) string {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	line = strings.TrimRight(line, "\r\n")
+	switch line[0] {
+	case '+', '-', ':':
+		return line
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return "(nil)"
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			t.Fatal(err)
+		}
+		return string(data[:n])
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return "(nil)"
+		}
+		items := make([]string, 0, n)
+		for i := 0; i < n; i++ {
+			items = append(items, respReply(t, r))
+		}
+		return "[" + strings.Join(items, " ") + "]"
+	}
+	t.Fatalf("bad reply '%v'", line)
+	return ""
+}
+
+func TestRESP(t *testing.T) {
+	server := NewServer(func() Queue { return queue.NewQueue(true) })
+	client, con := net.Pipe()
+	go server.ServeRESP(con)
+	defer client.Close()
+	r := bufio.NewReader(client)
+	check := func(expected string, args ...string) {
+		if _, err := client.Write(respEncode(args...)); err != nil {
+			t.Fatal(err)
+		}
+		if reply := respReply(t, r); reply != expected {
+			t.Fatalf("%v: expected '%v' got '%v'", args, expected, reply)
+		}
+	}
+
+	check("+PONG", "PING")
+	check("hello", "PING", "hello")
+	check(":0", "LLEN", "jobs")
+	check(":2", "LPUSH", "jobs", "a", "b")
+	check(":3", "lpush", "jobs", "c\r\nd")
+	check(":3", "LLEN", "jobs")
+	check("a", "RPOP", "jobs")
+	check("[jobs b]", "BRPOP", "other", "jobs", "1")
+	check("c\r\nd", "RPOP", "jobs")
+	check("(nil)", "RPOP", "jobs")
+	check("(nil)", "BRPOP", "jobs", "0.01")
+	check(":1", "LPUSH", "other", "x")
+	check(":2", "RPUSH", "other", "urgent")
+	check("x", "LPOP", "other")
+	check("[default jobs other]", "KEYS", "*")
+	check("[jobs]", "KEYS", "j*")
+	check(":2", "DEL", "jobs", "other", "missing")
+	check("[default]", "KEYS", "*")
+	check("-ERR wrong number of arguments for 'lpush' command", "LPUSH", "jobs")
+	check("-ERR unknown command 'WIZARD'", "WIZARD")
+
+	if _, err := client.Write([]byte("PING\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if reply := respReply(t, r); reply != "+PONG" {
+		t.Fatalf("inline PING got '%v'", reply)
+	}
+
+	done := make(chan string)
+	go func() {
+		c2, con2 := net.Pipe()
+		go server.ServeRESP(con2)
+		defer c2.Close()
+		c2.Write(respEncode("BRPOP", "later", "0"))
+		done <- respReply(t, bufio.NewReader(c2))
+	}()
+	time.Sleep(10 * time.Millisecond)
+	check(":1", "LPUSH", "later", "item")
+	if reply := <-done; reply != "[later item]" {
+		t.Fatalf("blocked BRPOP got '%v'", reply)
+	}
+
+	// a client which hangs up while blocked doesn't take the next item
+	c3, con3 := net.Pipe()
+	served := make(chan struct{})
+	go func() {
+		server.ServeRESP(con3)
+		close(served)
+	}()
+	c3.Write(respEncode("BRPOP", "abandoned", "0"))
+	c3.Close()
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("expected the blocked BRPOP to notice the client hang up")
+	}
+	check(":1", "LPUSH", "abandoned", "item")
+
+	// an item which can't be written to the client is put back
+	reader, writer := io.Pipe()
+	served = make(chan struct{})
+	go func() {
+		server.ServeRESP(brokenWriter{reader})
+		close(served)
+	}()
+	writer.Write(respEncode("BRPOP", "undelivered", "0"))
+	check(":1", "LPUSH", "undelivered", "item")
+	<-served
+	check(":1", "LLEN", "undelivered")
+	check("[undelivered item]", "BRPOP", "undelivered", "0")
+}
+
+/* A connection (without deadlines) whose writes fail. */
+type brokenWriter struct {
+	*io.PipeReader
+}
+
+func (self brokenWriter) Write(p []byte) (int, error) {
+	return 0, fmt.Errorf("broken")
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	bk := newBucket()
+	rate := Rate{PerSecond: 10, Burst: 2}
+	for i := 0; i < 2; i++ {
+		if ok, _ := bk.take(rate, now); !ok {
+			t.Fatal("should have had a token for the burst", i)
+		}
+	}
+	ok, wait := bk.take(rate, now)
+	if ok {
+		t.Fatal("should have been out of tokens")
+	}
+	if wait != 100*time.Millisecond {
+		t.Fatal("expected to wait 100ms", wait)
+	}
+	if ok, _ := bk.take(rate, now.Add(wait)); !ok {
+		t.Fatal("should have had a token after waiting")
+	}
+	if ok, _ := bk.take(Rate{}, now.Add(wait)); !ok {
+		t.Fatal("a zero rate is unlimited")
+	}
+	if wait := bk.reserve(rate, now.Add(wait)); wait != 100*time.Millisecond {
+		t.Fatal("expected reserve to wait 100ms", wait)
+	}
+
+	for _, s := range []string{"x", "-1", "1:x", "1:-2"} {
+		if _, err := ParseRate(s); err == nil {
+			t.Fatal("expected an error parsing", s)
+		}
+	}
+	if r, err := ParseRate("0.5:10"); err != nil || r.PerSecond != .5 || r.Burst != 10 {
+		t.Fatal("bad rate", r, err)
+	}
+}
+
+func TestQueueRateLimit(t *testing.T) {
+	server := NewServer(func() Queue { return queue.NewQueue(true) })
+	server.SetDefaultQueueRate(Rate{PerSecond: 0.001, Burst: 2}, Rate{})
+	send, recv := connect(server)
+	enque := func() (string, []byte) {
+		send <- EncodeB64Message("ENQUE", rand_bytes(8))
+		return DecodeCmd(<-recv)
+	}
+	for i := 0; i < 2; i++ {
+		if cmd, _ := enque(); cmd != "OK" {
+			t.Fatal("expected an OK", cmd)
+		}
+	}
+	cmd, rest := enque()
+	if cmd != "ERROR" {
+		t.Fatal("expected an error", cmd)
+	}
+	msg, err := DecodeB64(rest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(msg), "rate limited") {
+		t.Fatal("expected a rate limited error", string(msg))
+	}
+
+	server.SetQueueRate("default", Rate{}, Rate{PerSecond: 0.001, Burst: 1})
+	if cmd, _ := enque(); cmd != "OK" {
+		t.Fatal("expected the new rate to apply", cmd)
+	}
+	send <- EncodePlainMessage("DEQUE", nil)
+	if cmd, _ := DecodeCmd(<-recv); cmd != "ITEM" {
+		t.Fatal("expected an item", cmd)
+	}
+	send <- EncodePlainMessage("DEQUE", nil)
+	if cmd, _ := DecodeCmd(<-recv); cmd != "ERROR" {
+		t.Fatal("expected a rate limited DEQUE", cmd)
+	}
+	close(send)
+	<-recv
+}
+
+func TestConnectionRateLimit(t *testing.T) {
+	server := NewServer(func() Queue { return queue.NewQueue(true) })
+	server.SetConnectionRate(Rate{PerSecond: 100, Burst: 1})
+	send, recv := connect(server)
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		send <- EncodePlainMessage("SIZE", nil)
+		if cmd, _ := DecodeCmd(<-recv); cmd != "SIZE" {
+			t.Fatal("expected a SIZE (not an error)", cmd)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatal("commands should have been delayed", elapsed)
+	}
+	close(send)
+	<-recv
+}
+
+func TestLineLimits(t *testing.T) {
+	server := NewServer(func() Queue { return queue.NewQueue(true) })
+	server.SetLimits(Limits{MaxLineLength: 64, MaxItemSize: 8})
+	send, recv := connect(server)
+	expectError := func(expected string) {
+		cmd, rest := DecodeCmd(<-recv)
+		if cmd != "ERROR" {
+			t.Fatal("expected an error", cmd)
+		}
+		if msg, err := DecodeB64(rest); err != nil || string(msg) != expected {
+			t.Fatalf("expected '%v' got '%v' %v", expected, string(msg), err)
+		}
+	}
+	send <- EncodeB64Message("ENQUE", rand_bytes(128))
+	expectError("line too long (max 64 bytes)")
+	send <- EncodeB64Message("ENQUE", rand_bytes(9))
+	expectError("item too large (9 bytes, max 8)")
+	send <- EncodeB64Message("ENQUE", rand_bytes(8))
+	if cmd, _ := DecodeCmd(<-recv); cmd != "OK" {
+		t.Fatal("expected an OK after resyncing", cmd)
+	}
+	close(send)
+	<-recv
+}
+
+func TestTimeouts(t *testing.T) {
+	server := NewServer(func() Queue { return queue.NewQueue(true) })
+	server.SetLimits(Limits{IdleTimeout: 20 * time.Millisecond, ReadTimeout: 20 * time.Millisecond})
+	check := func(expected string, partial []byte) {
+		send, recv := connect(server)
+		if partial != nil {
+			send <- partial
+		}
+		cmd, rest := DecodeCmd(<-recv)
+		if msg, err := DecodeB64(rest); cmd != "ERROR" || err != nil || string(msg) != expected {
+			t.Fatalf("expected '%v' got %v '%v' %v", expected, cmd, string(msg), err)
+		}
+		close(send)
+		if _, open := <-recv; open {
+			t.Fatal("expected the connection to be closed")
+		}
+	}
+	check("idle timeout", nil)
+	check("read timeout", []byte("ENQUE aGk"))
+}
+
+func freePort(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func dial(t *testing.T, port int) net.Conn {
+	for i := 0; i < 100; i++ {
+		con, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err == nil {
+			return con
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("could not connect to", port)
+	return nil
+}
+
+func TestListen(t *testing.T) {
+	server := NewServer(func() Queue { return queue.NewQueue(true) })
+	addr, err := server.Listen(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	if addr.Port == 0 {
+		t.Fatal("expected the bound port", addr)
+	}
+	con := dial(t, addr.Port)
+	defer con.Close()
+	con.Write([]byte("SIZE\n"))
+	if line, err := bufio.NewReader(con).ReadString('\n'); err != nil || line != "SIZE 0\n" {
+		t.Fatal("expected a size", line, err)
+	}
+	if _, err := server.Listen(0); err == nil {
+		t.Fatal("expected an error listening twice")
+	}
+	other := NewServer(func() Queue { return queue.NewQueue(true) })
+	if _, err := other.Listen(addr.Port); err == nil {
+		other.Stop()
+		t.Fatal("expected an error for a port in use")
+	}
+	respAddr, err := server.ListenRESP(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := dial(t, respAddr.Port)
+	defer resp.Close()
+	resp.Write([]byte("PING\r\n"))
+	if line, err := bufio.NewReader(resp).ReadString('\n'); err != nil || line != "+PONG\r\n" {
+		t.Fatal("expected a PONG", line, err)
+	}
+}
+
+/* A listener which fails with errs, one per accept. */
+type failingListener struct {
+	errs  []error
+	calls int
+}
+
+type tempError struct{}
+
+func (tempError) Error() string   { return "accept: too many open files" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+func (self *failingListener) AcceptTCP() (*net.TCPConn, error) {
+	err := self.errs[self.calls]
+	self.calls += 1
+	return nil, err
+}
+
+func (self *failingListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9001}
+}
+
+func TestAccept(t *testing.T) {
+	ln := &failingListener{errs: []error{tempError{}, tempError{}, net.ErrClosed}}
+	if con, ok := accept(ln); ok || con != nil {
+		t.Fatal("expected accept to stop once the listener is closed")
+	}
+	if ln.calls != 3 {
+		t.Fatal("expected temporary errors to be retried", ln.calls)
+	}
+	ln = &failingListener{errs: []error{fmt.Errorf("broken"), tempError{}}}
+	if _, ok := accept(ln); ok || ln.calls != 1 {
+		t.Fatal("expected accept to give up on an error which isn't temporary", ln.calls)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	server := NewServer(func() Queue { return queue.NewQueue(true) })
+	server.SetLimits(Limits{MaxConnections: 1})
+	port := freePort(t)
+	go server.Start(port)
+	defer server.Stop()
+
+	first := dial(t, port)
+	r := bufio.NewReader(first)
+	first.Write([]byte("SIZE\n"))
+	if line, err := r.ReadString('\n'); err != nil || line != "SIZE 0\n" {
+		t.Fatal("expected a size", line, err)
+	}
+
+	second := dial(t, port)
+	line, err := bufio.NewReader(second).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, rest := DecodeCmd([]byte(line))
+	if msg, _ := DecodeB64(rest); cmd != "ERROR" || string(msg) != "too many connections" {
+		t.Fatal("expected to be rejected", line)
+	}
+	second.Close()
+
+	first.Close()
+	for i := 0; ; i++ {
+		third := dial(t, port)
+		third.Write([]byte("SIZE\n"))
+		line, err := bufio.NewReader(third).ReadString('\n')
+		third.Close()
+		if err == nil && line == "SIZE 0\n" {
+			break
+		} else if i > 100 {
+			t.Fatal("expected to connect once the first connection closed", line, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRESPLimits(t *testing.T) {
+	server := NewServer(func() Queue { return queue.NewQueue(true) })
+	server.SetLimits(Limits{MaxItemSize: 8, MaxLineLength: 16, IdleTimeout: 50 * time.Millisecond})
+	client, con := net.Pipe()
+	go server.ServeRESP(con)
+	defer client.Close()
+	r := bufio.NewReader(client)
+	check := func(expected string, cmd []byte) {
+		if _, err := client.Write(cmd); err != nil {
+			t.Fatal(err)
+		}
+		if reply := respReply(t, r); reply != expected {
+			t.Fatalf("expected '%v' got '%v'", expected, reply)
+		}
+	}
+	check("-ERR item too large (9 bytes, max 8)", respEncode("LPUSH", "q", "123456789"))
+	check("-ERR line too long (max 16 bytes)", []byte("PING 0123456789abcdef\r\n"))
+	check(":1", respEncode("LPUSH", "q", "12345678"))
+	if reply := respReply(t, r); reply != "-ERR idle timeout" {
+		t.Fatalf("expected an idle timeout got '%v'", reply)
+	}
+}
+
+func TestRESPBadLengths(t *testing.T) {
+	server := NewServer(func() Queue { return queue.NewQueue(true) })
+	bad := map[string]string{
+		"*-1\r\n":                        "-ERR Protocol error: invalid multibulk length",
+		"*99999999\r\n":                  "-ERR Protocol error: invalid multibulk length",
+		"*1\r\n$-5\r\n":                   "-ERR Protocol error: invalid bulk length",
+		"*2\r\n$4\r\nPING\r\n$9999999999\r\n": "-ERR Protocol error: invalid bulk length",
+		"*1\r\n$" + strings.Repeat("9", 100000) + "\r\n": "-ERR line too long (max 32 bytes)",
+	}
+	for cmd, expected := range bad {
+		client, con := net.Pipe()
+		go server.ServeRESP(con)
+		client.Write([]byte(cmd))
+		if reply := respReply(t, bufio.NewReader(client)); reply != expected {
+			t.Fatalf("%q: expected '%v' got '%v'", cmd, expected, reply)
+		}
+		client.Close()
+	}
+	// a huge claimed length costs nothing until the data arrives
+	client, con := net.Pipe()
+	go server.ServeRESP(con)
+	client.Write([]byte("*3\r\n$5\r\nLPUSH\r\n$1\r\nq\r\n$536870912\r\n"))
+	client.Close()
+	client, con = net.Pipe()
+	go server.ServeRESP(con)
+	defer client.Close()
+	client.Write(respEncode("PING"))
+	if reply := respReply(t, bufio.NewReader(client)); reply != "+PONG" {
+		t.Fatalf("expected the server to keep serving got '%v'", reply)
+	}
+}
+
+var benchSizes = []int{64, 4096, 65536}
+
+// n ENQUE lines each carrying an item of size bytes
+func benchPayload(n, size int) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		buf.Write(EncodeB64Message("ENQUE", rand_bytes(size)))
+	}
+	return buf.Bytes()
+}
+
+func benchReader(b *testing.B, read func(payload []byte) int) {
+	for _, size := range benchSizes {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			payload := benchPayload(64, size)
+			b.SetBytes(int64(len(payload)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if n := read(payload); n != 64 {
+					b.Fatal("expected 64 lines got", n)
+				}
+			}
+		})
+	}
+}
+
+// The old connection pipeline. Every byte crosses a channel (as it did with
+// netutils.TCPReader) and then netutils.Readlines splits it into lines.
+func BenchmarkChannelReader(b *testing.B) {
+	benchReader(b, func(payload []byte) int {
+		recv := make(chan byte, 4096)
+		go func() {
+			r := bytes.NewReader(payload)
+			buf := make([]byte, 4096)
+			for {
+				n, err := r.Read(buf)
+				for _, c := range buf[:n] {
+					recv <- c
+				}
+				if err != nil {
+					close(recv)
+					return
+				}
+			}
+		}()
+		count := 0
+		for _ = range netutils.Readlines(recv) {
+			count++
+		}
+		return count
+	})
+}
+
+// The buffered connection pipeline.
+func BenchmarkBufferedReader(b *testing.B) {
+	benchReader(b, func(payload []byte) int {
+		r := getReader(bytes.NewReader(payload))
+		defer putReader(r)
+		var buf []byte
+		count := 0
+		for {
+			_, err := readLine(r, 0, &buf)
+			if err == io.EOF {
+				return count
+			} else if err != nil {
+				b.Fatal(err)
+			}
+			count++
+		}
+	})
+}
+
+// ENQUE then DEQUE round trips through a Connection over an in memory pipe.
+func BenchmarkConnection(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			server := NewServer(func() Queue { return queue.NewQueue(true) })
+			client, con := net.Pipe()
+			go server.Connection(con).Serve()
+			defer client.Close()
+			r := bufio.NewReaderSize(client, 2*size+1024)
+			enque := EncodeB64Message("ENQUE", rand_bytes(size))
+			deque := EncodePlainMessage("DEQUE", nil)
+			b.SetBytes(int64(2 * len(enque)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				client.Write(enque)
+				if _, err := r.ReadSlice('\n'); err != nil {
+					b.Fatal(err)
+				}
+				client.Write(deque)
+				if _, err := r.ReadSlice('\n'); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestCommandLogging(t *testing.T) {
+	var buf bytes.Buffer
+	var lock sync.Mutex
+	SetLogger(slog.New(slog.NewJSONHandler(&lockedWriter{&lock, &buf}, nil)))
+	defer SetLogger(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+
+	server := NewServer(func() Queue { return queue.NewQueue(true) })
+	server.SetCommandLogging(true)
+	send, recv := connect(server)
+	send <- EncodePlainMessage("USE", []byte("jobs"))
+	<-recv
+	send <- EncodeB64Message("ENQUE", []byte("secret payload"))
+	<-recv
+	close(send)
+	<-recv
+	time.Sleep(10 * time.Millisecond)
+
+	lock.Lock()
+	defer lock.Unlock()
+	if bytes.Contains(buf.Bytes(), []byte("secret")) || bytes.Contains(buf.Bytes(), []byte("c2VjcmV0")) {
+		t.Fatal("the payload should not have been logged")
+	}
+	found := false
+	for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var record map[string]interface{}
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatal(err, string(line))
+		}
+		if record["pkg"] != "queued/net" || record["conn"] == nil || record["remote"] == nil {
+			t.Fatal("missing connection fields", string(line))
+		}
+		if record["msg"] == "command" && record["cmd"] == "ENQUE" {
+			found = true
+			if record["queue"] != "jobs" {
+				t.Fatal("expected the queue to be logged", string(line))
+			}
+		}
+	}
+	if !found {
+		t.Fatal("expected the ENQUE to be logged", buf.String())
+	}
+}
+
+type lockedWriter struct {
+	lock *sync.Mutex
+	w    io.Writer
+}
+
+func (self *lockedWriter) Write(p []byte) (int, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.w.Write(p)
+}
+
+func TestBoundedQueue(t *testing.T) {
+	q := NewBoundedQueue(queue.NewQueue(true), 2, 0)
+	if err := q.Enque(queue.NewItem([]byte("a"), nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Enque(queue.NewItem([]byte("b"), nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Enque(queue.NewItem([]byte("c"), nil)); err == nil {
+		t.Fatal("expected the queue to be full")
+	}
+	q.SetMaxSize(0)
+	if err := q.Enque(queue.NewItem([]byte("c"), nil)); err != nil {
+		t.Fatal(err)
+	}
+	old := queue.NewItem([]byte("old"), nil)
+	old.Enqueued = time.Now().Add(-time.Hour)
+	q.Enque(old)
+	fresh := queue.NewItem([]byte("fresh"), nil)
+	q.Enque(fresh)
+	q.SetTTL(time.Minute)
+	for _, expected := range []string{"a", "b", "c", "fresh"} {
+		item, err := q.Deque()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(item.Data) != expected {
+			t.Fatal("expected", expected, "got", string(item.Data))
+		}
+	}
+	if q.Expired() != 1 {
+		t.Fatal("expected one expired item", q.Expired())
+	}
+	q.Enque(old)
+	if _, err := q.Deque(); err == nil || err.Error() != "queue is empty" {
+		t.Fatal("expected the expired item to be dropped", err)
+	}
+}
+
+func TestDeclare(t *testing.T) {
+	server := NewServer(func() Queue { return queue.NewQueue(true) })
+	bounded := func() Queue { return NewBoundedQueue(queue.NewQueue(true), 1, 0) }
+	if _, created := server.Declare("small", bounded); !created {
+		t.Fatal("expected small to be created")
+	}
+	if _, has := server.Lookup("small"); !has {
+		t.Fatal("expected small to exist")
+	}
+	send, recv := connect(server)
+	send <- EncodePlainMessage("USE", []byte("small"))
+	<-recv
+	send <- EncodeB64Message("ENQUE", []byte("a"))
+	if cmd, _ := DecodeCmd(<-recv); cmd != "OK" {
+		t.Fatal("expected an OK response", cmd)
+	}
+	send <- EncodeB64Message("ENQUE", []byte("b"))
+	if cmd, _ := DecodeCmd(<-recv); cmd != "ERROR" {
+		t.Fatal("expected an error", cmd)
+	}
+	close(send)
+	<-recv
+	server.remove("small")
+	q, _ := server.queue("small")
+	if _, ok := q.(*BoundedQueue); !ok {
+		t.Fatal("expected small to be recreated as it was declared")
+	}
+	server.Undeclare("small")
+	server.remove("small")
+	q, _ = server.queue("small")
+	if _, ok := q.(*BoundedQueue); ok {
+		t.Fatal("expected small to be created like any other queue")
+	}
+}
+
+func TestTaggedRequests(t *testing.T) {
+	server := NewServer(func() Queue { return queue.NewQueue(true) })
+	send, recv := connect(server)
+	send <- []byte("#a BMOVE work processing 0\n")
+	send <- []byte("#b BMOVE other processing 0\n")
+	send <- []byte("USE work\n")
+	if cmd, _ := DecodeCmd(<-recv); cmd != "OK" {
+		t.Fatal("expected USE to be answered while the BMOVEs wait", cmd)
+	}
+	send <- []byte("#c " + string(EncodeB64Message("ENQUE", []byte("hello"))))
+	replies := map[string]string{}
+	for len(replies) < 2 {
+		tag, line, err := DecodeTag(<-recv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd, rest := DecodeCmd(line)
+		replies[string(tag)] = cmd
+		if string(tag) == "#a" {
+			item, err := DecodeItem(rest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(item.Data) != "hello" {
+				t.Fatal("bad item", string(item.Data))
+			}
+		}
+	}
+	if replies["#a"] != "ITEM" || replies["#c"] != "OK" {
+		t.Fatal("bad replies", replies)
+	}
+	send <- []byte("#d NOPE\n")
+	if tag, line, _ := DecodeTag(<-recv); string(tag) != "#d" || !bytes.HasPrefix(line, []byte("ERROR")) {
+		t.Fatal("expected a tagged error", string(tag), string(line))
+	}
+	send <- []byte("#" + strings.Repeat("x", 40) + " SIZE\n")
+	if cmd, _ := DecodeCmd(<-recv); cmd != "ERROR" {
+		t.Fatal("expected an error for a long tag", cmd)
+	}
+	// closing the connection cancels #b
+	close(send)
+	for _ = range recv {
+	}
+}
+
+/* A bare bones WebSocket client: handshake then masked frames. */
+func wsDial(t *testing.T, url string) (net.Conn, *bufio.Reader) {
+	con, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(con, "GET /queues HTTP/1.1\r\nHost: queued\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n")
+	r := bufio.NewReader(con)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatal("bad handshake status", resp.Status)
+	}
+	// the example from RFC 6455
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatal("bad accept", accept)
+	}
+	return con, r
+}
+
+func wsRead(t *testing.T, r *bufio.Reader) (byte, []byte) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		t.Fatal(err)
+	}
+	if head[1]&0x80 != 0 {
+		t.Fatal("server frames should not be masked")
+	}
+	n := int(head[1] & 0x7f)
+	if n == 126 {
+		var ext [2]byte
+		io.ReadFull(r, ext[:])
+		n = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return head[0] & 0x0f, payload
+}
+
+func TestWebSocket(t *testing.T) {
+	server := NewServer(func() Queue { return queue.NewQueue(true) })
+	ts := httptest.NewServer(server.WebSocketHandler())
+	defer ts.Close()
+
+	if resp, err := http.Get(ts.URL); err != nil {
+		t.Fatal(err)
+	} else if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("expected a plain GET to be refused", resp.Status)
+	}
+
+	con, r := wsDial(t, ts.URL)
+	defer con.Close()
+	mask := []byte{1, 2, 3, 4}
+	msg := EncodeB64Message("ENQUE", []byte("hello"))
+	// the first half as a fragment, the rest as a continuation
+	con.Write([]byte{wsText, byte(0x80 | 6)})
+	con.Write(mask)
+	half := make([]byte, 6)
+	for i := range half {
+		half[i] = msg[i] ^ mask[i%4]
+	}
+	con.Write(half)
+	if err := writeWSFrame(con, wsContinuation, msg[6:], mask); err != nil {
+		t.Fatal(err)
+	}
+	if op, reply := wsRead(t, r); op != wsText || !bytes.HasPrefix(reply, []byte("OK ")) {
+		t.Fatal("bad reply", op, string(reply))
+	}
+	writeWSFrame(con, wsPing, []byte("hi"), mask)
+	if op, reply := wsRead(t, r); op != wsPong || string(reply) != "hi" {
+		t.Fatal("expected a pong", op, string(reply))
+	}
+	writeWSFrame(con, wsText, []byte("#t DEQUE"), mask)
+	op, reply := wsRead(t, r)
+	tag, line, err := DecodeTag(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd, rest := DecodeCmd(line); op != wsText || string(tag) != "#t" || cmd != "ITEM" {
+		t.Fatal("bad reply", op, string(reply))
+	} else if item, err := DecodeItem(rest); err != nil || string(item.Data) != "hello" {
+		t.Fatal("bad item", err)
+	}
+	writeWSFrame(con, wsText, []byte("SIZE"), nil)
+	if op, reply := wsRead(t, r); op != wsClose || binary.BigEndian.Uint16(reply) != 1002 {
+		t.Fatal("expected unmasked frames to close the connection", op, string(reply))
+	}
+}
+
+func TestWebSocketSlowUpgrade(t *testing.T) {
+	server := NewServer(func() Queue { return queue.NewQueue(true) })
+	server.SetLimits(Limits{ReadTimeout: 20 * time.Millisecond})
+	addr, err := server.ListenWebSocket(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	con, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer con.Close()
+	con.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n"))
+	con.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadAll(con); err != nil {
+		t.Fatal("expected the server to hang up on a slow upgrade request", err)
+	}
+}
+
+func TestRing(t *testing.T) {
+	nodes := []string{"a:9001", "b:9001", "c:9001"}
+	ring := NewRing(nodes)
+	counts := make(map[string]int)
+	owners := make(map[string]string)
+	for i := 0; i < 3000; i++ {
+		name := fmt.Sprintf("queue-%d", i)
+		owners[name] = ring.Owner(name)
+		counts[owners[name]] += 1
+	}
+	for _, node := range nodes {
+		if counts[node] < 600 {
+			t.Fatal("uneven split", counts)
+		}
+	}
+	// a new node only takes queues, it doesn't shuffle the others
+	bigger := NewRing(append(nodes, "d:9001"))
+	for name, owner := range owners {
+		if now := bigger.Owner(name); now != owner && now != "d:9001" {
+			t.Fatal(name, "moved from", owner, "to", now)
+		}
+	}
+}
+
+func TestCluster(t *testing.T) {
+	nodes := []string{"a:9001", "b:9001"}
+	server := NewServer(func() Queue { return queue.NewQueue(true) })
+	if err := server.SetCluster("c:9001", nodes); err == nil {
+		t.Fatal("expected an error joining as a node not in the cluster")
+	}
+	if err := server.SetCluster("a:9001", nodes); err != nil {
+		t.Fatal(err)
+	}
+	var local, remote string
+	for i := 0; local == "" || remote == ""; i++ {
+		name := fmt.Sprintf("q%d", i)
+		if _, is := server.Owner(name); is {
+			local = name
+		} else {
+			remote = name
+		}
+	}
+	send, recv := connect(server)
+	defer close(send)
+	send <- []byte("USE " + remote + "\n")
+	if cmd, rest := DecodeCmd(<-recv); cmd != "MOVED" || string(bytes.TrimSpace(rest)) != "b:9001" {
+		t.Fatal("expected a redirect", cmd, string(rest))
+	}
+	send <- []byte("#t MOVE " + remote + " " + local + "\n")
+	if tag, line, _ := DecodeTag(<-recv); string(tag) != "#t" || !bytes.HasPrefix(line, []byte("MOVED")) {
+		t.Fatal("expected a tagged redirect", string(line))
+	}
+	send <- []byte("MOVE " + local + " " + remote + "\n")
+	if cmd, _ := DecodeCmd(<-recv); cmd != "ERROR" {
+		t.Fatal("expected an error moving to another node", cmd)
+	}
+	send <- []byte("USE " + local + "\n")
+	if cmd, _ := DecodeCmd(<-recv); cmd != "OK" {
+		t.Fatal("expected to use a local queue", cmd)
+	}
+
+	client, con := net.Pipe()
+	go server.ServeRESP(con)
+	defer client.Close()
+	client.Write(respEncode("LPUSH", remote, "x"))
+	if reply := respReply(t, bufio.NewReader(client)); reply != "-MOVED b:9001" {
+		t.Fatal("expected a RESP redirect", reply)
+	}
+}
+
+func TestMessageGroups(t *testing.T) {
+	server := NewServer(func() Queue { return queue.NewQueue(true) })
+	server.Declare("jobs", func() Queue {
+		return NewBoundedQueue(queue.NewGroupQueue(true), 0, 0)
+	})
+	enque := func(send chan<- []byte, recv <-chan []byte, data, group string) {
+		headers := map[string]string{queue.GroupHeader: group}
+		send <- []byte("ENQUE " + base64.StdEncoding.EncodeToString([]byte(data)) + " " + string(EncodeHeaders(headers)) + "\n")
+		if cmd, _ := DecodeCmd(<-recv); cmd != "OK" {
+			t.Fatal("enque failed", cmd)
+		}
+	}
+	deque := func(send chan<- []byte, recv <-chan []byte) *queue.Item {
+		send <- []byte("DEQUE\n")
+		cmd, rest := DecodeCmd(<-recv)
+		if cmd != "ITEM" {
+			return nil
+		}
+		item, err := DecodeItem(rest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return item
+	}
+	send, recv := connect(server)
+	send <- []byte("USE jobs\n")
+	<-recv
+	enque(send, recv, "a1", "a")
+	enque(send, recv, "a2", "a")
+	enque(send, recv, "b1", "b")
+
+	other, orecv := connect(server)
+	other <- []byte("USE jobs\n")
+	<-orecv
+	a1 := deque(send, recv)
+	if b1 := deque(other, orecv); a1 == nil || b1 == nil || string(b1.Data) != "b1" {
+		t.Fatal("expected a1 and b1 to go out together", a1, b1)
+	}
+	if item := deque(other, orecv); item != nil {
+		t.Fatal("a2 should wait for a1 to be acked", string(item.Data))
+	}
+	other <- []byte("ACK " + a1.Id + "\n")
+	if cmd, _ := DecodeCmd(<-orecv); cmd != "ERROR" {
+		t.Fatal("only the connection holding an item may ack it", cmd)
+	}
+	send <- []byte("ACK " + a1.Id + "\n")
+	if cmd, _ := DecodeCmd(<-recv); cmd != "OK" {
+		t.Fatal("ack failed", cmd)
+	}
+	a2 := deque(other, orecv)
+	if a2 == nil || string(a2.Data) != "a2" {
+		t.Fatal("expected a2", a2)
+	}
+	// hanging up without acking puts a2 back
+	released := server.wait("jobs")
+	close(other)
+	for _ = range orecv {
+	}
+	select {
+	case <-released:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a2 wasn't released")
+	}
+	a2 = deque(send, recv)
+	if a2 == nil || string(a2.Data) != "a2" || a2.Deliveries != 2 {
+		t.Fatal("expected a2 to be redelivered", a2)
+	}
+	close(send)
+	for _ = range recv {
+	}
+}
+
+func TestHoldTimeout(t *testing.T) {
+	server := NewServer(func() Queue { return queue.NewQueue(true) })
+	server.SetLimits(Limits{HoldTimeout: 50 * time.Millisecond})
+	server.Declare("jobs", func() Queue { return queue.NewGroupQueue(true) })
+	headers := map[string]string{queue.GroupHeader: "a"}
+	send, recv := connect(server)
+	send <- []byte("USE jobs\n")
+	<-recv
+	for _, data := range []string{"a1", "a2"} {
+		send <- []byte("ENQUE " + base64.StdEncoding.EncodeToString([]byte(data)) + " " + string(EncodeHeaders(headers)) + "\n")
+		if cmd, _ := DecodeCmd(<-recv); cmd != "OK" {
+			t.Fatal("enque failed", cmd)
+		}
+	}
+	// a hung consumer: it dequeues a1 and never acks it
+	send <- []byte("DEQUE\n")
+	cmd, rest := DecodeCmd(<-recv)
+	if cmd != "ITEM" {
+		t.Fatal("expected an item", cmd)
+	}
+	a1, err := DecodeItem(rest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	released := server.wait("jobs")
+	other, orecv := connect(server)
+	defer func() {
+		close(other)
+		for _ = range orecv {
+		}
+	}()
+	other <- []byte("USE jobs\n")
+	<-orecv
+	other <- []byte("DEQUE\n")
+	if cmd, _ := DecodeCmd(<-orecv); cmd != "ERROR" {
+		t.Fatal("a2 should wait for a1", cmd)
+	}
+	select {
+	case <-released:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a1 wasn't released after the hold timeout")
+	}
+	other <- []byte("DEQUE\n")
+	cmd, rest = DecodeCmd(<-orecv)
+	if cmd != "ITEM" {
+		t.Fatal("expected a1 to be redelivered", cmd)
+	}
+	if item, err := DecodeItem(rest); err != nil || item.Id != a1.Id || item.Deliveries != 2 {
+		t.Fatal("expected a1 to be redelivered", item, err)
+	}
+	send <- []byte("ACK " + a1.Id + "\n")
+	if cmd, _ := DecodeCmd(<-recv); cmd != "ERROR" {
+		t.Fatal("a late ack should fail", cmd)
+	}
+	other <- []byte("ACK " + a1.Id + "\n")
+	if cmd, _ := DecodeCmd(<-orecv); cmd != "OK" {
+		t.Fatal("ack failed", cmd)
+	}
+	close(send)
+	for _ = range recv {
+	}
+}
+
+func TestRetry(t *testing.T) {
+	policy := RetryPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	for attempt, delay := range []time.Duration{0, 1, 2, 4, 5, 5} {
+		if attempt > 0 && policy.Delay(attempt) != delay*time.Second {
+			t.Fatal("bad delay for attempt", attempt, policy.Delay(attempt))
+		}
+	}
+	if (RetryPolicy{Backoff: time.Second}).Delay(100) <= 0 {
+		t.Fatal("an uncapped backoff shouldn't overflow")
+	}
+
+	server := NewServer(func() Queue { return queue.NewQueue(true) })
+	server.SetRetryPolicy("default", RetryPolicy{
+		MaxAttempts: 3, Backoff: 20 * time.Millisecond, FailureQueue: "failed",
+	})
+	send, recv := connect(server)
+	retry := func(item *queue.Item) {
+		msg := base64.StdEncoding.EncodeToString(item.Data)
+		if len(item.Headers) > 0 {
+			msg += " " + string(EncodeHeaders(item.Headers))
+		}
+		send <- []byte("RETRY " + msg + "\n")
+		if cmd, _ := DecodeCmd(<-recv); cmd != "OK" {
+			t.Fatal("retry failed", cmd)
+		}
+	}
+	deque := func() *queue.Item {
+		for i := 0; i < 100; i++ {
+			send <- []byte("DEQUE\n")
+			cmd, rest := DecodeCmd(<-recv)
+			if cmd == "ITEM" {
+				item, err := DecodeItem(rest)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return item
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("the retried item never came back")
+		return nil
+	}
+	send <- EncodeB64Message("ENQUE", []byte("job"))
+	<-recv
+	item := deque()
+	for attempt := 2; attempt <= 3; attempt++ {
+		retry(item)
+		if server.Retrying() != 1 {
+			t.Fatal("expected the item to be waiting out its backoff")
+		}
+		send <- []byte("SIZE\n")
+		if _, rest := DecodeCmd(<-recv); strings.TrimSpace(string(rest)) != "0" {
+			t.Fatal("the item came back before its backoff", string(rest))
+		}
+		item = deque()
+		if item.Headers[AttemptHeader] != strconv.Itoa(attempt) {
+			t.Fatal("bad attempt", attempt, item.Headers)
+		}
+	}
+	retry(item)
+	failed, _ := server.Lookup("failed")
+	if server.Retrying() != 0 || failed == nil || failed.Size() != 1 {
+		t.Fatal("expected the item to go to the failure queue")
+	}
+	if item, _ := failed.Deque(); string(item.Data) != "job" || item.Headers[AttemptHeader] != "3" {
+		t.Fatal("bad failed item", item)
+	}
+
+	// stopping the server drops the items waiting out their backoff
+	if _, err := server.Listen(0); err != nil {
+		t.Fatal(err)
+	}
+	server.SetRetryPolicy("default", RetryPolicy{Backoff: time.Minute})
+	retry(&queue.Item{Data: []byte("stopped")})
+	if server.Retrying() != 1 {
+		t.Fatal("expected the item to be waiting out its backoff")
+	}
+	if err := server.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if server.Retrying() != 0 {
+		t.Fatal("expected Stop to drop the waiting item")
+	}
+	server.SetRetryPolicy("default", RetryPolicy{Backoff: 10 * time.Millisecond})
+	send <- EncodeB64Message("RETRY", []byte("late"))
+	if cmd, _ := DecodeCmd(<-recv); cmd != "OK" {
+		t.Fatal("retry failed", cmd)
+	}
+	time.Sleep(50 * time.Millisecond)
+	send <- []byte("SIZE\n")
+	if _, rest := DecodeCmd(<-recv); strings.TrimSpace(string(rest)) != "0" {
+		t.Fatal("a retry was enqueued after the server stopped", string(rest))
+	}
+	close(send)
+	for _ = range recv {
+	}
+}
+
+func TestTempQueues(t *testing.T) {
+	server := NewServer(func() Queue { return queue.NewQueue(true) })
+	server.Declare("jobs", func() Queue { return queue.NewQueue(true) })
+	gone := func(name string) bool {
+		for i := 0; i < 100; i++ {
+			if _, has := server.Lookup(name); !has {
+				return true
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		return false
+	}
+	owner, orecv := connect(server)
+	other, recv := connect(server)
+	call := func(send chan<- []byte, recv <-chan []byte, line string) (string, string) {
+		send <- []byte(line + "\n")
+		cmd, rest := DecodeCmd(<-recv)
+		return cmd, strings.TrimSpace(string(rest))
+	}
+	cmd, name := call(owner, orecv, "NEWQUEUE exclusive")
+	if cmd != "QUEUE" || !strings.HasPrefix(name, "tmp.") {
+		t.Fatal("expected a new queue", cmd, name)
+	}
+	if cmd, _ := call(other, recv, "USE "+name); cmd != "OK" {
+		t.Fatal("anyone may use an exclusive queue", cmd)
+	}
+	if cmd, _ := call(other, recv, "ENQUE "+base64.StdEncoding.EncodeToString([]byte("reply"))); cmd != "OK" {
+		t.Fatal("anyone may enque onto an exclusive queue", cmd)
+	}
+	if cmd, _ := call(other, recv, "DEQUE"); cmd != "ERROR" {
+		t.Fatal("only the owner may deque from an exclusive queue", cmd)
+	}
+	if cmd, _ := call(other, recv, "MOVE "+name+" default"); cmd != "ERROR" {
+		t.Fatal("only the owner may move from an exclusive queue", cmd)
+	}
+	if cmd, _ := call(other, recv, "USE "+name+" exclusive"); cmd != "ERROR" {
+		t.Fatal("expected an error for an existing queue", cmd)
+	}
+	call(owner, orecv, "USE "+name)
+	if cmd, _ := call(owner, orecv, "DEQUE"); cmd != "ITEM" {
+		t.Fatal("the owner should get the reply", cmd)
+	}
+	close(owner)
+	for _ = range orecv {
+	}
+	if !gone(name) {
+		t.Fatal("expected the exclusive queue to be removed with its connection")
+	}
+
+	if cmd, _ := call(other, recv, "USE jobs exclusive"); cmd != "ERROR" {
+		t.Fatal("declared queues can't be temporary", cmd)
+	}
+	if cmd, _ := call(other, recv, "USE scratch idle=nope"); cmd != "ERROR" {
+		t.Fatal("expected an error for a bad idle timeout", cmd)
+	}
+	if cmd, _ := call(other, recv, "USE scratch idle=0.05"); cmd != "OK" {
+		t.Fatal("could not make an idle queue", cmd)
+	}
+	for i := 0; i < 5; i++ {
+		// using the queue keeps it around
+		time.Sleep(20 * time.Millisecond)
+		call(other, recv, "SIZE")
+	}
+	if _, has := server.Lookup("scratch"); !has {
+		t.Fatal("a queue in use shouldn't be removed")
+	}
+	if !gone("scratch") {
+		t.Fatal("expected the idle queue to be removed")
+	}
+
+	// an expired temporary queue isn't brought back by using it
+	cmd, name = call(other, recv, "NEWQUEUE idle=0.05")
+	if cmd != "QUEUE" {
+		t.Fatal("expected a new queue", cmd, name)
+	}
+	call(other, recv, "USE "+name)
+	if !gone(name) {
+		t.Fatal("expected the idle queue to be removed")
+	}
+	if cmd, _ := call(other, recv, "ENQUE "+base64.StdEncoding.EncodeToString([]byte("late reply"))); cmd != "ERROR" {
+		t.Fatal("expected an error enqueing onto an expired queue", cmd)
+	}
+	if cmd, _ := call(other, recv, "USE "+name); cmd != "ERROR" {
+		t.Fatal("expected an error using an expired queue", cmd)
+	}
+	call(other, recv, "USE default")
+	call(other, recv, "ENQUE "+base64.StdEncoding.EncodeToString([]byte("reply")))
+	if cmd, _ := call(other, recv, "MOVE default "+name); cmd != "ERROR" {
+		t.Fatal("expected an error moving onto an expired queue", cmd)
+	}
+	if cmd, size := call(other, recv, "SIZE"); cmd != "SIZE" || size != "1" {
+		t.Fatal("a failed MOVE should leave the item where it was", cmd, size)
+	}
+	if _, has := server.Lookup(name); has {
+		t.Fatal("the expired queue was made again")
+	}
+	server.rates.lock.Lock()
+	_, limited := server.rates.queues[name]
+	server.rates.lock.Unlock()
+	if limited {
+		t.Fatal("the refused commands left a rate limit for the expired queue")
+	}
+	if cmd, _ := call(other, recv, "USE "+name+" idle=1"); cmd != "OK" {
+		t.Fatal("USE with options may make the queue again", cmd)
+	}
+	close(other)
+	for _ = range recv {
+	}
+}
+
+func TestBothEnds(t *testing.T) {
+	server := NewServer(func() Queue {
+		return NewBoundedQueue(queue.NewQueue(true), 3, 0)
+	})
+	server.Declare("grouped", func() Queue { return queue.NewGroupQueue(true) })
+	send, recv := connect(server)
+	call := func(cmd string, data string) (string, string) {
+		if data != "" {
+			send <- EncodeB64Message(cmd, []byte(data))
+		} else {
+			send <- EncodePlainMessage(cmd, nil)
+		}
+		cmd, rest := DecodeCmd(<-recv)
+		if cmd != "ITEM" {
+			return cmd, ""
+		}
+		item, err := DecodeItem(rest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cmd, string(item.Data)
+	}
+	call("ENQUE", "a")
+	call("ENQUE", "b")
+	if cmd, _ := call("ENQUEFRONT", "urgent"); cmd != "OK" {
+		t.Fatal("enquefront failed", cmd)
+	}
+	if cmd, _ := call("ENQUEFRONT", "full"); cmd != "ERROR" {
+		t.Fatal("expected the max size to apply", cmd)
+	}
+	if _, data := call("DEQUEBACK", ""); data != "b" {
+		t.Fatal("expected the newest item", data)
+	}
+	if _, data := call("DEQUE", ""); data != "urgent" {
+		t.Fatal("expected the urgent item", data)
+	}
+	if _, data := call("DEQUEBACK", ""); data != "a" {
+		t.Fatal("expected the last item", data)
+	}
+	if cmd, _ := call("DEQUEBACK", ""); cmd != "ERROR" {
+		t.Fatal("expected an empty queue", cmd)
+	}
+	send <- []byte("USE grouped\n")
+	<-recv
+	if cmd, _ := call("ENQUEFRONT", "x"); cmd != "ERROR" {
+		t.Fatal("a group queue can't be used from the front", cmd)
+	}
+	close(send)
+	for _ = range recv {
+	}
+}
+
+/* A connection which WATCHes the named queue and then never reads. */
+func stalledWatcher(server *Server, name string) net.Conn {
+	client, con := net.Pipe()
+	go server.Connection(con).Serve()
+	client.Write([]byte("WATCH " + name + "\n"))
+	return client
+}
+
+func TestStalledWatcher(t *testing.T) {
+	server := NewServer(func() Queue { return queue.NewQueue(true) })
+	server.SetWatchDebounce(time.Millisecond)
+	stalled := stalledWatcher(server, "jobs")
+	defer stalled.Close()
+	watcher, events := connect(server)
+	watcher <- []byte("WATCH jobs\n")
+	<-events
+	send, recv := connect(server)
+	send <- []byte("USE jobs\n")
+	<-recv
+	for i := 0; i < 2*watchBacklog; i++ {
+		send <- EncodeB64Message("ENQUE", []byte(fmt.Sprint(i)))
+		<-recv
+	}
+	for {
+		select {
+		case line := <-events:
+			cmd, rest := DecodeCmd(line)
+			ev, err := DecodeEvent(rest)
+			if cmd != "EVENT" || err != nil {
+				t.Fatal("bad event", string(line), err)
+			}
+			if ev.Size < 2*watchBacklog {
+				continue
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("a stalled watcher held up the other watcher's events")
+		}
+		break
+	}
+	close(watcher)
+	close(send)
+	for _ = range events {
+	}
+	for _ = range recv {
+	}
+}
+
+func TestWatch(t *testing.T) {
+	server := NewServer(func() Queue { return queue.NewQueue(true) })
+	server.SetWatchDebounce(10 * time.Millisecond)
+	watcher, events := connect(server)
+	send, recv := connect(server)
+	next := func() (string, string, Event) {
+		select {
+		case line := <-events:
+			tag, line, err := DecodeTag(line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cmd, rest := DecodeCmd(line)
+			if cmd != "EVENT" {
+				return string(tag), cmd, Event{}
+			}
+			ev, err := DecodeEvent(rest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return string(tag), cmd, ev
+		case <-time.After(time.Second):
+			t.Fatal("no event")
+		}
+		return "", "", Event{}
+	}
+	until := func(kind string) []Event {
+		var seen []Event
+		for {
+			tag, _, ev := next()
+			if tag != "#w" {
+				t.Fatal("expected the events to be tagged", tag)
+			}
+			seen = append(seen, ev)
+			if ev.Kind == kind {
+				return seen
+			}
+		}
+	}
+	watcher <- []byte("#w WATCH jobs 3\n")
+	if tag, cmd, ev := next(); tag != "#w" || cmd != "EVENT" || ev != (Event{Queue: "jobs", Kind: "size"}) {
+		t.Fatal("expected the current size", tag, cmd, ev)
+	}
+	send <- []byte("USE jobs\n")
+	<-recv
+	for _, data := range []string{"a", "b", "c"} {
+		send <- EncodeB64Message("ENQUE", []byte(data))
+		<-recv
+	}
+	seen := until("above")
+	if seen[1].Kind != "nonempty" || seen[len(seen)-1].Size != 3 {
+		t.Fatal("bad events", seen)
+	}
+	for i := 0; i < 3; i++ {
+		send <- []byte("DEQUE\n")
+		<-recv
+	}
+	seen = until("below")
+	if kinds := fmt.Sprint(seen); !strings.Contains(kinds, "empty") {
+		t.Fatal("expected an empty event", seen)
+	}
+	watcher <- []byte("UNWATCH jobs\n")
+	if _, cmd, _ := next(); cmd != "OK" {
+		t.Fatal("expected an OK", cmd)
+	}
+	send <- EncodeB64Message("ENQUE", []byte("d"))
+	<-recv
+	select {
+	case line := <-events:
+		t.Fatal("expected no events after UNWATCH", string(line))
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(watcher)
+	for _ = range events {
+	}
+	close(send)
+	for _ = range recv {
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	server := NewServer(func() Queue {
+		return NewBoundedQueue(queue.NewQueue(true), 0, 50*time.Millisecond)
+	})
+	server.SetWatchDebounce(10 * time.Millisecond)
+	received := make(chan webhookEvent, 100)
+	var lock sync.Mutex
+	calls := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		calls++
+		first := calls == 1
+		lock.Unlock()
+		if first {
+			http.Error(w, "try again", http.StatusInternalServerError)
+			return
+		}
+		var ev webhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Error(err)
+		}
+		received <- ev
+	}))
+	defer receiver.Close()
+	hook := Webhook{
+		URL:       receiver.URL,
+		Queues:    []string{"jobs"},
+		Events:    []string{"enqueued", "above", "below", "expired"},
+		Threshold: 2,
+		Backoff:   10 * time.Millisecond,
+	}
+	if err := server.SetWebhooks([]Webhook{hook}); err != nil {
+		t.Fatal(err)
+	}
+	defer server.SetWebhooks(nil)
+	until := func(kind string) []webhookEvent {
+		var seen []webhookEvent
+		for {
+			select {
+			case ev := <-received:
+				if ev.Queue != "jobs" || ev.Time.IsZero() {
+					t.Fatal("bad event", ev)
+				}
+				seen = append(seen, ev)
+				if ev.Event == kind {
+					return seen
+				}
+			case <-time.After(time.Second):
+				t.Fatal("no", kind, "event", seen)
+			}
+		}
+	}
+	send, recv := connect(server)
+	send <- []byte("USE jobs\n")
+	<-recv
+	for _, data := range []string{"a", "b"} {
+		send <- EncodeB64Message("ENQUE", []byte(data))
+		<-recv
+	}
+	seen := until("above")
+	enqueued := 0
+	for _, ev := range seen {
+		if ev.Event == "enqueued" {
+			enqueued += ev.Count
+		}
+	}
+	if enqueued != 2 || seen[len(seen)-1].Size != 2 {
+		t.Fatal("expected two enqueued items then an above event", seen)
+	}
+	lock.Lock()
+	if calls < 2 {
+		t.Fatal("expected the failed delivery to be retried", calls)
+	}
+	lock.Unlock()
+
+	time.Sleep(100 * time.Millisecond)
+	send <- []byte("DEQUE\n")
+	<-recv
+	seen = until("below")
+	if seen[0].Event != "expired" || seen[0].Count != 2 || seen[0].Size != 0 {
+		t.Fatal("expected the items to expire", seen)
+	}
+	close(send)
+	for _ = range recv {
+	}
+
+	bad := []Webhook{
+		{URL: "localhost", Queues: []string{"jobs"}, Events: []string{"enqueued"}},
+		{URL: receiver.URL, Events: []string{"enqueued"}},
+		{URL: receiver.URL, Queues: []string{"jobs"}, Events: []string{"deleted"}},
+		{URL: receiver.URL, Queues: []string{"jobs"}, Events: []string{"above"}},
+	}
+	for _, hook := range bad {
+		if err := server.SetWebhooks([]Webhook{hook}); err == nil {
+			t.Fatal("expected an error for", hook)
+		}
+	}
+}
+
+func TestWebhookWithStalledWatcher(t *testing.T) {
+	server := NewServer(func() Queue { return queue.NewQueue(true) })
+	server.SetWatchDebounce(time.Millisecond)
+	received := make(chan webhookEvent, 2*watchBacklog)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev webhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Error(err)
+		}
+		received <- ev
+	}))
+	defer receiver.Close()
+	stalled := stalledWatcher(server, "jobs")
+	defer stalled.Close()
+	hook := Webhook{URL: receiver.URL, Queues: []string{"jobs"}, Events: []string{"enqueued"}}
+	if err := server.SetWebhooks([]Webhook{hook}); err != nil {
+		t.Fatal(err)
+	}
+	defer server.SetWebhooks(nil)
+	send, recv := connect(server)
+	send <- []byte("USE jobs\n")
+	<-recv
+	for i := 0; i < 2*watchBacklog; i++ {
+		send <- EncodeB64Message("ENQUE", []byte(fmt.Sprint(i)))
+		<-recv
+	}
+	for enqueued := 0; enqueued < 2*watchBacklog; {
+		select {
+		case ev := <-received:
+			enqueued += ev.Count
+		case <-time.After(5 * time.Second):
+			t.Fatal("a stalled watcher held up the webhook, enqueued", enqueued)
+		}
+	}
+	close(send)
+	for _ = range recv {
+	}
+}
+
+func TestWebhookEnqueuedWithinDebounce(t *testing.T) {
+	server := NewServer(func() Queue { return queue.NewQueue(true) })
+	server.SetWatchDebounce(100 * time.Millisecond)
+	received := make(chan webhookEvent, 100)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev webhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Error(err)
+		}
+		received <- ev
+	}))
+	defer receiver.Close()
+	hook := Webhook{URL: receiver.URL, Queues: []string{"jobs"}, Events: []string{"enqueued"}}
+	if err := server.SetWebhooks([]Webhook{hook}); err != nil {
+		t.Fatal(err)
+	}
+	defer server.SetWebhooks(nil)
+	send, recv := connect(server)
+	send <- []byte("USE jobs\n")
+	<-recv
+	next := func() webhookEvent {
+		select {
+		case ev := <-received:
+			return ev
+		case <-time.After(time.Second):
+			t.Fatal("no event")
+		}
+		return webhookEvent{}
+	}
+	call := func(line string) {
+		send <- []byte(line + "\n")
+		<-recv
+	}
+	call("ENQUE YQ==")
+	if ev := next(); ev.Event != "enqueued" || ev.Count != 1 || ev.Size != 1 {
+		t.Fatal("bad event", ev)
+	}
+	// within the next debounce interval an item comes and goes, so the queue's
+	// size is the same when it is checked again
+	call("ENQUE Yg==")
+	call("DEQUE")
+	if ev := next(); ev.Event != "enqueued" || ev.Count != 1 || ev.Size != 1 {
+		t.Fatal("bad event", ev)
+	}
+	close(send)
+	for _ = range recv {
+	}
+}
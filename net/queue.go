@@ -32,16 +32,119 @@ package net
  * POSSIBILITY OF SUCH DAMAGE.
  */
 
+import (
+	"fmt"
+)
+
+import (
+	"github.com/timtadh/queued/queue"
+)
+
 /*
 The network interface for the Queue is pluggable for different Queue
 implementations. All implementations must conform to the following interface but
 other than that they are free to do whatever they want. For instance you could
-have a persistent queue or a distributed queue or something else.  */
+have a persistent queue or a distributed queue or something else. Items are
+passed around as *queue.Item so an implementation must keep each item's
+metadata (Id, enqueue time, headers) along with its data. The queuetest package
+checks that an implementation does what the server expects.  */
 type Queue interface {
-	Enque(data []byte) error
-	Deque() (data []byte, err error)
+	Enque(item *queue.Item) error
+	Deque() (item *queue.Item, err error)
 	Empty() bool
 	Has(hash []byte) bool
 	Size() int
 }
 
+/*
+A Queue which can say what it is holding (see queue.Stats). The STATS command
+uses it. Queues which don't implement it only report their size.  */
+type StatsQueue interface {
+	Queue
+	Stats() queue.Stats
+}
+
+func QueueStats(q Queue) queue.Stats {
+	if s, ok := q.(StatsQueue); ok {
+		return s.Stats()
+	}
+	return queue.Stats{Items: q.Size()}
+}
+
+/*
+A Queue which can be used from both ends (see queue.Queue): items can be put
+on its front and taken off its back. ENQUEFRONT and DEQUEBACK (and RPUSH and
+LPOP over RESP) use it.  */
+type DoubleEndedQueue interface {
+	Queue
+	EnqueFront(item *queue.Item) error
+	DequeBack() (item *queue.Item, err error)
+}
+
+/* q as a DoubleEndedQueue or an error if it doesn't support both ends. */
+func doubleEnded(q Queue) (DoubleEndedQueue, error) {
+	if d, ok := q.(DoubleEndedQueue); ok {
+		return d, nil
+	}
+	return nil, fmt.Errorf("not supported by this queue")
+}
+
+/*
+A Queue which can say when it drops an item because a copy of its data is
+already on it (see queue.NewQueue). EnqueUnique returns the Id of that copy
+for a dropped item and "" for an enqueued one. ENQUE answers a dropped item
+with DUPLICATE and MOVE leaves it where it was.  */
+type UniqueQueue interface {
+	Queue
+	EnqueUnique(item *queue.Item) (dup string, err error)
+}
+
+/* EnqueFront, reporting a dropped duplicate as UniqueQueue does. */
+type uniqueFront interface {
+	EnqueFrontUnique(item *queue.Item) (dup string, err error)
+}
+
+/*
+Enque the item on the back (or front) of q. Returns the Id of the copy already
+on q if q dropped it as a duplicate. Queues which aren't UniqueQueues never
+report one.  */
+func enqueUnique(q Queue, item *queue.Item, front bool) (string, error) {
+	if front {
+		if u, ok := q.(uniqueFront); ok {
+			return u.EnqueFrontUnique(item)
+		}
+		d, err := doubleEnded(q)
+		if err != nil {
+			return "", err
+		}
+		return "", d.EnqueFront(item)
+	}
+	if u, ok := q.(UniqueQueue); ok {
+		return u.EnqueUnique(item)
+	}
+	return "", q.Enque(item)
+}
+
+/*
+A Queue which holds each dequeued item's message group until the item is acked
+or released (see queue.GroupQueue). A connection holds the items it dequeues
+until the client ACKs them; those it hasn't acked when it closes are released.  */
+type GroupQueue interface {
+	Queue
+	Ack(id string) error
+	Release(id string) error
+}
+
+/* The GroupQueue q is (or wraps, see BoundedQueue.Unwrap), if there is one. */
+func groupQueue(q Queue) (GroupQueue, bool) {
+	for {
+		if g, ok := q.(GroupQueue); ok {
+			return g, true
+		}
+		u, ok := q.(interface{ Unwrap() Queue })
+		if !ok {
+			return nil, false
+		}
+		q = u.Unwrap()
+	}
+}
@@ -0,0 +1,312 @@
+/*
+Package queuetest checks that a net.Queue implementation behaves the way the
+server expects, so a new backend (persistent, distributed or otherwise) can
+prove it is a drop in replacement for queue.Queue. Run it from the backend's
+own tests:
+
+    func TestConformance(t *testing.T) {
+        queuetest.Run(t, true, func(t *testing.T) net.Queue {
+            return mybackend.NewQueue(t.TempDir())
+        })
+    }
+
+It checks
+
+    - items come off the queue in the order they went on (FIFO)
+    - each item keeps its data, Id, enqueue time and headers
+    - dedupe, if the queue does it: an item whose data is already on the
+      queue is ignored (not an error) until that copy is dequeued
+    - Has, Size and Empty agree with what is on the queue
+    - Deque on an empty queue is an error
+    - many producers and consumers may use the queue at once. Run the tests
+      with -race to have the race detector check this too.
+*/
+package queuetest
+
+/* queued
+ * Author: Tim Henderson
+ * Email: tadh@case.edu
+ * Copyright 2013 All Right Reserved
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ *  * Neither the name of the queued nor the names of its contributors may be
+ *    used to endorse or promote products derived from this software without
+ *    specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/timtadh/queued/net"
+	"github.com/timtadh/queued/queue"
+)
+
+/*
+Run the conformance tests as subtests of t. create is called for a new,
+empty queue for each test. dedupe says whether the queues ignore items whose
+data is already on the queue (ie. queue.NewQueue(false)).  */
+func Run(t *testing.T, dedupe bool, create func(t *testing.T) net.Queue) {
+	t.Run("Empty", func(t *testing.T) { testEmpty(t, create(t)) })
+	t.Run("FIFO", func(t *testing.T) { testFIFO(t, create(t)) })
+	t.Run("Dedupe", func(t *testing.T) { testDedupe(t, create(t), dedupe) })
+	t.Run("Has", func(t *testing.T) { testHas(t, create(t), dedupe) })
+	t.Run("Size", func(t *testing.T) { testSize(t, create(t)) })
+	t.Run("Concurrent", func(t *testing.T) { testConcurrent(t, create(t)) })
+}
+
+/* How many items the tests which don't say put on a queue. */
+const items = 1000
+
+func enque(t *testing.T, q net.Queue, data string) *queue.Item {
+	item := queue.NewItem([]byte(data), nil)
+	if err := q.Enque(item); err != nil {
+		t.Fatalf("could not enque %q: %v", data, err)
+	}
+	return item
+}
+
+func deque(t *testing.T, q net.Queue, data string) *queue.Item {
+	item, err := q.Deque()
+	if err != nil {
+		t.Fatalf("could not deque %q: %v", data, err)
+	}
+	if item == nil {
+		t.Fatalf("expected to deque %q got nothing", data)
+	}
+	if string(item.Data) != data {
+		t.Fatalf("expected to deque %q got %q", data, item.Data)
+	}
+	return item
+}
+
+func checkSize(t *testing.T, q net.Queue, size int) {
+	if q.Size() != size {
+		t.Fatalf("expected size %v got %v", size, q.Size())
+	}
+	if q.Empty() != (size == 0) {
+		t.Fatalf("Empty() is %v with %v items", q.Empty(), size)
+	}
+}
+
+func testEmpty(t *testing.T, q net.Queue) {
+	checkSize(t, q, 0)
+	if item, err := q.Deque(); err == nil {
+		t.Fatal("expected an error dequeuing from a new queue", item)
+	}
+	enque(t, q, "a")
+	checkSize(t, q, 1)
+	deque(t, q, "a")
+	checkSize(t, q, 0)
+	if item, err := q.Deque(); err == nil {
+		t.Fatal("expected an error dequeuing from an emptied queue", item)
+	}
+	enque(t, q, "b")
+	deque(t, q, "b")
+}
+
+func testFIFO(t *testing.T, q net.Queue) {
+	sent := make([]*queue.Item, 0, items)
+	for i := 0; i < items; i++ {
+		headers := map[string]string{"n": fmt.Sprint(i)}
+		if i%2 == 0 {
+			headers = nil
+		}
+		item := queue.NewItem([]byte(fmt.Sprintf("item-%d", i)), headers)
+		if err := q.Enque(item); err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, item)
+	}
+	checkSize(t, q, items)
+	for i, want := range sent {
+		got := deque(t, q, string(want.Data))
+		if got.Id != want.Id || !got.Enqueued.Equal(want.Enqueued) {
+			t.Fatalf("item %v lost its metadata, sent %v got %v", i, want, got)
+		}
+		if len(got.Headers) != len(want.Headers) || got.Headers["n"] != want.Headers["n"] {
+			t.Fatalf("item %v lost its headers, sent %v got %v", i, want.Headers, got.Headers)
+		}
+		checkSize(t, q, items-i-1)
+	}
+}
+
+func testDedupe(t *testing.T, q net.Queue, dedupe bool) {
+	for _, data := range []string{"a", "b", "a", "c", "b"} {
+		enque(t, q, data)
+	}
+	want := []string{"a", "b", "a", "c", "b"}
+	if dedupe {
+		want = []string{"a", "b", "c"}
+	}
+	checkSize(t, q, len(want))
+	deque(t, q, want[0])
+	// the copy of a on the queue is gone so another is welcome
+	enque(t, q, "a")
+	for _, data := range append(want[1:], "a") {
+		deque(t, q, data)
+	}
+	checkSize(t, q, 0)
+}
+
+func testHas(t *testing.T, q net.Queue, dedupe bool) {
+	a, b := queue.Hash([]byte("a")), queue.Hash([]byte("b"))
+	if q.Has(a) {
+		t.Fatal("a new queue has a")
+	}
+	if q.Has(nil) || q.Has([]byte("a")) {
+		t.Fatal("expected a bad hash not to be found")
+	}
+	enque(t, q, "a")
+	enque(t, q, "a")
+	enque(t, q, "b")
+	if !q.Has(a) || !q.Has(b) {
+		t.Fatal("expected the queue to have a and b")
+	}
+	deque(t, q, "a")
+	if q.Has(a) == dedupe {
+		t.Fatal("Has(a) should be true only while a copy of a is on the queue")
+	}
+	if !dedupe {
+		deque(t, q, "a")
+		if q.Has(a) {
+			t.Fatal("expected a to be gone")
+		}
+	}
+	deque(t, q, "b")
+	if q.Has(b) {
+		t.Fatal("expected b to be gone")
+	}
+}
+
+func testSize(t *testing.T, q net.Queue) {
+	size := 0
+	next, first := 0, 0
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 3*round+1; i++ {
+			enque(t, q, fmt.Sprint(next))
+			next += 1
+			size += 1
+			checkSize(t, q, size)
+		}
+		for i := 0; i < 2*round; i++ {
+			deque(t, q, fmt.Sprint(first))
+			first += 1
+			size -= 1
+			checkSize(t, q, size)
+		}
+	}
+	for ; first < next; first++ {
+		deque(t, q, fmt.Sprint(first))
+	}
+	checkSize(t, q, 0)
+}
+
+/*
+Producers and consumers racing on the queue. Every item must be dequeued
+exactly once and each producer's items must come off in the order it put
+them on.  */
+func testConcurrent(t *testing.T, q net.Queue) {
+	const producers, consumers, each = 4, 4, 250
+	total := producers * each
+	var wg sync.WaitGroup
+	errs := make(chan error, producers+consumers)
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < each; i++ {
+				item := queue.NewItem([]byte(fmt.Sprintf("%d %d", p, i)), nil)
+				if err := q.Enque(item); err != nil {
+					errs <- err
+					return
+				}
+				q.Has(queue.Hash(item.Data))
+			}
+		}(p)
+	}
+	lock := new(sync.Mutex)
+	seen := make(map[string]bool, total)
+	deadline := time.Now().Add(30 * time.Second)
+	for c := 0; c < consumers; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			last := make([]int, producers)
+			for i := range last {
+				last[i] = -1
+			}
+			for time.Now().Before(deadline) {
+				lock.Lock()
+				done := len(seen) == total
+				lock.Unlock()
+				if done {
+					return
+				}
+				if q.Empty() {
+					runtime.Gosched()
+					continue
+				}
+				item, err := q.Deque()
+				if err != nil {
+					// another consumer got there first
+					runtime.Gosched()
+					continue
+				}
+				var p, i int
+				if _, err := fmt.Sscanf(string(item.Data), "%d %d", &p, &i); err != nil || p < 0 || p >= producers {
+					errs <- fmt.Errorf("dequeued an item which wasn't enqueued %q", item.Data)
+					return
+				}
+				if i <= last[p] {
+					errs <- fmt.Errorf("producer %v's item %v came off after its item %v", p, i, last[p])
+					return
+				}
+				last[p] = i
+				lock.Lock()
+				dup := seen[string(item.Data)]
+				seen[string(item.Data)] = true
+				lock.Unlock()
+				if dup {
+					errs <- fmt.Errorf("dequeued %q twice", item.Data)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if len(seen) != total {
+		t.Fatalf("dequeued %v of the %v items", len(seen), total)
+	}
+	checkSize(t, q, 0)
+}
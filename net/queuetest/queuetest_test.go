@@ -0,0 +1,74 @@
+package queuetest
+
+/* queued
+ * Author: Tim Henderson
+ * Email: tadh@case.edu
+ * Copyright 2013 All Right Reserved
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ *  * Neither the name of the queued nor the names of its contributors may be
+ *    used to endorse or promote products derived from this software without
+ *    specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+import "testing"
+
+import (
+	"time"
+)
+
+import (
+	"github.com/timtadh/queued/net"
+	"github.com/timtadh/queued/queue"
+)
+
+func TestQueue(t *testing.T) {
+	Run(t, false, func(t *testing.T) net.Queue { return queue.NewQueue(true) })
+}
+
+func TestDedupeQueue(t *testing.T) {
+	Run(t, true, func(t *testing.T) net.Queue { return queue.NewQueue(false) })
+}
+
+func TestSpillQueue(t *testing.T) {
+	Run(t, false, func(t *testing.T) net.Queue {
+		// a small limit so the tests spill to disk
+		q, err := queue.NewSpillQueue(t.TempDir(), "conformance", 1024, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { q.Close() })
+		return q
+	})
+}
+
+func TestGroupQueue(t *testing.T) {
+	Run(t, true, func(t *testing.T) net.Queue { return queue.NewGroupQueue(false) })
+}
+
+func TestBoundedQueue(t *testing.T) {
+	Run(t, false, func(t *testing.T) net.Queue {
+		return net.NewBoundedQueue(queue.NewQueue(true), 0, time.Hour)
+	})
+}
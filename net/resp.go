@@ -0,0 +1,709 @@
+package net
+
+/* queued
+ * Author: Tim Henderson
+ * Email: tadh@case.edu
+ * Copyright 2013 All Right Reserved
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ *  * Neither the name of the queued nor the names of its contributors may be
+ *    used to endorse or promote products derived from this software without
+ *    specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+/*
+A subset of the Redis (RESP) protocol. This lets clients which already have a
+Redis library use queued without a custom client. The named queues are exposed
+as Redis lists. The "left" end of a list is the tail of a queue and the
+"right" end is the head. This makes the usual Redis queue idiom (LPUSH +
+RPOP/BRPOP) a FIFO queue. RPUSH and LPOP use the other ends (see
+DoubleEndedQueue) and are only supported by queues which can be used from
+both ends. RPOP on a LIFO queue pops from the left.
+
+Supported commands:
+
+    PING [message]
+    LPUSH key value [value ...]
+    RPUSH key value [value ...]
+    RPOP key
+    LPOP key
+    BRPOP key [key ...] timeout
+    LLEN key
+    DEL key [key ...]
+    KEYS pattern
+
+In a cluster a command on a key owned by another node gets a -MOVED host:port
+error naming the owner (KEYS only lists the keys on this node). So does a push
+or pop of a replicated queue on a node which isn't its leader.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/timtadh/queued/queue"
+)
+
+const maxRESPBulkLen = 512 * 1024 * 1024
+const maxRESPArgs = 1024 * 1024
+
+/*
+The longest $<length> line of a bulk string. A length never needs more, and
+the limit stops a client making the server buffer an endless one.  */
+const maxRESPLengthLine = 32
+
+/*
+The most memory (and arguments) allocated for a command before its data
+arrives, so a client can't make the server allocate by just claiming a large
+length.  */
+const respPrealloc = 64 * 1024
+const respPreallocArgs = 1024
+
+/*
+Starts the RESP (Redis protocol) listener. Like Start this is a blocking call
+and it panics if the listener is already started or can't bind the port.  */
+func (self *Server) StartRESP(port int) {
+	if self.respLn != nil {
+		panic("RESP server already started")
+	}
+	ln, err := bind(port)
+	if err != nil {
+		panic(err)
+	}
+	self.respLn = ln
+	self.listenRESP()
+}
+
+/* Starts the RESP listener in the background, like Listen. */
+func (self *Server) ListenRESP(port int) (*net.TCPAddr, error) {
+	if self.respLn != nil {
+		return nil, fmt.Errorf("RESP server already started")
+	}
+	ln, err := bind(port)
+	if err != nil {
+		return nil, err
+	}
+	self.respLn = ln
+	go self.listenRESP()
+	return ln.Addr().(*net.TCPAddr), nil
+}
+
+func (self *Server) listenRESP() {
+	for {
+		con, ok := accept(self.respLn)
+		if !ok {
+			return
+		} else if !self.acquire() {
+			go reject(con, []byte("-ERR too many connections\r\n"), self.Limits().WriteTimeout)
+		} else {
+			go func() {
+				defer self.release()
+				self.ServeRESP(con)
+			}()
+		}
+	}
+}
+
+/* Get the named queue if it exists. Does not create the queue. */
+func (self *Server) Lookup(name string) (Queue, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	q, has := self.queues[name]
+	return q, has
+}
+
+/*
+Remove the named queue (and everything on it). Queues which are io.Closers
+(eg. a queue.SpillQueue) are closed.  */
+func (self *Server) remove(name string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.drop(name)
+}
+
+/* remove for a caller which holds the lock. */
+func (self *Server) drop(name string) bool {
+	q, has := self.queues[name]
+	delete(self.queues, name)
+	delete(self.temps, name)
+	self.changed(name)
+	self.rates.forget(name)
+	if c, ok := q.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Warn("could not close a removed queue", "queue", name, "err", err)
+		}
+	}
+	return has
+}
+
+/* The names of all the queues, sorted. */
+func (self *Server) Names() []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	names := make([]string, 0, len(self.queues))
+	for name := range self.queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+Serve a single RESP connection until the client hangs up. The connection is
+closed when this returns. If con has deadlines (eg. it is a net.Conn) the
+server's timeout Limits are enforced.  */
+func (self *Server) ServeRESP(con io.ReadWriteCloser) {
+	_, logger := connLogger(con, "resp")
+	logger.Info("new connection")
+	defer logger.Info("closed connection")
+	defer con.Close()
+	r := getReader(con)
+	defer putReader(r)
+	w := getWriter(con)
+	defer putWriter(w)
+	bk := newBucket()
+	limits := self.Limits()
+	dl, _ := con.(deadliner)
+	fail := func(err error) {
+		logger.Warn("bad command", "err", err)
+		writeRESPError(w, err.Error())
+		if dl != nil {
+			dl.SetWriteDeadline(deadline(limits.WriteTimeout))
+		}
+		w.Flush()
+	}
+	for {
+		if dl != nil {
+			dl.SetReadDeadline(deadline(limits.IdleTimeout))
+		}
+		if _, err := r.Peek(1); err == io.EOF {
+			return
+		} else if isTimeout(err) {
+			fail(fmt.Errorf("idle timeout"))
+			return
+		} else if err != nil {
+			logger.Error("read failed", "err", err)
+			return
+		}
+		if dl != nil {
+			dl.SetReadDeadline(deadline(limits.ReadTimeout))
+		}
+		args, err := readRESPCommand(r, limits)
+		if err == io.EOF {
+			return
+		} else if isTimeout(err) {
+			fail(fmt.Errorf("read timeout"))
+			return
+		} else if _, ok := err.(*lineError); ok {
+			fail(err)
+			continue
+		} else if err != nil {
+			fail(err)
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		self.throttle(bk)
+		if self.commandLogging() {
+			size := 0
+			for _, arg := range args[1:] {
+				size += len(arg)
+			}
+			key := ""
+			if len(args) > 1 {
+				key = string(args[1])
+			}
+			logger.Info("command", "cmd", strings.ToUpper(string(args[0])), "key", key, "bytes", size)
+		}
+		self.respond(&respConn{r: r, w: w, dl: dl, limits: limits}, args)
+		if dl != nil {
+			dl.SetWriteDeadline(deadline(limits.WriteTimeout))
+		}
+		if err := w.Flush(); err != nil {
+			logger.Error("write failed", "err", err)
+			return
+		}
+	}
+}
+
+/*
+The connection a RESP command came in on. Most commands just write their
+response to w; those which block (BRPOP) also watch for the client hanging up
+and flush their own response.  */
+type respConn struct {
+	r      *bufio.Reader
+	w      *bufio.Writer
+	dl     deadliner
+	limits Limits
+}
+
+/*
+Watch for the client hanging up while the connection isn't reading commands.
+gone is closed if it does. stop ends the watch, it must be called before the
+connection reads again. Connections without deadlines can't be watched.  */
+func (self *respConn) hangup() (gone <-chan struct{}, stop func()) {
+	closed := make(chan struct{})
+	if self.dl == nil {
+		return closed, func() {}
+	}
+	self.dl.SetReadDeadline(time.Time{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// data means another command is waiting, not a hang up
+		if _, err := self.r.Peek(1); err != nil && !isTimeout(err) {
+			close(closed)
+		}
+	}()
+	return closed, func() {
+		self.dl.SetReadDeadline(time.Now())
+		<-done
+	}
+}
+
+/* Flush the response, within the write timeout. */
+func (self *respConn) flush() error {
+	if self.dl != nil {
+		self.dl.SetWriteDeadline(deadline(self.limits.WriteTimeout))
+	}
+	return self.w.Flush()
+}
+
+func (self *Server) respond(c *respConn, args [][]byte) {
+	w := c.w
+	cmd := strings.ToUpper(string(args[0]))
+	args = args[1:]
+	arity := func(min int) bool {
+		if len(args) < min {
+			writeRESPError(w, fmt.Sprintf("wrong number of arguments for '%v' command", strings.ToLower(cmd)))
+			return false
+		}
+		return true
+	}
+	if moved := self.movedKey(cmd, args); moved != nil {
+		writeRESPErr(w, moved)
+		return
+	}
+	switch cmd {
+	case "PING":
+		if len(args) > 0 {
+			writeRESPBulk(w, args[0])
+		} else {
+			writeRESPSimple(w, "PONG")
+		}
+	case "LPUSH":
+		if arity(2) {
+			self.respPush(w, string(args[0]), args[1:])
+		}
+	case "RPUSH":
+		if arity(2) {
+			self.respPushFront(w, string(args[0]), args[1:])
+		}
+	case "RPOP":
+		if arity(1) {
+			self.respPop(w, string(args[0]))
+		}
+	case "LPOP":
+		if arity(1) {
+			self.respPopBack(w, string(args[0]))
+		}
+	case "BRPOP":
+		if arity(2) {
+			self.respBlockingPop(c, args)
+		}
+	case "LLEN":
+		if arity(1) {
+			size := 0
+			if q, has := self.Lookup(string(args[0])); has {
+				size = q.Size()
+			}
+			writeRESPInt(w, size)
+		}
+	case "DEL":
+		if arity(1) {
+			count := 0
+			for _, name := range args {
+				if self.remove(string(name)) {
+					count += 1
+				}
+			}
+			writeRESPInt(w, count)
+		}
+	case "KEYS":
+		if arity(1) {
+			self.respKeys(w, string(args[0]))
+		}
+	default:
+		writeRESPError(w, fmt.Sprintf("unknown command '%v'", cmd))
+	}
+}
+
+/* The first key of the command which is owned by another node, if any. */
+func (self *Server) movedKey(cmd string, args [][]byte) *MovedError {
+	var keys [][]byte
+	switch cmd {
+	case "LPUSH", "RPUSH", "RPOP", "LPOP", "LLEN":
+		if len(args) > 0 {
+			keys = args[:1]
+		}
+	case "BRPOP":
+		if len(args) > 0 {
+			keys = args[:len(args)-1]
+		}
+	case "DEL":
+		keys = args
+	}
+	for _, key := range keys {
+		if moved := self.moved(string(key)); moved != nil {
+			return moved
+		}
+	}
+	return nil
+}
+
+func (self *Server) respPush(w *bufio.Writer, name string, values [][]byte) {
+	q, err := self.queue(name)
+	if err != nil {
+		writeRESPErr(w, err)
+		return
+	}
+	self.push(w, name, q, false, values)
+}
+
+/* RPUSH, onto the head of the queue. */
+func (self *Server) respPushFront(w *bufio.Writer, name string, values [][]byte) {
+	q, err := self.queue(name)
+	if err != nil {
+		writeRESPErr(w, err)
+		return
+	}
+	if _, err := doubleEnded(q); err != nil {
+		writeRESPErr(w, err)
+		return
+	}
+	self.push(w, name, q, true, values)
+}
+
+func (self *Server) push(w *bufio.Writer, name string, q Queue, front bool, values [][]byte) {
+	n := 0
+	defer func() {
+		self.enqueued(name, n)
+		self.signal(name)
+	}()
+	for _, value := range values {
+		if err := self.rates.check(name, "ENQUE"); err != nil {
+			writeRESPErr(w, err)
+			return
+		}
+		dup, err := enqueUnique(q, queue.NewItem(value, nil), front)
+		if err != nil {
+			writeRESPErr(w, err)
+			return
+		} else if dup == "" {
+			n += 1
+		}
+	}
+	writeRESPInt(w, q.Size())
+}
+
+/* Pop the head (or, if back, the tail) of the named queue. */
+func (self *Server) pop(name string, back bool) (*queue.Item, error) {
+	item, q, err := self.take(name, back)
+	if item != nil {
+		done(q, item)
+	}
+	return item, err
+}
+
+/*
+Take the head (or tail) of the named queue, returning the queue it came from
+too. The item isn't done with (see done) until it has been delivered.  */
+func (self *Server) take(name string, back bool) (*queue.Item, Queue, error) {
+	if err := self.consumer(name, 0); err != nil {
+		return nil, nil, err
+	}
+	q, has := self.Lookup(name)
+	if !has {
+		return nil, nil, nil
+	}
+	if err := self.rates.check(name, "DEQUE"); err != nil {
+		return nil, nil, err
+	}
+	pop := q.Deque
+	if back {
+		d, err := doubleEnded(q)
+		if err != nil {
+			return nil, nil, err
+		}
+		pop = d.DequeBack
+	}
+	if q.Empty() {
+		return nil, nil, nil
+	}
+	item, err := pop()
+	self.changed(name)
+	if err != nil && q.Empty() {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	item.Deliveries += 1
+	return item, q, nil
+}
+
+/* RESP has no ACK, a delivered item is done with. */
+func done(q Queue, item *queue.Item) {
+	if g, ok := groupQueue(q); ok && item.Headers[queue.GroupHeader] != "" {
+		g.Ack(item.Id)
+	}
+}
+
+func (self *Server) respPop(w *bufio.Writer, name string) {
+	self.writePopped(w, name, false)
+}
+
+/* LPOP, from the tail of the queue. */
+func (self *Server) respPopBack(w *bufio.Writer, name string) {
+	self.writePopped(w, name, true)
+}
+
+func (self *Server) writePopped(w *bufio.Writer, name string, back bool) {
+	item, err := self.pop(name, back)
+	if err != nil {
+		writeRESPErr(w, err)
+	} else if item == nil {
+		writeRESPNilBulk(w)
+	} else {
+		writeRESPBulk(w, item.Data)
+	}
+}
+
+/*
+BRPOP: pop from the first of the named queues with an item, waiting up to the
+timeout for one. It gives up if the client hangs up while it waits, and puts
+the item back if it can't be written to the client.  */
+func (self *Server) respBlockingPop(c *respConn, args [][]byte) {
+	seconds, err := strconv.ParseFloat(string(args[len(args)-1]), 64)
+	if err != nil || seconds < 0 {
+		writeRESPError(c.w, "timeout is not a float or out of range")
+		return
+	}
+	names := make([]string, 0, len(args)-1)
+	for _, arg := range args[:len(args)-1] {
+		names = append(names, string(arg))
+	}
+	gone, stop := c.hangup()
+	defer stop()
+	cases := make([]reflect.SelectCase, len(names), len(names)+2)
+	cases = append(cases, reflect.SelectCase{
+		Dir:  reflect.SelectRecv,
+		Chan: reflect.ValueOf(gone),
+	})
+	if seconds > 0 {
+		timer := time.NewTimer(time.Duration(seconds * float64(time.Second)))
+		defer timer.Stop()
+		cases = append(cases, reflect.SelectCase{
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(timer.C),
+		})
+	}
+	for {
+		select {
+		case <-gone:
+			return
+		default:
+		}
+		for i, name := range names {
+			cases[i] = reflect.SelectCase{
+				Dir:  reflect.SelectRecv,
+				Chan: reflect.ValueOf(self.wait(name)),
+			}
+		}
+		for _, name := range names {
+			item, q, err := self.take(name, false)
+			if err != nil {
+				writeRESPErr(c.w, err)
+				return
+			} else if item != nil {
+				self.deliverPopped(c, name, q, item)
+				return
+			}
+		}
+		switch chosen, _, _ := reflect.Select(cases); chosen {
+		case len(names):
+			return
+		case len(names) + 1:
+			writeRESPNilArray(c.w)
+			return
+		}
+	}
+}
+
+/*
+Write a popped item to the client now, putting it back on q if that fails so
+it isn't lost with the connection.  */
+func (self *Server) deliverPopped(c *respConn, name string, q Queue, item *queue.Item) {
+	writeRESPArray(c.w, [][]byte{[]byte(name), item.Data})
+	if err := c.flush(); err != nil {
+		item.Deliveries -= 1
+		if err := restore(q, item); err != nil {
+			log.Error("could not restore an undelivered item", "queue", name, "id", item.Id, "err", err)
+		}
+		self.signal(name)
+		return
+	}
+	done(q, item)
+}
+
+func (self *Server) respKeys(w *bufio.Writer, pattern string) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		writeRESPError(w, err.Error())
+		return
+	}
+	keys := make([][]byte, 0)
+	for _, name := range self.Names() {
+		if ok, _ := path.Match(pattern, name); ok {
+			keys = append(keys, []byte(name))
+		}
+	}
+	writeRESPArray(w, keys)
+}
+
+/*
+Read one command. Commands are either an array of bulk strings (what every
+client library sends) or an inline command (what you type into telnet). If an
+argument is larger than limits.MaxItemSize the whole command is read and
+dropped and a (recoverable) *lineError is returned.  */
+func readRESPCommand(r *bufio.Reader, limits Limits) ([][]byte, error) {
+	line, err := readLine(r, limits.MaxLineLength, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return bytes.Fields(line), nil
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n < 0 || n > maxRESPArgs {
+		return nil, fmt.Errorf("Protocol error: invalid multibulk length")
+	}
+	args := make([][]byte, 0, min(n, respPreallocArgs))
+	var tooLarge error
+	for i := 0; i < n; i++ {
+		line, err := readLine(r, maxRESPLengthLine, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("Protocol error: expected '$', got '%v'", string(line))
+		}
+		length, err := strconv.Atoi(string(line[1:]))
+		if err != nil || length < 0 || length > maxRESPBulkLen {
+			return nil, fmt.Errorf("Protocol error: invalid bulk length")
+		}
+		if max := limits.MaxItemSize; max > 0 && length > max {
+			if _, err := io.CopyN(io.Discard, r, int64(length+2)); err != nil {
+				return nil, err
+			}
+			tooLarge = &lineError{msg: fmt.Sprintf("item too large (%v bytes, max %v)", length, max)}
+			continue
+		}
+		arg, err := readBulk(r, length)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	if tooLarge != nil {
+		return nil, tooLarge
+	}
+	return args, nil
+}
+
+/*
+Read a bulk string of length bytes (and the \r\n after it). The buffer grows
+as the data arrives rather than being allocated from the length up front.  */
+func readBulk(r io.Reader, length int) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, min(length+2, respPrealloc)))
+	if _, err := io.CopyN(buf, r, int64(length+2)); err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+	return buf.Bytes()[:length], nil
+}
+
+func writeRESPSimple(w *bufio.Writer, msg string) {
+	fmt.Fprintf(w, "+%v\r\n", msg)
+}
+
+func writeRESPError(w *bufio.Writer, msg string) {
+	msg = strings.Replace(strings.Replace(msg, "\r", " ", -1), "\n", " ", -1)
+	fmt.Fprintf(w, "-ERR %v\r\n", msg)
+}
+
+/* An error, as a -MOVED error if it sends the client to another node. */
+func writeRESPErr(w *bufio.Writer, err error) {
+	if r, is := err.(Redirect); is && r.Redirect() != "" {
+		fmt.Fprintf(w, "-MOVED %v\r\n", r.Redirect())
+	} else {
+		writeRESPError(w, err.Error())
+	}
+}
+
+func writeRESPInt(w *bufio.Writer, i int) {
+	fmt.Fprintf(w, ":%d\r\n", i)
+}
+
+func writeRESPBulk(w *bufio.Writer, data []byte) {
+	fmt.Fprintf(w, "$%d\r\n", len(data))
+	w.Write(data)
+	w.WriteString("\r\n")
+}
+
+func writeRESPNilBulk(w *bufio.Writer) {
+	w.WriteString("$-1\r\n")
+}
+
+func writeRESPArray(w *bufio.Writer, items [][]byte) {
+	fmt.Fprintf(w, "*%d\r\n", len(items))
+	for _, item := range items {
+		writeRESPBulk(w, item)
+	}
+}
+
+func writeRESPNilArray(w *bufio.Writer) {
+	w.WriteString("*-1\r\n")
+}
@@ -0,0 +1,276 @@
+package net
+
+/* queued
+ * Author: Tim Henderson
+ * Email: tadh@case.edu
+ * Copyright 2013 All Right Reserved
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ *  * Neither the name of the queued nor the names of its contributors may be
+ *    used to endorse or promote products derived from this software without
+ *    specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/timtadh/queued/queue"
+)
+
+/*
+The header RETRY counts an item's delivery attempts in. A missing (or
+unparsable) header means the item is on its first attempt.  */
+const AttemptHeader = "attempt"
+
+/*
+How a queue's items are retried (see RETRY). The first retry waits Backoff,
+and each one after that waits twice as long as the last, up to MaxBackoff
+(0 means no cap). Once an item has failed MaxAttempts times (0 means no
+limit) it is enqued on FailureQueue instead, or dropped if there is no failure
+queue.  */
+type RetryPolicy struct {
+	MaxAttempts  int
+	Backoff      time.Duration
+	MaxBackoff   time.Duration
+	FailureQueue string
+}
+
+/* How long to wait before the next attempt after the given attempt failed. */
+func (self RetryPolicy) Delay(attempt int) time.Duration {
+	d := self.Backoff
+	for i := 1; i < attempt && d > 0; i++ {
+		if (self.MaxBackoff > 0 && d >= self.MaxBackoff) || d > math.MaxInt64/2 {
+			break
+		}
+		d *= 2
+	}
+	if self.MaxBackoff > 0 && d > self.MaxBackoff {
+		return self.MaxBackoff
+	}
+	return d
+}
+
+/* Has an item which failed the given attempt run out of attempts? */
+func (self RetryPolicy) Exhausted(attempt int) bool {
+	return self.MaxAttempts > 0 && attempt >= self.MaxAttempts
+}
+
+/*
+The retry policies for a server, and the timers of the items waiting out
+their backoff. Queues without their own policy use the default one.
+Everything can be changed while the server runs.  */
+type retrier struct {
+	lock     *sync.Mutex
+	def      RetryPolicy
+	policies map[string]RetryPolicy
+	timers   map[*time.Timer]bool
+	stopped  bool
+}
+
+func newRetrier() *retrier {
+	return &retrier{
+		lock:     new(sync.Mutex),
+		policies: make(map[string]RetryPolicy),
+		timers:   make(map[*time.Timer]bool),
+	}
+}
+
+/*
+Call f after delay unless the retrier is stopped first. Returns false (and
+never calls f) if it is already stopped.  */
+func (self *retrier) after(delay time.Duration, f func()) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.stopped {
+		return false
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		self.lock.Lock()
+		pending := self.timers[timer]
+		delete(self.timers, timer)
+		self.lock.Unlock()
+		if pending {
+			f()
+		}
+	})
+	self.timers[timer] = true
+	return true
+}
+
+/* Stop every timer which hasn't fired. Returns how many there were. */
+func (self *retrier) stop() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.stopped = true
+	n := len(self.timers)
+	for timer := range self.timers {
+		timer.Stop()
+	}
+	self.timers = make(map[*time.Timer]bool)
+	return n
+}
+
+func (self *retrier) policy(name string) RetryPolicy {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if p, has := self.policies[name]; has {
+		return p
+	}
+	return self.def
+}
+
+/* Set the retry policy of every queue without its own policy. */
+func (self *Server) SetDefaultRetryPolicy(policy RetryPolicy) {
+	self.retries.lock.Lock()
+	defer self.retries.lock.Unlock()
+	self.retries.def = policy
+}
+
+/* Set the named queue's retry policy. */
+func (self *Server) SetRetryPolicy(name string, policy RetryPolicy) {
+	self.retries.lock.Lock()
+	defer self.retries.lock.Unlock()
+	self.retries.policies[name] = policy
+}
+
+/* Remove the named queue's own retry policy so it uses the default one. */
+func (self *Server) ClearRetryPolicy(name string) {
+	self.retries.lock.Lock()
+	defer self.retries.lock.Unlock()
+	delete(self.retries.policies, name)
+}
+
+/* The retry policy of the named queue. */
+func (self *Server) RetryPolicy(name string) RetryPolicy {
+	return self.retries.policy(name)
+}
+
+/* How many retried items are waiting out their backoff. */
+func (self *Server) Retrying() int {
+	self.retries.lock.Lock()
+	defer self.retries.lock.Unlock()
+	return len(self.retries.timers)
+}
+
+/* The attempt an item is on according to its headers. */
+func attempt(headers map[string]string) int {
+	n, err := strconv.Atoi(headers[AttemptHeader])
+	if err != nil || n < 1 {
+		return 1
+	}
+	return n
+}
+
+/*
+Retry an item which failed on the named queue. The item is given its next
+attempt number and enqued after the queue's backoff, or enqued on the failure
+queue if it is out of attempts. Returns the queue the item is going to
+(which is "" if it was dropped). Items waiting out their backoff are only in
+memory, so they are lost if the server stops (Stop drops them, and any item
+retried with a backoff after that).  */
+func (self *Server) retry(name string, item *queue.Item) (string, error) {
+	policy := self.RetryPolicy(name)
+	n := attempt(item.Headers)
+	if policy.Exhausted(n) {
+		if policy.FailureQueue == "" {
+			log.Warn("item out of attempts, dropped", "queue", name, "item", item.Id, "attempts", n)
+			return "", nil
+		}
+		if err := self.enque(policy.FailureQueue, item); err != nil {
+			return "", err
+		}
+		self.signal(policy.FailureQueue)
+		return policy.FailureQueue, nil
+	}
+	item.Headers[AttemptHeader] = strconv.Itoa(n + 1)
+	delay := policy.Delay(n)
+	if delay <= 0 {
+		if err := self.enque(name, item); err != nil {
+			return "", err
+		}
+		self.signal(name)
+		return name, nil
+	}
+	scheduled := self.retries.after(delay, func() {
+		if err := self.enque(name, item); err != nil {
+			log.Error("could not retry item, dropped", "queue", name, "item", item.Id, "err", err)
+			return
+		}
+		self.signal(name)
+	})
+	if !scheduled {
+		log.Warn("server stopped, item to retry dropped", "queue", name, "item", item.Id)
+		return "", nil
+	}
+	return name, nil
+}
+
+/* Enque item on the named queue, counting it for the queue's watches. */
+func (self *Server) enque(name string, item *queue.Item) error {
+	q, err := self.queue(name)
+	if err != nil {
+		return err
+	}
+	dup, err := enqueUnique(q, item, false)
+	if err != nil {
+		return err
+	} else if dup == "" {
+		self.enqueued(name, 1)
+	}
+	return nil
+}
+
+/*
+RETRY is ENQUE for an item which failed. The item keeps its attempt count in
+its attempt header.  */
+func (c *Connection) Retry(rest []byte) (string, []byte, error) {
+	if rest == nil {
+		return "", nil, fmt.Errorf("no data sent to queue")
+	}
+	data, headers, err := DecodeEnque(rest)
+	if err != nil {
+		return "", nil, err
+	}
+	if max := c.limits.MaxItemSize; max > 0 && len(data) > max {
+		return "", nil, fmt.Errorf("item too large (%v bytes, max %v)", len(data), max)
+	}
+	if _, err := c.queue(); err != nil {
+		return "", nil, err
+	}
+	if err := c.s.rates.check(c.queueName, "ENQUE"); err != nil {
+		return "", nil, err
+	}
+	item := queue.NewItem(data, headers)
+	if _, err := c.s.retry(c.queueName, item); err != nil {
+		return "", nil, err
+	}
+	return "OK", []byte(item.Id), nil
+}
@@ -0,0 +1,243 @@
+package net
+
+/* queued
+ * Author: Tim Henderson
+ * Email: tadh@case.edu
+ * Copyright 2013 All Right Reserved
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ *  * Neither the name of the queued nor the names of its contributors may be
+ *    used to endorse or promote products derived from this software without
+ *    specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/timtadh/queued/queue"
+)
+
+/*
+A temporary queue. It is removed when the connection it is exclusive to (if
+any) closes or when it hasn't been used for idle (if idle > 0), whichever
+comes first.  */
+type tempQueue struct {
+	owner uint64
+	idle  time.Duration
+	used  time.Time
+}
+
+/*
+The prefix of the names of temporary queues. A queue with such a name is only
+made by NEWQUEUE or USE with options, never just by using the name, so that
+using a temporary queue after it has been removed is an error rather than
+quietly making a new queue which is never removed.  */
+const tempPrefix = "tmp."
+
+/* How many names NEWQUEUE tries before giving up on finding a local one. */
+const maxTempNames = 100
+
+/*
+Decode the options of USE and NEWQUEUE:
+
+    exclusive       the queue belongs to the connection. It is removed when
+                    the connection closes and only the connection may DEQUE
+                    (or MOVE) from it
+    idle=SECONDS    the queue is removed once it hasn't been used for this
+                    long (a decimal number of seconds)
+*/
+func decodeTempOpts(fields [][]byte) (exclusive bool, idle time.Duration, err error) {
+	for _, field := range fields {
+		if string(field) == "exclusive" {
+			exclusive = true
+		} else if bytes.HasPrefix(field, []byte("idle=")) {
+			seconds, err := strconv.ParseFloat(string(field[len("idle="):]), 64)
+			if err != nil || seconds <= 0 {
+				return false, 0, fmt.Errorf("bad idle timeout '%v'", string(field))
+			}
+			idle = time.Duration(seconds * float64(time.Second))
+		} else {
+			return false, 0, fmt.Errorf("unknown queue option '%v'", string(field))
+		}
+	}
+	return exclusive, idle, nil
+}
+
+/*
+Create the named temporary queue, exclusive to the connection owner unless
+owner is 0. Using an existing temporary queue with the same owner and idle
+timeout is fine but any other existing queue is an error.  */
+func (self *Server) temp(name string, owner uint64, idle time.Duration) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if t, has := self.temps[name]; has {
+		if t.owner != owner || t.idle != idle {
+			return fmt.Errorf("queue '%v' already exists", name)
+		}
+		t.used = time.Now()
+		return nil
+	}
+	if _, has := self.queues[name]; has {
+		return fmt.Errorf("queue '%v' already exists", name)
+	}
+	if _, declared := self.creators[name]; declared {
+		return fmt.Errorf("queue '%v' is declared and can't be temporary", name)
+	}
+	t := &tempQueue{owner: owner, idle: idle, used: time.Now()}
+	self.queues[name] = self.create(name)
+	self.temps[name] = t
+	if idle > 0 {
+		self.expire(name, t, idle)
+	}
+	return nil
+}
+
+/* Remove the temporary queue after wait if it hasn't been used by then. */
+func (self *Server) expire(name string, t *tempQueue, wait time.Duration) {
+	time.AfterFunc(wait, func() {
+		self.lock.Lock()
+		defer self.lock.Unlock()
+		if self.temps[name] != t {
+			return
+		}
+		if idle := time.Since(t.used); idle < t.idle {
+			self.expire(name, t, t.idle-idle)
+			return
+		}
+		log.Info("removed idle queue", "queue", name, "idle", t.idle)
+		self.drop(name)
+	})
+}
+
+/*
+May the named queue be made just by using its name? The caller must hold the
+lock.  */
+func (self *Server) creatable(name string) error {
+	if _, declared := self.creators[name]; declared {
+		return nil
+	}
+	if strings.HasPrefix(name, tempPrefix) {
+		return fmt.Errorf("queue '%v' doesn't exist (temporary queues are only made by NEWQUEUE or USE with options)", name)
+	}
+	return nil
+}
+
+/* Mark the named queue as used. The caller must hold the lock. */
+func (self *Server) touch(name string) {
+	if t, has := self.temps[name]; has && t.idle > 0 {
+		t.used = time.Now()
+	}
+}
+
+/* Can the connection conn DEQUE from the named queue? */
+func (self *Server) consumer(name string, conn uint64) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if t, has := self.temps[name]; has && t.owner != 0 && t.owner != conn {
+		return fmt.Errorf("queue '%v' is exclusive to another connection", name)
+	}
+	return nil
+}
+
+/* Remove the queues which are exclusive to the connection conn. */
+func (self *Server) dropExclusive(conn uint64, names []string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, name := range names {
+		if t, has := self.temps[name]; has && t.owner == conn {
+			self.drop(name)
+		}
+	}
+}
+
+/*
+Create a temporary queue with a unique name, exclusive to the connection
+owner unless owner is 0. In a cluster the name is one this node owns.  */
+func (self *Server) newTemp(owner uint64, idle time.Duration) (string, error) {
+	for i := 0; i < maxTempNames; i++ {
+		name := tempPrefix + queue.NewId()
+		if _, local := self.Owner(name); !local {
+			continue
+		}
+		if err := self.temp(name, owner, idle); err != nil {
+			return "", err
+		}
+		return name, nil
+	}
+	return "", fmt.Errorf("could not find a name for the queue")
+}
+
+/* NEWQUEUE [exclusive] [idle=SECONDS] */
+func (c *Connection) NewQueue(rest []byte) (string, []byte, error) {
+	exclusive, idle, err := decodeTempOpts(bytes.Fields(rest))
+	if err != nil {
+		return "", nil, err
+	}
+	var owner uint64
+	if exclusive {
+		owner = c.id
+	}
+	name, err := c.s.newTemp(owner, idle)
+	if err != nil {
+		return "", nil, err
+	}
+	if exclusive {
+		c.owned = append(c.owned, name)
+	}
+	return "QUEUE", []byte(name), nil
+}
+
+/* USE name with options makes a temporary queue. See decodeTempOpts. */
+func (c *Connection) useTemp(name string, opts [][]byte) error {
+	exclusive, idle, err := decodeTempOpts(opts)
+	if err != nil {
+		return err
+	}
+	var owner uint64
+	if exclusive {
+		owner = c.id
+	}
+	if err := c.s.temp(name, owner, idle); err != nil {
+		return err
+	}
+	if exclusive && !contains(c.owned, name) {
+		c.owned = append(c.owned, name)
+	}
+	return nil
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,439 @@
+package net
+
+/* queued
+ * Author: Tim Henderson
+ * Email: tadh@case.edu
+ * Copyright 2013 All Right Reserved
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ *  * Neither the name of the queued nor the names of its contributors may be
+ *    used to endorse or promote products derived from this software without
+ *    specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+Something which happened to a queue (see WATCH). Kind is one of
+
+    size        the queue's size changed
+    empty       the queue became empty
+    nonempty    the queue stopped being empty
+    above       the queue's size reached the watch's threshold
+    below       the queue's size dropped back below the threshold
+    expired     items on the queue expired (see BoundedQueue), only for
+                watches which ask for it
+    enqueued    items were enqueued onto the queue, only for watches which
+                ask for it
+
+Size is the queue's size when the event was sent. Count is how many items
+expired for an expired event, or were enqueued for an enqueued event (even if
+they have already been dequeued again).  */
+type Event struct {
+	Queue string
+	Kind  string
+	Size  int
+	Count int
+}
+
+/* Encode the body of an EVENT message: NAME KIND SIZE. */
+func EncodeEvent(ev Event) []byte {
+	return []byte(fmt.Sprintf("%v %v %d", ev.Queue, ev.Kind, ev.Size))
+}
+
+/* Decode the body of an EVENT message encoded with EncodeEvent. */
+func DecodeEvent(rest []byte) (Event, error) {
+	fields := bytes.Fields(rest)
+	if len(fields) != 3 {
+		return Event{}, fmt.Errorf("bad event '%v'", string(bytes.TrimSpace(rest)))
+	}
+	size, err := strconv.Atoi(string(fields[2]))
+	if err != nil {
+		return Event{}, fmt.Errorf("bad event '%v'", string(bytes.TrimSpace(rest)))
+	}
+	return Event{Queue: string(fields[0]), Kind: string(fields[1]), Size: size}, nil
+}
+
+/* How long the server waits after a queue changes before checking it again. */
+const defaultDebounce = 50 * time.Millisecond
+
+/* How many events a watch holds while f is busy. More are dropped. */
+const watchBacklog = 256
+
+/*
+A watch on a queue. The check of its queue (holding lock) works out its events
+and queues them on events without blocking; the watch's own goroutine calls f
+with them (holding call), so a slow f only holds up its own watch. f is never
+called concurrently and never after the watch is stopped.  */
+type watch struct {
+	lock      *sync.Mutex
+	call      *sync.Mutex
+	threshold int
+	size      int
+	counts    bool
+	expired   int
+	enqueued  int
+	stopped   bool
+	events    chan Event
+	done      chan struct{}
+	f         func(Event)
+}
+
+/* Queue an event for f, dropping it if the watch is too far behind. */
+func (self *watch) send(ev Event) {
+	select {
+	case self.events <- ev:
+	default:
+		log.Warn("watcher too far behind, event dropped", "queue", ev.Queue, "event", ev.Kind)
+	}
+}
+
+/* Call f with the queued events until the watch is stopped. */
+func (self *watch) deliver() {
+	for {
+		select {
+		case ev := <-self.events:
+			self.call.Lock()
+			self.lock.Lock()
+			stopped := self.stopped
+			self.lock.Unlock()
+			if !stopped {
+				self.f(ev)
+			}
+			self.call.Unlock()
+		case <-self.done:
+			return
+		}
+	}
+}
+
+/*
+The events for the queue's size changing from the last one seen to size and
+its expired and enqueued counts changing to expired and enqueued.  */
+func (self *watch) update(name string, size, expired, enqueued int) []Event {
+	var events []Event
+	if self.counts && enqueued > self.enqueued {
+		events = append(events, Event{Queue: name, Kind: "enqueued", Size: size, Count: enqueued - self.enqueued})
+	}
+	if self.counts && expired > self.expired {
+		events = append(events, Event{Queue: name, Kind: "expired", Size: size, Count: expired - self.expired})
+	}
+	self.expired = expired
+	self.enqueued = enqueued
+	was := self.size
+	if size == was {
+		return events
+	}
+	self.size = size
+	events = append(events, Event{Queue: name, Kind: "size", Size: size})
+	if was == 0 {
+		events = append(events, Event{Queue: name, Kind: "nonempty", Size: size})
+	} else if size == 0 {
+		events = append(events, Event{Queue: name, Kind: "empty", Size: size})
+	}
+	if t := self.threshold; t > 0 && was < t && size >= t {
+		events = append(events, Event{Queue: name, Kind: "above", Size: size})
+	} else if t > 0 && was >= t && size < t {
+		events = append(events, Event{Queue: name, Kind: "below", Size: size})
+	}
+	return events
+}
+
+/*
+The watches on one queue. enqueued counts the items enqueued onto it since it
+was first watched.  */
+type watched struct {
+	watches  []*watch
+	pending  bool
+	dirty    bool
+	checked  time.Time
+	enqueued int
+}
+
+/*
+The watches of a server. When a watched queue changes it is checked (and
+events sent) at most once per debounce interval, so a busy queue doesn't flood
+its watchers.  */
+type hub struct {
+	lock     *sync.Mutex
+	debounce time.Duration
+	queues   map[string]*watched
+}
+
+func newHub() *hub {
+	return &hub{
+		lock:     new(sync.Mutex),
+		debounce: defaultDebounce,
+		queues:   make(map[string]*watched),
+	}
+}
+
+/*
+Set how often a watched queue which keeps changing is checked. Changes in
+between are rolled into one set of events.  */
+func (self *Server) SetWatchDebounce(d time.Duration) {
+	self.events.lock.Lock()
+	defer self.events.lock.Unlock()
+	self.events.debounce = d
+}
+
+/* The named queue's size, 0 if it doesn't exist. */
+func (self *Server) size(name string) int {
+	if q, has := self.Lookup(name); has {
+		return q.Size()
+	}
+	return 0
+}
+
+/* How many items have expired on the named queue. */
+func (self *Server) expired(name string) int {
+	if q, has := self.Lookup(name); has {
+		if bq, ok := q.(*BoundedQueue); ok {
+			return bq.Expired()
+		}
+	}
+	return 0
+}
+
+/*
+Watch the named queue. f is called with the events (see Event) for each
+change to the queue. threshold is the size at which above and below events
+are sent, 0 for none. Returns the queue's current size and a function which
+stops the watch; f isn't called once it returns. f is called from a goroutine
+of the watch's own, so a slow f doesn't hold up the queue's other watches, but
+events which arrive while it is more than 256 behind are dropped.  */
+func (self *Server) Watch(name string, threshold int, f func(Event)) (int, func()) {
+	return self.watch(name, threshold, false, f)
+}
+
+/*
+Watch, with expired and enqueued events if counts is set. These count the
+items which expired or were enqueued rather than following the queue's size,
+so they aren't missed when items come and go between checks.  */
+func (self *Server) watch(name string, threshold int, counts bool, f func(Event)) (int, func()) {
+	w := &watch{
+		lock:      new(sync.Mutex),
+		call:      new(sync.Mutex),
+		threshold: threshold,
+		counts:    counts,
+		events:    make(chan Event, watchBacklog),
+		done:      make(chan struct{}),
+		f:         f,
+	}
+	go w.deliver()
+	self.events.lock.Lock()
+	q, has := self.events.queues[name]
+	if !has {
+		q = new(watched)
+		self.events.queues[name] = q
+	}
+	q.watches = append(q.watches, w)
+	w.enqueued = q.enqueued
+	// the size is read after the watch is added so no change is missed
+	w.lock.Lock()
+	self.events.lock.Unlock()
+	w.size = self.size(name)
+	w.expired = self.expired(name)
+	size := w.size
+	w.lock.Unlock()
+	return size, func() { self.unwatch(name, w) }
+}
+
+func (self *Server) unwatch(name string, w *watch) {
+	w.lock.Lock()
+	stopped := w.stopped
+	w.stopped = true
+	w.lock.Unlock()
+	if stopped {
+		return
+	}
+	close(w.done)
+	// wait for a call of f which has already started
+	defer func() {
+		w.call.Lock()
+		w.call.Unlock()
+	}()
+	self.events.lock.Lock()
+	defer self.events.lock.Unlock()
+	q, has := self.events.queues[name]
+	if !has {
+		return
+	}
+	for i, x := range q.watches {
+		if x == w {
+			q.watches = append(q.watches[:i], q.watches[i+1:]...)
+			break
+		}
+	}
+	if len(q.watches) == 0 && !q.pending {
+		delete(self.events.queues, name)
+	}
+}
+
+/*
+Count n items enqueued onto the named queue if it is being watched. Call it
+before the signal (or changed) for the enqueue.  */
+func (self *Server) enqueued(name string, n int) {
+	if n <= 0 {
+		return
+	}
+	self.events.lock.Lock()
+	defer self.events.lock.Unlock()
+	if q, has := self.events.queues[name]; has {
+		q.enqueued += n
+	}
+}
+
+/* The named queue may have changed. Check it if it is being watched. */
+func (self *Server) changed(name string) {
+	self.events.lock.Lock()
+	defer self.events.lock.Unlock()
+	q, has := self.events.queues[name]
+	if !has {
+		return
+	} else if q.pending {
+		q.dirty = true
+		return
+	}
+	q.pending = true
+	self.schedule(name, q, self.events.debounce-time.Since(q.checked))
+}
+
+/* Check the watched queue after wait. The caller must hold the hub's lock. */
+func (self *Server) schedule(name string, q *watched, wait time.Duration) {
+	if wait < 0 {
+		wait = 0
+	}
+	time.AfterFunc(wait, func() {
+		self.check(name, q)
+	})
+}
+
+/* Send the events for the watched queue's current size. */
+func (self *Server) check(name string, q *watched) {
+	self.events.lock.Lock()
+	q.dirty = false
+	watches := append([]*watch(nil), q.watches...)
+	enqueued := q.enqueued
+	self.events.lock.Unlock()
+	size, expired := self.size(name), self.expired(name)
+	for _, w := range watches {
+		w.lock.Lock()
+		if !w.stopped {
+			for _, ev := range w.update(name, size, expired, enqueued) {
+				w.send(ev)
+			}
+		}
+		w.lock.Unlock()
+	}
+	self.events.lock.Lock()
+	defer self.events.lock.Unlock()
+	q.checked = time.Now()
+	if q.dirty {
+		self.schedule(name, q, self.events.debounce)
+		return
+	}
+	q.pending = false
+	if len(q.watches) == 0 {
+		delete(self.events.queues, name)
+	}
+}
+
+func decodeWatchArgs(rest []byte) (string, int, error) {
+	fields := bytes.Fields(rest)
+	if len(fields) < 1 || len(fields) > 2 {
+		return "", 0, fmt.Errorf("expected a queue name and an optional threshold")
+	}
+	threshold := 0
+	if len(fields) == 2 {
+		t, err := strconv.Atoi(string(fields[1]))
+		if err != nil || t < 1 {
+			return "", 0, fmt.Errorf("bad threshold '%v'", string(fields[1]))
+		}
+		threshold = t
+	}
+	return string(fields[0]), threshold, nil
+}
+
+/*
+WATCH name [threshold]. The response is a size EVENT with the queue's current
+size. The events which follow are written as they happen, with the WATCH's tag
+if it had one. Watching a queue again replaces the old watch.  */
+func (c *Connection) watch(tag []byte, rest []byte) {
+	name, threshold, err := decodeWatchArgs(rest)
+	if err != nil {
+		c.writeError(tag, err)
+		return
+	}
+	if moved := c.s.moved(name); moved != nil {
+		c.writeError(tag, moved)
+		return
+	}
+	if stop, has := c.watches[name]; has {
+		stop()
+	}
+	if tag != nil {
+		tag = append([]byte(nil), tag...)
+	}
+	send := func(ev Event) {
+		c.wlock.Lock()
+		defer c.wlock.Unlock()
+		c.writeTag(tag)
+		c.writeMessage("EVENT", EncodeEvent(ev), echoEncoder{})
+		if err := c.flush(); err != nil {
+			c.log.Error("write failed", "err", err)
+		}
+	}
+	// events wait for the response to be written
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	size, stop := c.s.Watch(name, threshold, send)
+	c.watches[name] = stop
+	c.writeTag(tag)
+	c.writeMessage("EVENT", EncodeEvent(Event{Queue: name, Kind: "size", Size: size}), echoEncoder{})
+}
+
+func (c *Connection) Unwatch(rest []byte) (string, []byte, error) {
+	name := string(bytes.TrimSpace(rest))
+	stop, has := c.watches[name]
+	if !has {
+		return "", nil, fmt.Errorf("not watching '%v'", name)
+	}
+	stop()
+	delete(c.watches, name)
+	return "OK", nil, nil
+}
+
+func (c *Connection) stopWatches() {
+	for name, stop := range c.watches {
+		stop()
+		delete(c.watches, name)
+	}
+}
@@ -0,0 +1,272 @@
+package net
+
+/* queued
+ * Author: Tim Henderson
+ * Email: tadh@case.edu
+ * Copyright 2013 All Right Reserved
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ *  * Neither the name of the queued nor the names of its contributors may be
+ *    used to endorse or promote products derived from this software without
+ *    specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+/*
+A Webhook POSTs events about its queues to URL so consumers (eg. serverless
+functions) can be triggered without holding a connection open. Events is
+which kinds of event it wants:
+
+    enqueued    items were enqueued. Like every event this is debounced (see
+                WATCH) so a burst of items is one event whose Count is how
+                many were enqueued (even if some were dequeued again before
+                the event was sent)
+    above       the queue's size reached Threshold
+    below       the queue's size dropped back below Threshold
+    expired     items expired (see BoundedQueue). Items expire as the server
+                notices them, when they reach the head of the queue, and
+                Count is how many did
+    size, empty and nonempty
+                as for WATCH
+
+Each event is sent as a JSON object
+
+    {"queue": "jobs", "event": "enqueued", "size": 12, "count": 3,
+     "time": "2013-06-01T12:00:00Z"}
+
+A delivery which fails (an error or a non 2xx response) is retried after
+Backoff (1s by default), doubling every time up to MaxBackoff, until
+MaxAttempts have been made (see RetryPolicy, 0 means keep trying). The events
+of a webhook are delivered one at a time in order. Timeout limits each
+request (10s by default).  */
+type Webhook struct {
+	URL         string
+	Queues      []string
+	Events      []string
+	Threshold   int
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+	Timeout     time.Duration
+}
+
+var webhookEvents = map[string]bool{
+	"enqueued": true, "above": true, "below": true, "expired": true,
+	"size": true, "empty": true, "nonempty": true,
+}
+
+/* How many events a webhook holds while it is delivering. More are dropped. */
+const webhookBacklog = 1024
+
+const defaultWebhookTimeout = 10 * time.Second
+const defaultWebhookBackoff = time.Second
+
+func (self *Webhook) Validate() error {
+	u, err := url.Parse(self.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("bad webhook url '%v'", self.URL)
+	}
+	if len(self.Queues) == 0 {
+		return fmt.Errorf("webhook %v has no queues", self.URL)
+	}
+	if len(self.Events) == 0 {
+		return fmt.Errorf("webhook %v has no events", self.URL)
+	}
+	for _, kind := range self.Events {
+		if !webhookEvents[kind] {
+			return fmt.Errorf("webhook %v has an unknown event '%v'", self.URL, kind)
+		}
+		if (kind == "above" || kind == "below") && self.Threshold <= 0 {
+			return fmt.Errorf("webhook %v needs a threshold for %v events", self.URL, kind)
+		}
+	}
+	if self.MaxAttempts < 0 || self.Backoff < 0 || self.MaxBackoff < 0 || self.Timeout < 0 {
+		return fmt.Errorf("webhook %v has a negative limit", self.URL)
+	}
+	return nil
+}
+
+func (self *Webhook) wants(kind string) bool {
+	for _, k := range self.Events {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+/* The JSON body of a webhook request. */
+type webhookEvent struct {
+	Queue string    `json:"queue"`
+	Event string    `json:"event"`
+	Size  int       `json:"size"`
+	Count int       `json:"count"`
+	Time  time.Time `json:"time"`
+}
+
+/* A running webhook. */
+type webhook struct {
+	Webhook
+	client *http.Client
+	events chan Event
+	done   chan struct{}
+	stops  []func()
+}
+
+/*
+Replace the server's webhooks. The old ones are stopped (events they haven't
+delivered yet are dropped).  */
+func (self *Server) SetWebhooks(hooks []Webhook) error {
+	for i := range hooks {
+		if err := hooks[i].Validate(); err != nil {
+			return err
+		}
+	}
+	started := make([]*webhook, 0, len(hooks))
+	for _, hook := range hooks {
+		started = append(started, self.startWebhook(hook))
+	}
+	self.lock.Lock()
+	old := self.webhooks
+	self.webhooks = started
+	self.lock.Unlock()
+	for _, w := range old {
+		w.stop()
+	}
+	return nil
+}
+
+func (self *Server) startWebhook(hook Webhook) *webhook {
+	timeout := hook.Timeout
+	if timeout == 0 {
+		timeout = defaultWebhookTimeout
+	}
+	w := &webhook{
+		Webhook: hook,
+		client:  &http.Client{Timeout: timeout},
+		events:  make(chan Event, webhookBacklog),
+		done:    make(chan struct{}),
+	}
+	threshold := 0
+	if hook.wants("above") || hook.wants("below") {
+		threshold = hook.Threshold
+	}
+	counts := hook.wants("enqueued") || hook.wants("expired")
+	for _, name := range hook.Queues {
+		_, stop := self.watch(name, threshold, counts, func(ev Event) {
+			if hook.wants(ev.Kind) {
+				w.send(ev)
+			}
+		})
+		w.stops = append(w.stops, stop)
+	}
+	go w.deliver()
+	return w
+}
+
+func (self *webhook) stop() {
+	for _, stop := range self.stops {
+		stop()
+	}
+	close(self.done)
+}
+
+/* Queue an event for delivery, dropping it if the backlog is full. */
+func (self *webhook) send(ev Event) {
+	select {
+	case self.events <- ev:
+	default:
+		log.Warn("webhook backlog full, event dropped", "url", self.URL, "queue", ev.Queue, "event", ev.Kind)
+	}
+}
+
+func (self *webhook) deliver() {
+	for {
+		select {
+		case ev := <-self.events:
+			self.post(ev)
+		case <-self.done:
+			return
+		}
+	}
+}
+
+/* POST the event, retrying with backoff. */
+func (self *webhook) post(ev Event) {
+	body, err := json.Marshal(webhookEvent{
+		Queue: ev.Queue,
+		Event: ev.Kind,
+		Size:  ev.Size,
+		Count: ev.Count,
+		Time:  time.Now().UTC(),
+	})
+	if err != nil {
+		log.Error("could not encode webhook event", "url", self.URL, "err", err)
+		return
+	}
+	policy := RetryPolicy{
+		MaxAttempts: self.MaxAttempts,
+		Backoff:     self.Backoff,
+		MaxBackoff:  self.MaxBackoff,
+	}
+	if policy.Backoff == 0 {
+		policy.Backoff = defaultWebhookBackoff
+	}
+	for attempt := 1; ; attempt++ {
+		err := self.try(body)
+		if err == nil {
+			return
+		}
+		if policy.Exhausted(attempt) {
+			log.Error("webhook failed, event dropped", "url", self.URL, "queue", ev.Queue, "event", ev.Kind, "attempts", attempt, "err", err)
+			return
+		}
+		log.Warn("webhook failed, retrying", "url", self.URL, "queue", ev.Queue, "event", ev.Kind, "attempt", attempt, "err", err)
+		select {
+		case <-time.After(policy.Delay(attempt)):
+		case <-self.done:
+			return
+		}
+	}
+}
+
+func (self *webhook) try(body []byte) error {
+	resp, err := self.client.Post(self.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%v", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,399 @@
+package net
+
+/* queued
+ * Author: Tim Henderson
+ * Email: tadh@case.edu
+ * Copyright 2013 All Right Reserved
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ *  * Neither the name of the queued nor the names of its contributors may be
+ *    used to endorse or promote products derived from this software without
+ *    specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+WebSockets (RFC 6455), implemented here with just the standard library. Each
+message a client sends is one command of the queued protocol (with or without
+its trailing newline) and each response comes back as one text message. The
+commands are handled by a Connection exactly as they are on the line protocol
+listener.  */
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+/* The largest message accepted when MaxLineLength isn't set. */
+const maxWSMessage = 64 * 1024 * 1024
+
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+/*
+Starts the WebSocket listener. Like Start this is a blocking call and it panics
+if the listener is already started or can't bind the port. Clients may connect
+with any path. To serve WebSockets from your own http server use
+WebSocketHandler instead.  */
+func (self *Server) StartWebSocket(port int) {
+	if self.wsLn != nil {
+		panic("WebSocket server already started")
+	}
+	ln, err := bind(port)
+	if err != nil {
+		panic(err)
+	}
+	self.wsLn = ln
+	self.serveWebSocket()
+}
+
+/* Starts the WebSocket listener in the background, like Listen. */
+func (self *Server) ListenWebSocket(port int) (*net.TCPAddr, error) {
+	if self.wsLn != nil {
+		return nil, fmt.Errorf("WebSocket server already started")
+	}
+	ln, err := bind(port)
+	if err != nil {
+		return nil, err
+	}
+	self.wsLn = ln
+	go self.serveWebSocket()
+	return ln.Addr().(*net.TCPAddr), nil
+}
+
+/*
+Serve WebSockets until the listener is closed. http.Server retries temporary
+accept errors itself, any other error is logged and stops the listener. The
+upgrade request must arrive within the ReadTimeout the server had when the
+listener started.  */
+func (self *Server) serveWebSocket() {
+	srv := &http.Server{
+		Handler:           self.WebSocketHandler(),
+		ReadHeaderTimeout: self.Limits().ReadTimeout,
+	}
+	if err := srv.Serve(self.wsLn); err != nil && err != http.ErrServerClosed && !isClosed(err) {
+		log.Error("websocket server failed, no longer accepting connections", "err", err)
+	}
+}
+
+func isClosed(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
+
+/* An http.Handler which upgrades requests to WebSockets and serves them. */
+func (self *Server) WebSocketHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !self.acquire() {
+			http.Error(w, "too many connections", http.StatusServiceUnavailable)
+			log.Warn("rejected connection", "reason", "too many connections", "remote", r.RemoteAddr)
+			return
+		}
+		defer self.release()
+		con, err := upgrade(w, r, self.Limits())
+		if err != nil {
+			log.Warn("websocket handshake failed", "remote", r.RemoteAddr, "err", err)
+			return
+		}
+		self.connection(con, "websocket").Serve()
+	})
+}
+
+func headerHas(h http.Header, key, value string) bool {
+	for _, v := range h.Values(key) {
+		for _, part := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/* Check the handshake, switch protocols and take over the connection. */
+func upgrade(w http.ResponseWriter, r *http.Request, limits Limits) (*wsConn, error) {
+	fail := func(status int, msg string) (*wsConn, error) {
+		http.Error(w, msg, status)
+		return nil, fmt.Errorf("%v", msg)
+	}
+	if r.Method != http.MethodGet {
+		return fail(http.StatusMethodNotAllowed, "websocket handshakes must be GETs")
+	}
+	if !headerHas(r.Header, "Connection", "upgrade") || !headerHas(r.Header, "Upgrade", "websocket") {
+		return fail(http.StatusBadRequest, "not a websocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return fail(http.StatusUpgradeRequired, "unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if k, err := base64.StdEncoding.DecodeString(key); err != nil || len(k) != 16 {
+		return fail(http.StatusBadRequest, "bad Sec-WebSocket-Key")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return fail(http.StatusInternalServerError, "can't take over the connection")
+	}
+	con, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum([]byte(key + wsGUID))
+	accept := base64.StdEncoding.EncodeToString(sum[:])
+	if limits.WriteTimeout > 0 {
+		con.SetWriteDeadline(deadline(limits.WriteTimeout))
+	}
+	_, err = fmt.Fprintf(con,
+		"HTTP/1.1 101 Switching Protocols\r\n"+
+			"Upgrade: websocket\r\n"+
+			"Connection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: %v\r\n\r\n", accept)
+	if err != nil {
+		con.Close()
+		return nil, err
+	}
+	max := limits.MaxLineLength
+	if max <= 0 {
+		max = maxWSMessage
+	}
+	return &wsConn{
+		Conn:  con,
+		r:     brw.Reader,
+		wlock: new(sync.Mutex),
+		max:   max,
+	}, nil
+}
+
+/*
+A WebSocket connection seen as a stream of lines. Read returns each message
+followed by a newline. Writes are gathered into lines and each line is sent as
+a text message.  */
+type wsConn struct {
+	net.Conn
+	r       *bufio.Reader
+	wlock   *sync.Mutex
+	max     int
+	pending []byte
+	message []byte
+	partial []byte
+	closed  bool
+}
+
+func (self *wsConn) Read(p []byte) (int, error) {
+	for len(self.pending) == 0 {
+		msg, err := self.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		msg = bytes.TrimRight(msg, "\r\n")
+		if bytes.IndexByte(msg, '\n') >= 0 {
+			self.writeClose(1007, "one command per message")
+			return 0, fmt.Errorf("websocket message with more than one line")
+		}
+		self.pending = append(msg, '\n')
+	}
+	n := copy(p, self.pending)
+	self.pending = self.pending[n:]
+	return n, nil
+}
+
+/* Read the next data message, answering any control frames on the way. */
+func (self *wsConn) readMessage() ([]byte, error) {
+	self.message = self.message[:0]
+	started := false
+	for {
+		fin, opcode, payload, err := self.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsPing:
+			if err := self.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+		case wsPong:
+		case wsClose:
+			self.writeClose(1000, "")
+			return nil, io.EOF
+		case wsText, wsBinary, wsContinuation:
+			if (opcode == wsContinuation) != started {
+				self.writeClose(1002, "bad fragment")
+				return nil, fmt.Errorf("websocket protocol error, bad fragment")
+			}
+			started = true
+			if len(self.message)+len(payload) > self.max {
+				self.writeClose(1009, "message too big")
+				return nil, fmt.Errorf("websocket message too big (max %v bytes)", self.max)
+			}
+			self.message = append(self.message, payload...)
+			if fin {
+				return self.message, nil
+			}
+		default:
+			self.writeClose(1002, "bad opcode")
+			return nil, fmt.Errorf("websocket protocol error, bad opcode %v", opcode)
+		}
+	}
+}
+
+func (self *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(self.r, head[:]); err != nil {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	opcode = head[0] & 0x0f
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(self.r, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(self.r, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if !masked {
+		self.writeClose(1002, "client frames must be masked")
+		return false, 0, nil, fmt.Errorf("websocket protocol error, unmasked frame")
+	}
+	if length > uint64(self.max) {
+		self.writeClose(1009, "message too big")
+		return false, 0, nil, fmt.Errorf("websocket frame too big (%v bytes, max %v)", length, self.max)
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(self.r, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(self.r, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+func (self *wsConn) writeFrame(opcode byte, payload []byte) error {
+	self.wlock.Lock()
+	defer self.wlock.Unlock()
+	if self.closed {
+		return fmt.Errorf("websocket closed")
+	}
+	return writeWSFrame(self.Conn, opcode, payload, nil)
+}
+
+/*
+Write a single (final) frame. Servers send their frames unmasked, clients
+must give a mask.  */
+func writeWSFrame(w io.Writer, opcode byte, payload []byte, mask []byte) error {
+	head := make([]byte, 2, 14)
+	head[0] = 0x80 | opcode
+	n := len(payload)
+	switch {
+	case n < 126:
+		head[1] = byte(n)
+	case n <= 0xffff:
+		head[1] = 126
+		head = binary.BigEndian.AppendUint16(head, uint16(n))
+	default:
+		head[1] = 127
+		head = binary.BigEndian.AppendUint64(head, uint64(n))
+	}
+	if mask != nil {
+		head[1] |= 0x80
+		head = append(head, mask...)
+		masked := make([]byte, n)
+		for i := range payload {
+			masked[i] = payload[i] ^ mask[i%4]
+		}
+		payload = masked
+	}
+	if _, err := w.Write(head); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+/* Send a close frame (once). */
+func (self *wsConn) writeClose(code uint16, reason string) {
+	self.wlock.Lock()
+	defer self.wlock.Unlock()
+	if self.closed {
+		return
+	}
+	self.closed = true
+	payload := binary.BigEndian.AppendUint16(nil, code)
+	payload = append(payload, reason...)
+	self.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	writeWSFrame(self.Conn, wsClose, payload, nil)
+}
+
+/* Send every complete line in p as a text message. */
+func (self *wsConn) Write(p []byte) (int, error) {
+	self.partial = append(self.partial, p...)
+	for {
+		i := bytes.IndexByte(self.partial, '\n')
+		if i < 0 {
+			break
+		}
+		if err := self.writeFrame(wsText, self.partial[:i]); err != nil {
+			return 0, err
+		}
+		self.partial = self.partial[i+1:]
+	}
+	if len(self.partial) == 0 {
+		self.partial = nil
+	}
+	return len(p), nil
+}
+
+func (self *wsConn) Close() error {
+	self.writeClose(1000, "")
+	return self.Conn.Close()
+}
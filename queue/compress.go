@@ -0,0 +1,160 @@
+package queue
+
+/* queued
+ * Author: Tim Henderson
+ * Email: tadh@case.edu
+ * Copyright 2013 All Right Reserved
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ *  * Neither the name of the queued nor the names of its contributors may be
+ *    used to endorse or promote products derived from this software without
+ *    specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+)
+
+/*
+What a queue is holding. Bytes counts item data as it is stored (compressed or
+not) and RawBytes the same data before compression so RawBytes/Bytes is the
+compression ratio.  */
+type Stats struct {
+	Items       int
+	Bytes       int64
+	RawBytes    int64
+	Compressed  int
+	MemoryBytes int64
+	DiskBytes   int64
+	Segments    int
+	Expired     int
+}
+
+/* The compression ratio, 1 if nothing is stored. */
+func (self Stats) Ratio() float64 {
+	if self.Bytes == 0 {
+		return 1
+	}
+	return float64(self.RawBytes) / float64(self.Bytes)
+}
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, err := flate.NewWriter(nil, flate.DefaultCompression)
+		if err != nil {
+			panic(err)
+		}
+		return w
+	},
+}
+
+var flateReaders = sync.Pool{
+	New: func() interface{} { return flate.NewReader(nil) },
+}
+
+/*
+A codec compresses items (of at least minSize bytes, 0 turns compression off)
+as they are stored on a queue and keeps the byte counts for Stats. The queue's
+lock must be held to use it. Each stored item is a copy of the enqueued item
+with its data compressed and compressed set, so changing minSize only effects
+items enqueued afterwards.  */
+type codec struct {
+	minSize    int
+	bytes      int64
+	rawBytes   int64
+	compressed int
+}
+
+/* The form of item to keep on the queue. */
+func (self *codec) pack(item *Item) *Item {
+	stored := item
+	if self.minSize > 0 && len(item.Data) >= self.minSize {
+		if data, ok := deflate(item.Data); ok {
+			copied := *item
+			copied.Data = data
+			copied.compressed = true
+			stored = &copied
+			self.compressed += 1
+		}
+	}
+	self.rawBytes += int64(len(item.Data))
+	self.bytes += int64(len(stored.Data))
+	return stored
+}
+
+/*
+The item as it was enqueued. The counts are left alone if it fails, so the
+stored item can stay on the queue.  */
+func (self *codec) unpack(stored *Item) (*Item, error) {
+	item := stored
+	if stored.compressed {
+		data, err := inflate(stored.Data)
+		if err != nil {
+			return nil, fmt.Errorf("could not decompress item %v: %v", stored.Id, err)
+		}
+		copied := *stored
+		copied.Data = data
+		copied.compressed = false
+		item = &copied
+		self.compressed -= 1
+	}
+	self.bytes -= int64(len(stored.Data))
+	self.rawBytes -= int64(len(item.Data))
+	return item, nil
+}
+
+func (self *codec) reset() {
+	self.bytes, self.rawBytes, self.compressed = 0, 0, 0
+}
+
+/* Compress data. Returns false if it didn't get any smaller. */
+func deflate(data []byte) ([]byte, bool) {
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, false
+	}
+	if err := w.Close(); err != nil {
+		return nil, false
+	}
+	if buf.Len() >= len(data) {
+		return nil, false
+	}
+	return append([]byte(nil), buf.Bytes()...), true
+}
+
+func inflate(data []byte) ([]byte, error) {
+	r := flateReaders.Get().(io.ReadCloser)
+	defer flateReaders.Put(r)
+	if err := r.(flate.Resetter).Reset(bytes.NewReader(data), nil); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
@@ -0,0 +1,266 @@
+package queue
+
+/* queued
+ * Author: Tim Henderson
+ * Email: tadh@case.edu
+ * Copyright 2013 All Right Reserved
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ *  * Neither the name of the queued nor the names of its contributors may be
+ *    used to endorse or promote products derived from this software without
+ *    specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+import (
+	"container/heap"
+	"fmt"
+	"sync"
+)
+
+/* The header which puts an item in a message group. */
+const GroupHeader = "group"
+
+/*
+A GroupQueue keeps the items of each message group (the items with the same
+group header) in FIFO order and hands out at most one item of a group at a
+time. A dequeued item holds its group until it is acked (the consumer is done
+with it) or released (it goes back to the head of its group to be delivered
+again). Deque returns the oldest item whose group isn't held, so different
+groups are worked on in parallel while each group is worked on in order. Items
+without a group are never held.  */
+type GroupQueue struct {
+	lock      *sync.Mutex
+	groups    map[string]*group
+	ready     groupHeap
+	held      map[string]*held
+	seq       uint64
+	length    int
+	index     index
+	codec     codec
+	allowDups bool
+}
+
+type sequenced struct {
+	item *Item
+	seq  uint64
+}
+
+/* A message group, or a single item without a group (name ""). */
+type group struct {
+	name  string
+	items []sequenced
+	pos   int
+	held  bool
+}
+
+type held struct {
+	group *group
+	item  *Item
+	seq   uint64
+}
+
+/* The groups which may be dequeued from, oldest head item first. */
+type groupHeap []*group
+
+func (self groupHeap) Len() int           { return len(self) }
+func (self groupHeap) Less(i, j int) bool { return self[i].items[0].seq < self[j].items[0].seq }
+func (self groupHeap) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+	self[i].pos = i
+	self[j].pos = j
+}
+
+func (self *groupHeap) Push(x interface{}) {
+	g := x.(*group)
+	g.pos = len(*self)
+	*self = append(*self, g)
+}
+
+func (self *groupHeap) Pop() interface{} {
+	old := *self
+	g := old[len(old)-1]
+	old[len(old)-1] = nil
+	*self = old[:len(old)-1]
+	g.pos = -1
+	return g
+}
+
+func NewGroupQueue(allowDups bool) *GroupQueue {
+	return &GroupQueue{
+		lock:      new(sync.Mutex),
+		groups:    make(map[string]*group),
+		held:      make(map[string]*held),
+		index:     make(index),
+		allowDups: allowDups,
+	}
+}
+
+func (self *GroupQueue) Enque(item *Item) error {
+	_, err := self.EnqueUnique(item)
+	return err
+}
+
+/* Enque, reporting a dropped duplicate as Queue.EnqueUnique does. */
+func (self *GroupQueue) EnqueUnique(item *Item) (string, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if dup, ok := self.index.add(item, self.allowDups); !ok {
+		return dup, nil
+	}
+	self.seq += 1
+	s := sequenced{item: self.codec.pack(item), seq: self.seq}
+	name := item.Headers[GroupHeader]
+	if name == "" {
+		heap.Push(&self.ready, &group{items: []sequenced{s}})
+	} else if g, has := self.groups[name]; has {
+		g.items = append(g.items, s)
+		if len(g.items) == 1 && !g.held {
+			heap.Push(&self.ready, g)
+		}
+	} else {
+		g := &group{name: name, items: []sequenced{s}}
+		self.groups[name] = g
+		heap.Push(&self.ready, g)
+	}
+	self.length += 1
+	return "", nil
+}
+
+/*
+Deque the oldest item whose group isn't held. The item holds its group until
+it is acked or released.  */
+func (self *GroupQueue) Deque() (*Item, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.ready.Len() == 0 {
+		return nil, fmt.Errorf("queue is empty")
+	}
+	g := heap.Pop(&self.ready).(*group)
+	s := g.items[0]
+	g.items[0] = sequenced{}
+	g.items = g.items[1:]
+	self.length -= 1
+	item, err := self.codec.unpack(s.item)
+	if err != nil {
+		return nil, err
+	}
+	if err := self.index.remove(item); err != nil {
+		return nil, err
+	}
+	if g.name != "" {
+		g.held = true
+		self.held[item.Id] = &held{group: g, item: item, seq: s.seq}
+	}
+	return item, nil
+}
+
+/* The consumer is done with the item, let the next item of its group go. */
+func (self *GroupQueue) Ack(id string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	h, has := self.held[id]
+	if !has {
+		return fmt.Errorf("item %v is not held", id)
+	}
+	delete(self.held, id)
+	self.unhold(h.group)
+	return nil
+}
+
+/*
+Put a held item back at the head of its group, to be delivered again. It keeps
+its place in the queue (and any change made to it, eg. to its delivery
+count).  */
+func (self *GroupQueue) Release(id string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	h, has := self.held[id]
+	if !has {
+		return fmt.Errorf("item %v is not held", id)
+	}
+	delete(self.held, id)
+	self.index.add(h.item, true)
+	s := sequenced{item: self.codec.pack(h.item), seq: h.seq}
+	h.group.items = append([]sequenced{s}, h.group.items...)
+	self.length += 1
+	self.unhold(h.group)
+	return nil
+}
+
+func (self *GroupQueue) unhold(g *group) {
+	g.held = false
+	if len(g.items) > 0 {
+		heap.Push(&self.ready, g)
+	} else if self.groups[g.name] == g {
+		delete(self.groups, g.name)
+	}
+}
+
+/* Whether the item is dequeued and not yet acked or released. */
+func (self *GroupQueue) Held(id string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	_, has := self.held[id]
+	return has
+}
+
+/*
+Empty is true when nothing can be dequeued: there may still be items waiting
+behind held ones.  */
+func (self *GroupQueue) Empty() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.ready.Len() == 0
+}
+
+/* How many items are waiting (not counting held ones). */
+func (self *GroupQueue) Size() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.length
+}
+
+func (self *GroupQueue) Has(hash []byte) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.index.has(hash)
+}
+
+func (self *GroupQueue) SetCompression(minSize int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.codec.minSize = minSize
+}
+
+func (self *GroupQueue) Stats() Stats {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return Stats{
+		Items:       self.length,
+		Bytes:       self.codec.bytes,
+		RawBytes:    self.codec.rawBytes,
+		Compressed:  self.codec.compressed,
+		MemoryBytes: self.codec.bytes,
+	}
+}
@@ -0,0 +1,88 @@
+package queue
+
+/* queued
+ * Author: Tim Henderson
+ * Email: tadh@case.edu
+ * Copyright 2013 All Right Reserved
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ *  * Neither the name of the queued nor the names of its contributors may be
+ *    used to endorse or promote products derived from this software without
+ *    specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+/*
+An Item is a single entry on a queue. Along with the data the producer
+supplied it carries a server assigned unique Id, the time it was enqueued, the
+number of times it has been delivered to a consumer and any headers the
+producer attached to it.  */
+type Item struct {
+	Id         string            `json:"id"`
+	Enqueued   time.Time         `json:"enqueued"`
+	Deliveries int               `json:"deliveries"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Data       []byte            `json:"data"`
+	compressed bool
+}
+
+/* Construct a new item with a fresh Id and an enqueue time of now. */
+func NewItem(data []byte, headers map[string]string) *Item {
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+	return &Item{
+		Id:       NewId(),
+		Enqueued: time.Now(),
+		Headers:  headers,
+		Data:     data,
+	}
+}
+
+/*
+A copy of the item which can be changed (its delivery count or headers)
+without changing the original. The data is shared, it is never changed in
+place.  */
+func (self *Item) Copy() *Item {
+	copied := *self
+	copied.Headers = make(map[string]string, len(self.Headers))
+	for k, v := range self.Headers {
+		copied.Headers[k] = v
+	}
+	return &copied
+}
+
+/* Generate a new random (128 bit) hex encoded message id. */
+func NewId() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
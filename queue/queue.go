@@ -1,6 +1,15 @@
 /*
-This implements a simple linked list Queue. Nothing complicated. The queue is
-thread safe and easy to use.
+This implements a simple Queue. Nothing complicated. The queue is thread safe
+and easy to use.
+
+Items are stored in fixed size chunks (arrays of item pointers) linked
+together, so the queue makes one allocation per chunkSize items rather than a
+list node per item, and emptied chunks are kept for reuse. The items are
+still the ones enqueued, each its own allocation, so the garbage collector
+still follows a pointer per item (and its data and headers). The dedupe index
+is a map from the sha256 of an item's data to how many copies of it are
+queued, which holds no pointers at all. Chunks are linked both ways so items
+can be added and removed at either end of the queue.
 */
 package queue
 
@@ -38,150 +47,295 @@ package queue
 
 import (
 	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	logpkg "log"
+	"log/slog"
 	"os"
 	"strings"
 	"sync"
 )
 
-import (
-	"github.com/timtadh/data-structures/hashtable"
-	"github.com/timtadh/data-structures/types"
-)
-
-var log *logpkg.Logger
+var log *slog.Logger
 
 func init() {
-	log = logpkg.New(os.Stderr, "queued/queue> ", logpkg.Ltime|logpkg.Lshortfile)
+	SetLogger(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+}
+
+/*
+Set the logger for this package. Every record gets a pkg=queued/queue
+attribute. Call this before using any queues.  */
+func SetLogger(logger *slog.Logger) {
+	log = logger.With("pkg", "queued/queue")
 }
 
 // Generate a sha256 hash of the data
 func Hash(data []byte) []byte {
 	h := sha256.Sum256(data)
-	return types.ByteSlice(h[:])
+	return h[:]
+}
+
+const chunkSize = 256
+
+/* How many empty chunks a queue keeps for reuse. */
+const spareChunks = 4
+
+/*
+The items of a chunk are items[lo:hi]. They are pointers to the enqueued
+items, not copies.  */
+type chunk struct {
+	items [chunkSize]*Item
+	lo    int
+	hi    int
+	next  *chunk
+	prev  *chunk
+}
+
+/*
+How many copies of each item (by the sha256 of its data) are on a queue, and
+the Id of the first copy (so a queue which doesn't allow duplicates can say
+which item a duplicate was dropped for). It holds no pointers so the garbage
+collector doesn't have to scan it.  */
+type index map[[sha256.Size]byte]entry
+
+type entry struct {
+	n     uint32
+	known bool
+	id    [16]byte
+}
+
+/*
+Count a copy of the item. Returns false (and doesn't count it) if it is a
+duplicate which isn't allowed, along with the Id of the copy already counted
+("" if it isn't a NewId).  */
+func (self index) add(item *Item, allowDups bool) (string, bool) {
+	h := sha256.Sum256(item.Data)
+	e := self[h]
+	if e.n > 0 && !allowDups {
+		if !e.known {
+			return "", false
+		}
+		return hex.EncodeToString(e.id[:]), false
+	}
+	if e.n == 0 {
+		id, err := hex.DecodeString(item.Id)
+		e.known = err == nil && len(id) == len(e.id)
+		copy(e.id[:], id)
+	}
+	e.n += 1
+	self[h] = e
+	return "", true
+}
+
+func (self index) remove(item *Item) error {
+	h := sha256.Sum256(item.Data)
+	e, has := self[h]
+	if !has {
+		return fmt.Errorf("integrity error, index did not have data")
+	}
+	if e.n <= 1 {
+		delete(self, h)
+	} else {
+		e.n -= 1
+		self[h] = e
+	}
+	return nil
 }
 
-type node struct {
-	next *node
-	data []byte
+func (self index) has(hash []byte) bool {
+	if len(hash) != sha256.Size {
+		return false
+	}
+	var h [sha256.Size]byte
+	copy(h[:], hash)
+	return self[h].n > 0
 }
 
 type Queue struct {
-	head   *node
-	tail   *node
-	length int
-	index  *hashtable.LinearHash
-	lock   *sync.Mutex
+	head      *chunk
+	tail      *chunk
+	spare     []*chunk
+	length    int
+	index     index
+	codec     codec
+	lock      *sync.Mutex
 	allowDups bool
+	lifo      bool
 }
 
 /* Construct a new queue */
 func NewQueue(allowDups bool) *Queue {
 	return &Queue{
-		head:   nil,
-		tail:   nil,
-		length: 0,
-		index: hashtable.NewLinearHash(),
-		lock:   new(sync.Mutex),
+		index:     make(index),
+		lock:      new(sync.Mutex),
 		allowDups: allowDups,
 	}
 }
 
-/* Put data on the queue */
-func (self *Queue) Enque(data []byte) error {
+/* A chunk to add to the queue, reused if there is a spare one. */
+func (self *Queue) newChunk() *chunk {
+	if n := len(self.spare); n > 0 {
+		c := self.spare[n-1]
+		self.spare = self.spare[:n-1]
+		return c
+	}
+	return new(chunk)
+}
+
+/* Unlink an empty chunk from the queue and keep it if there is room. */
+func (self *Queue) freeChunk(c *chunk) {
+	if c.prev != nil {
+		c.prev.next = c.next
+	} else {
+		self.head = c.next
+	}
+	if c.next != nil {
+		c.next.prev = c.prev
+	} else {
+		self.tail = c.prev
+	}
+	if len(self.spare) < spareChunks {
+		*c = chunk{}
+		self.spare = append(self.spare, c)
+	}
+}
+
+/* Put an item on the queue */
+func (self *Queue) Enque(item *Item) error {
+	_, err := self.EnqueUnique(item)
+	return err
+}
+
+/*
+Enque the item, returning the Id of the copy of its data already on the queue
+if it was dropped as a duplicate (see NewQueue) and "" if it was enqueued.  */
+func (self *Queue) EnqueUnique(item *Item) (string, error) {
 	self.lock.Lock()
 	defer self.lock.Unlock()
 
-	h := types.ByteSlice(Hash(data))
-	has := self.index.Has(h)
-	if !self.allowDups && has {
-		return nil
-	} else if has {
-		i, err := self.index.Get(h)
-		if err != nil {
-			return err
-		}
-		err = self.index.Put(h, types.Int(int(i.(types.Int)) + 1))
-		if err != nil {
-			return err
-		}
-	} else {
-		err := self.index.Put(h, types.Int(1))
-		if err != nil {
-			return err
+	if dup, ok := self.index.add(item, self.allowDups); !ok {
+		return dup, nil
+	}
+	if self.tail == nil || self.tail.hi == chunkSize {
+		c := self.newChunk()
+		c.prev = self.tail
+		if self.tail != nil {
+			self.tail.next = c
+		} else {
+			self.head = c
 		}
+		self.tail = c
 	}
+	self.tail.items[self.tail.hi] = self.codec.pack(item)
+	self.tail.hi += 1
+	self.length += 1
+	return "", nil
+}
 
-	node := &node{next: nil, data: data}
+/*
+Put an item on the front of the queue, so it is the next one dequeued (unless
+the queue is LIFO). Duplicates are handled as for Enque.  */
+func (self *Queue) EnqueFront(item *Item) error {
+	_, err := self.EnqueFrontUnique(item)
+	return err
+}
+
+/* EnqueFront, reporting a dropped duplicate as EnqueUnique does. */
+func (self *Queue) EnqueFrontUnique(item *Item) (string, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
 
-	if self.tail == nil {
+	if dup, ok := self.index.add(item, self.allowDups); !ok {
+		return dup, nil
+	}
+	if self.head == nil || self.head.lo == 0 {
+		c := self.newChunk()
+		c.lo, c.hi = chunkSize, chunkSize
+		c.next = self.head
 		if self.head != nil {
-			return fmt.Errorf("List has head but no tail...")
+			self.head.prev = c
+		} else {
+			self.tail = c
 		}
-		self.head = node
-		self.tail = node
-	} else {
-		self.tail.next = node
-		self.tail = node
+		self.head = c
 	}
+	self.head.lo -= 1
+	self.head.items[self.head.lo] = self.codec.pack(item)
 	self.length += 1
+	return "", nil
+}
 
-	return nil
+/*
+Read an item off the queue in FIFO order (or LIFO order if the queue is LIFO,
+see SetLIFO).  */
+func (self *Queue) Deque() (item *Item, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.pop(self.lifo)
+}
+
+/* Read the newest item (the one at the back) off the queue. */
+func (self *Queue) DequeBack() (item *Item, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.pop(true)
 }
 
-/* Read data off the queue in FIFO order */
-func (self *Queue) Deque() (data []byte, err error) {
+/*
+Make Deque take the newest item rather than the oldest, turning the queue into
+a stack. Items already on the queue stay where they are.  */
+func (self *Queue) SetLIFO(on bool) {
 	self.lock.Lock()
 	defer self.lock.Unlock()
+	self.lifo = on
+}
 
+/* Whether the queue is LIFO (see SetLIFO). */
+func (self *Queue) LIFO() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.lifo
+}
+
+/* Remove the item at the front (or back) of the queue. */
+func (self *Queue) pop(back bool) (item *Item, err error) {
 	if self.length == 0 {
 		return nil, fmt.Errorf("List is empty")
 	}
 	if self.length < 0 {
 		return nil, fmt.Errorf("List length is less than zero")
 	}
-	if self.head == nil {
-		return nil, fmt.Errorf("head is nil")
+	c := self.head
+	if back {
+		c = self.tail
 	}
-
-	node := self.head
-
-	if node.next == nil {
-		if node != self.tail {
-			return nil, fmt.Errorf("Expected tail to equal head")
-		}
-		if self.length != 1 {
-			return nil, fmt.Errorf("Expected list length to equal 1")
-		}
-		self.tail = nil
+	if c == nil || c.lo >= c.hi {
+		return nil, fmt.Errorf("end chunk is empty")
 	}
-	self.head = node.next
-	self.length -= 1
 
-	h := types.ByteSlice(Hash(node.data))
-	if self.index.Has(h) {
-		i, err := self.index.Get(h)
-		if err != nil {
-			return nil, err
-		}
-		j := int(i.(types.Int)) - 1
-		if j <= 0 {
-			_, err = self.index.Remove(h)
-			if err != nil {
-				return nil, err
-			}
-		} else {
-			err = self.index.Put(h, types.Int(j))
-			if err != nil {
-				return nil, err
-			}
-		}
+	stored := c.items[c.lo]
+	if back {
+		stored = c.items[c.hi-1]
+	}
+	item, err = self.codec.unpack(stored)
+	if err != nil {
+		return nil, err
+	}
+	if back {
+		c.hi -= 1
+		c.items[c.hi] = nil
 	} else {
-		return nil, fmt.Errorf("integrity error, index did not have data")
+		c.items[c.lo] = nil
+		c.lo += 1
+	}
+	if c.lo == c.hi {
+		self.freeChunk(c)
 	}
+	self.length -= 1
 
-	return node.data, nil
+	if err := self.index.remove(item); err != nil {
+		return nil, err
+	}
+	return item, nil
 }
 
 /* Check to see if it empty */
@@ -199,14 +353,32 @@ func (self *Queue) Size() int {
 }
 
 func (self *Queue) Has(hash []byte) bool {
-	if len(hash) != sha256.Size {
-		return false
-	}
-	return self.index.Has(types.ByteSlice(hash))
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.index.has(hash)
+}
+
+/*
+Compress the data of items of at least minSize bytes (with flate) while they
+are on the queue. A minSize of 0 turns compression off. Items on the queue
+are left as they are. Hashes (for HAS and dedupe) are always of the original
+data.  */
+func (self *Queue) SetCompression(minSize int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.codec.minSize = minSize
 }
 
-func (self *node) String() string {
-	return fmt.Sprintf("<node: '%s'>", string(self.data))
+func (self *Queue) Stats() Stats {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return Stats{
+		Items:       self.length,
+		Bytes:       self.codec.bytes,
+		RawBytes:    self.codec.rawBytes,
+		Compressed:  self.codec.compressed,
+		MemoryBytes: self.codec.bytes,
+	}
 }
 
 func (self *Queue) String() string {
@@ -214,13 +386,14 @@ func (self *Queue) String() string {
 	defer self.lock.Unlock()
 
 	var strs []string
-	strs = append(strs, "<queue: ")
 	for c := self.head; c != nil; c = c.next {
-		strs = append(strs, c.String())
-		if c.next != nil {
-			strs = append(strs, ", ")
+		for _, item := range c.items[c.lo:c.hi] {
+			data := item.Data
+			if item.compressed {
+				data, _ = inflate(data)
+			}
+			strs = append(strs, fmt.Sprintf("<item: '%s'>", string(data)))
 		}
 	}
-	strs = append(strs, ">")
-	return strings.Join(strs, "")
+	return "<queue: " + strings.Join(strs, ", ") + ">"
 }
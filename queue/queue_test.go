@@ -37,8 +37,12 @@ import "testing"
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"math/rand"
 	"os"
+	"runtime"
+	"strconv"
+	"time"
 )
 
 func init() {
@@ -46,17 +50,16 @@ func init() {
 }
 
 func rand_bytes(length int) []byte {
-	if urandom, err := os.Open("/dev/urandom"); err != nil {
-		log.Fatal(err)
-	} else {
-		slice := make([]byte, length)
-		if _, err := urandom.Read(slice); err != nil {
-			log.Fatal(err)
-		}
-		urandom.Close()
-		return slice
+	urandom, err := os.Open("/dev/urandom")
+	if err != nil {
+		panic(err)
+	}
+	defer urandom.Close()
+	slice := make([]byte, length)
+	if _, err := urandom.Read(slice); err != nil {
+		panic(err)
 	}
-	panic("unreachable")
+	return slice
 }
 
 func TestEnqueThenDeque(t *testing.T) {
@@ -65,7 +68,7 @@ func TestEnqueThenDeque(t *testing.T) {
 	for i := 0; i < rand.Intn(25)+10; i++ {
 		item := rand_bytes(rand.Intn(32) + 2)
 		l = append(l, item)
-		if err := q.Enque(item); err != nil {
+		if err := q.Enque(NewItem(item, nil)); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -77,7 +80,7 @@ func TestEnqueThenDeque(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		if !bytes.Equal(q_item, item) {
+		if !bytes.Equal(q_item.Data, item) {
 			t.Fatal("items should have equalled each other")
 		}
 	}
@@ -95,3 +98,438 @@ func TestEnqueThenDeque(t *testing.T) {
 		t.Fatal("queue should have been empty.")
 	}
 }
+
+func TestChunks(t *testing.T) {
+	q := NewQueue(false)
+	items := benchItems(3*chunkSize + 7)
+	next := 0
+	for i, item := range items {
+		if err := q.Enque(item); err != nil {
+			t.Fatal(err)
+		}
+		if i%3 == 0 {
+			got, err := q.Deque()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != items[next] {
+				t.Fatal("items out of order at", next)
+			}
+			next += 1
+		}
+	}
+	if q.Size() != len(items)-next {
+		t.Fatal("wrong size", q.Size(), len(items)-next)
+	}
+	for ; next < len(items); next++ {
+		got, err := q.Deque()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != items[next] {
+			t.Fatal("items out of order at", next)
+		}
+	}
+	if !q.Empty() || q.head != nil || q.tail != nil {
+		t.Fatal("expected every chunk to be freed")
+	}
+	if len(q.spare) == 0 || len(q.spare) > spareChunks {
+		t.Fatal("expected some chunks to be kept for reuse", len(q.spare))
+	}
+	if len(q.index) != 0 {
+		t.Fatal("expected an empty index", len(q.index))
+	}
+}
+
+func TestBothEnds(t *testing.T) {
+	q := NewQueue(false)
+	items := benchItems(2*chunkSize + 5)
+	// front: items[n-1] ... items[0], then back: items[0] ... items[n-1]
+	for _, item := range items {
+		if err := q.EnqueFront(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Enque(items[0]); err != nil {
+		t.Fatal(err)
+	}
+	if q.Size() != len(items) {
+		t.Fatal("expected the duplicate to be dropped", q.Size())
+	}
+	for i := len(items) - 1; i >= 0; i-- {
+		got, err := q.Deque()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != items[i] {
+			t.Fatal("items out of order at", i)
+		}
+	}
+	for _, item := range items {
+		q.Enque(item)
+	}
+	for i := len(items) - 1; i >= 0; i-- {
+		got, err := q.DequeBack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != items[i] {
+			t.Fatal("items out of order at", i)
+		}
+	}
+	if !q.Empty() || q.head != nil || q.tail != nil || len(q.index) != 0 {
+		t.Fatal("expected an empty queue")
+	}
+	if _, err := q.DequeBack(); err == nil {
+		t.Fatal("expected an error from an empty queue")
+	}
+
+	q.SetLIFO(true)
+	for _, item := range items[:3] {
+		q.Enque(item)
+	}
+	q.EnqueFront(items[3])
+	for _, i := range []int{2, 1, 0, 3} {
+		if got, _ := q.Deque(); got != items[i] {
+			t.Fatal("expected LIFO order", i)
+		}
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	q := NewQueue(false)
+	q.Enque(NewItem([]byte("a"), nil))
+	q.Enque(NewItem([]byte("a"), nil))
+	if q.Size() != 1 {
+		t.Fatal("expected the duplicate to be dropped", q.Size())
+	}
+	if !q.Has(Hash([]byte("a"))) || q.Has(Hash([]byte("b"))) {
+		t.Fatal("bad Has")
+	}
+	q.Deque()
+	if q.Has(Hash([]byte("a"))) {
+		t.Fatal("expected a to be gone")
+	}
+	first := NewItem([]byte("b"), nil)
+	if dup, err := q.EnqueUnique(first); err != nil || dup != "" {
+		t.Fatal("expected b to be enqueued", dup, err)
+	}
+	if dup, err := q.EnqueFrontUnique(NewItem([]byte("b"), nil)); err != nil || dup != first.Id {
+		t.Fatal("expected the id of the first b", dup, err)
+	}
+	dups := NewQueue(true)
+	if dup, _ := dups.EnqueUnique(NewItem([]byte("a"), nil)); dup != "" {
+		t.Fatal("expected a queue which allows duplicates to keep them")
+	}
+	dups.Enque(NewItem([]byte("a"), nil))
+	dups.Deque()
+	if dups.Size() != 1 || !dups.Has(Hash([]byte("a"))) {
+		t.Fatal("expected the second copy to still be queued")
+	}
+}
+
+func TestSpillQueue(t *testing.T) {
+	dir := t.TempDir()
+	q, err := NewSpillQueue(dir, "jobs/1", 1024, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := make([][]byte, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		item := rand_bytes(rand.Intn(32) + 8)
+		items = append(items, item)
+		if err := q.Enque(NewItem(item, map[string]string{"n": strconv.Itoa(i)})); err != nil {
+			t.Fatal(err)
+		}
+		if i == 10 {
+			q.Enque(NewItem(item, nil))
+		}
+	}
+	stats := q.Stats()
+	if stats.Segments == 0 || stats.MemoryBytes > 1024+64 {
+		t.Fatal("expected most of the queue to be on disk", stats)
+	}
+	if files, _ := os.ReadDir(q.dir); len(files) != stats.Segments {
+		t.Fatal("expected a file per segment", len(files), stats.Segments)
+	}
+	if q.Size() != len(items) {
+		t.Fatal("expected the duplicate to be dropped", q.Size())
+	}
+	if !q.Has(Hash(items[500])) {
+		t.Fatal("expected to find an item which is on disk")
+	}
+	for i, item := range items {
+		if i%100 == 0 {
+			q.Enque(NewItem([]byte(fmt.Sprint("late", i)), nil))
+		}
+		got, err := q.Deque()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Data, item) || got.Headers["n"] != strconv.Itoa(i) {
+			t.Fatal("items out of order at", i)
+		}
+	}
+	for i := 0; i < 1000; i += 100 {
+		got, err := q.Deque()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got.Data) != fmt.Sprint("late", i) {
+			t.Fatal("expected the late items last", string(got.Data))
+		}
+	}
+	if !q.Empty() || q.Stats().Segments != 0 {
+		t.Fatal("expected the queue to be empty", q.Stats())
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Fatal("expected Close to remove the queue's directory")
+	}
+}
+
+func TestSpillQueueCorruptSegment(t *testing.T) {
+	q, err := NewSpillQueue(t.TempDir(), "corrupt", 1024, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	for i := 0; i < 500; i++ {
+		q.Enque(NewItem([]byte(fmt.Sprintf("item %08d", i)), nil))
+	}
+	if len(q.segments) < 2 {
+		t.Fatal("expected a few segments", len(q.segments))
+	}
+	inHead, bad := len(q.head), q.segments[0]
+	if err := os.WriteFile(bad.path, []byte("not a segment"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < inHead; i++ {
+		if _, err := q.Deque(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := q.Deque(); err == nil {
+		t.Fatal("expected an error reading the corrupt segment")
+	}
+	if q.Size() != 500-inHead-bad.count {
+		t.Fatal("expected the corrupt segment's items to be dropped", q.Size())
+	}
+	item, err := q.Deque()
+	if err != nil {
+		t.Fatal(err)
+	} else if string(item.Data) != fmt.Sprintf("item %08d", inHead+bad.count) {
+		t.Fatal("expected to carry on after the corrupt segment", string(item.Data))
+	}
+
+	q.SetCompression(1)
+	q.Enque(NewItem(bytes.Repeat([]byte("x"), 100), nil))
+	for q.Size() > 1 {
+		q.Deque()
+	}
+	if len(q.head) != 1 || !q.head[0].compressed {
+		t.Fatal("expected the compressed item at the head")
+	}
+	q.head[0].Data = []byte("not deflated")
+	for i := 0; i < 2; i++ {
+		if _, err := q.Deque(); err == nil {
+			t.Fatal("expected an error decompressing the item")
+		}
+		if q.Size() != 1 {
+			t.Fatal("expected the item to stay on the queue", q.Size())
+		}
+	}
+}
+
+func jsonItem(i int) []byte {
+	return []byte(fmt.Sprintf(`{"id": %d, "name": "item %d", "tags": ["a", "b", "c"], "body": "%s"}`,
+		i, i, bytes.Repeat([]byte("lorem ipsum "), 20)))
+}
+
+func TestCompression(t *testing.T) {
+	spill, err := NewSpillQueue(t.TempDir(), "compressed", 4096, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spill.Close()
+	for _, q := range []interface {
+		Enque(*Item) error
+		Deque() (*Item, error)
+		Has([]byte) bool
+		SetCompression(int)
+		Stats() Stats
+	}{NewQueue(false), spill} {
+		q.SetCompression(64)
+		for i := 0; i < 100; i++ {
+			q.Enque(NewItem(jsonItem(i), nil))
+		}
+		q.Enque(NewItem([]byte("tiny"), nil))
+		stats := q.Stats()
+		if stats.Items != 101 || stats.Compressed != 100 {
+			t.Fatal("expected every item but the tiny one to be compressed", stats)
+		}
+		if stats.Ratio() < 3 {
+			t.Fatal("expected a better compression ratio", stats.Ratio())
+		}
+		if !q.Has(Hash(jsonItem(50))) {
+			t.Fatal("expected Has to use the hash of the original data")
+		}
+		q.Enque(NewItem(jsonItem(50), nil))
+		if q.Stats().Items != 101 {
+			t.Fatal("expected the duplicate to be dropped")
+		}
+		for i := 0; i < 100; i++ {
+			item, err := q.Deque()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(item.Data, jsonItem(i)) {
+				t.Fatal("bad item", i, string(item.Data))
+			}
+		}
+		if item, _ := q.Deque(); string(item.Data) != "tiny" {
+			t.Fatal("expected the tiny item")
+		}
+		if stats := q.Stats(); stats.Bytes != 0 || stats.RawBytes != 0 || stats.Compressed != 0 {
+			t.Fatal("expected the stats to go back to zero", stats)
+		}
+	}
+}
+
+func TestGroupQueue(t *testing.T) {
+	q := NewGroupQueue(true)
+	enque := func(data, group string) {
+		headers := map[string]string{}
+		if group != "" {
+			headers[GroupHeader] = group
+		}
+		if err := q.Enque(NewItem([]byte(data), headers)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deque := func(expected string) *Item {
+		item, err := q.Deque()
+		if expected == "" {
+			if err == nil {
+				t.Fatal("expected nothing to deque got", string(item.Data))
+			}
+			return nil
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(item.Data) != expected {
+			t.Fatalf("expected %v got %v", expected, string(item.Data))
+		}
+		return item
+	}
+	enque("a1", "a")
+	enque("a2", "a")
+	enque("b1", "b")
+	enque("x", "")
+	enque("a3", "a")
+	enque("b2", "b")
+
+	a1 := deque("a1")
+	// a is held so its other items are skipped
+	b1 := deque("b1")
+	deque("x")
+	deque("")
+	if !q.Empty() || q.Size() != 3 {
+		t.Fatal("expected 3 items waiting behind held groups", q.Size())
+	}
+	if !q.Has(Hash([]byte("a2"))) || q.Has(Hash([]byte("a1"))) {
+		t.Fatal("Has should only see waiting items")
+	}
+	if err := q.Ack(a1.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Ack(a1.Id); err == nil {
+		t.Fatal("expected an error acking twice")
+	}
+	a2 := deque("a2")
+	if err := q.Release(b1.Id); err != nil {
+		t.Fatal(err)
+	}
+	// b1 is older than a3 and b2 so it comes next
+	b1 = deque("b1")
+	deque("")
+	q.Ack(a2.Id)
+	q.Ack(b1.Id)
+	a3 := deque("a3")
+	b2 := deque("b2")
+	q.Ack(a3.Id)
+	q.Ack(b2.Id)
+	if !q.Empty() || q.Size() != 0 || len(q.groups) != 0 {
+		t.Fatal("expected the queue to be empty", q.Size(), len(q.groups))
+	}
+}
+
+/* n small distinct items. */
+func benchItems(n int) []*Item {
+	items := make([]*Item, n)
+	for i := range items {
+		data := make([]byte, 16)
+		binary.LittleEndian.PutUint64(data, uint64(i))
+		items[i] = &Item{Data: data}
+	}
+	return items
+}
+
+/*
+The memory the queue itself uses for each item it holds (the items are
+allocated before measuring).  */
+func BenchmarkMemoryPerItem(b *testing.B) {
+	items := benchItems(b.N)
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+	q := NewQueue(false)
+	for _, item := range items {
+		q.Enque(item)
+	}
+	b.StopTimer()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/float64(b.N), "bytes/item")
+	runtime.KeepAlive(q)
+	runtime.KeepAlive(items)
+}
+
+/* How long a full collection takes with a million items on a queue. */
+func BenchmarkGCPause(b *testing.B) {
+	q := NewQueue(false)
+	for _, item := range benchItems(1000000) {
+		q.Enque(item)
+	}
+	runtime.GC()
+	var pause time.Duration
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := time.Now()
+		runtime.GC()
+		pause += time.Since(start)
+	}
+	b.ReportMetric(float64(pause.Microseconds())/float64(b.N), "us/gc")
+	runtime.KeepAlive(q)
+}
+
+/* A queue which stays around 1000 items long. */
+func BenchmarkEnqueDeque(b *testing.B) {
+	q := NewQueue(false)
+	items := benchItems(1000 + b.N)
+	for _, item := range items[:1000] {
+		q.Enque(item)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for _, item := range items[1000:] {
+		q.Enque(item)
+		if _, err := q.Deque(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
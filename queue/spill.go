@@ -0,0 +1,335 @@
+package queue
+
+/* queued
+ * Author: Tim Henderson
+ * Email: tadh@case.edu
+ * Copyright 2013 All Right Reserved
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ *  * Neither the name of the queued nor the names of its contributors may be
+ *    used to endorse or promote products derived from this software without
+ *    specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+)
+
+/*
+A SpillQueue is a queue which can grow past the memory it is allowed to use.
+The head of the queue (where items are dequeued) and the tail (where they are
+enqueued) are kept in memory. When the tail reaches half of the memory limit
+it is written out as a segment file, so the middle of the queue lives on disk
+as a list of segments. As consumers catch up the segments are read back (and
+deleted) one at a time to become the new head.
+
+Only the item data (as stored, see SetCompression) and headers count towards
+the limit. The dedupe index is always kept in memory (about 40 bytes an
+item). The segments are not meant to survive a restart: each queue writes
+them to its own new directory which Close removes.  */
+type SpillQueue struct {
+	lock      *sync.Mutex
+	dir       string
+	limit     int
+	head      []*Item
+	tail      []*Item
+	headBytes int
+	tailBytes int
+	segments  []*segment
+	nextSeg   int
+	length    int
+	index     index
+	codec     codec
+	allowDups bool
+}
+
+type segment struct {
+	path  string
+	count int
+	bytes int
+}
+
+/* How an item is written to a segment. */
+type record struct {
+	Item       *Item
+	Compressed bool
+}
+
+var unsafeChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+/*
+Construct a new SpillQueue which keeps about limit bytes of items in memory
+and writes the rest to segment files in a new directory under dir. name is
+only used to name that directory.  */
+func NewSpillQueue(dir, name string, limit int, allowDups bool) (*SpillQueue, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("the memory limit must be positive, got %v", limit)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	qdir, err := os.MkdirTemp(dir, "queued-"+unsafeChars.ReplaceAllString(name, "_")+"-")
+	if err != nil {
+		return nil, err
+	}
+	return &SpillQueue{
+		lock:      new(sync.Mutex),
+		dir:       qdir,
+		limit:     limit,
+		index:     make(index),
+		allowDups: allowDups,
+	}, nil
+}
+
+/* Roughly the memory an item uses. */
+func itemBytes(item *Item) int {
+	size := len(item.Data) + len(item.Id)
+	for k, v := range item.Headers {
+		size += len(k) + len(v)
+	}
+	return size
+}
+
+/* Put an item on the queue */
+func (self *SpillQueue) Enque(item *Item) error {
+	_, err := self.EnqueUnique(item)
+	return err
+}
+
+/* Enque, reporting a dropped duplicate as Queue.EnqueUnique does. */
+func (self *SpillQueue) EnqueUnique(item *Item) (string, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if dup, ok := self.index.add(item, self.allowDups); !ok {
+		return dup, nil
+	}
+	stored := self.codec.pack(item)
+	self.tail = append(self.tail, stored)
+	self.tailBytes += itemBytes(stored)
+	self.length += 1
+	if self.tailBytes < self.limit/2 {
+		return "", nil
+	}
+	if len(self.head) == 0 && len(self.segments) == 0 {
+		self.head, self.tail = self.tail, self.head
+		self.headBytes, self.tailBytes = self.tailBytes, 0
+	} else if err := self.spill(); err != nil {
+		log.Error("could not spill to disk, keeping the items in memory", "dir", self.dir, "err", err)
+	}
+	return "", nil
+}
+
+/* Read an item off the queue in FIFO order */
+func (self *SpillQueue) Deque() (*Item, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.length <= 0 {
+		return nil, fmt.Errorf("List is empty")
+	}
+	if len(self.head) == 0 {
+		if len(self.segments) > 0 {
+			if err := self.load(); err != nil {
+				return nil, err
+			}
+		} else {
+			self.head, self.tail = self.tail, self.head[:0]
+			self.headBytes, self.tailBytes = self.tailBytes, 0
+		}
+	}
+	stored := self.head[0]
+	item, err := self.codec.unpack(stored)
+	if err != nil {
+		return nil, err
+	}
+	self.head[0] = nil
+	self.head = self.head[1:]
+	self.headBytes -= itemBytes(stored)
+	self.length -= 1
+	if err := self.index.remove(item); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+/* Write the tail out as a new segment. */
+func (self *SpillQueue) spill() (err error) {
+	path := filepath.Join(self.dir, fmt.Sprintf("segment-%08d", self.nextSeg))
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := f.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+	w := bufio.NewWriter(f)
+	enc := gob.NewEncoder(w)
+	for _, item := range self.tail {
+		if err := enc.Encode(&record{Item: item, Compressed: item.compressed}); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	self.nextSeg += 1
+	self.segments = append(self.segments, &segment{
+		path:  path,
+		count: len(self.tail),
+		bytes: self.tailBytes,
+	})
+	for i := range self.tail {
+		self.tail[i] = nil
+	}
+	self.tail = self.tail[:0]
+	self.tailBytes = 0
+	return nil
+}
+
+/*
+Read the first segment back in as the head (and delete it). If the segment
+can't be opened it is kept to try again. If it is corrupt it is dropped along
+with its items (so the rest of the queue can still be dequeued). The items
+which couldn't be read stay in the dedupe index and the byte counts of Stats.  */
+func (self *SpillQueue) load() error {
+	seg := self.segments[0]
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := gob.NewDecoder(bufio.NewReader(f))
+	head := make([]*Item, 0, seg.count)
+	for {
+		var rec record
+		if err = dec.Decode(&rec); err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			break
+		}
+		if rec.Item == nil {
+			err = fmt.Errorf("missing item")
+			break
+		}
+		rec.Item.compressed = rec.Compressed
+		head = append(head, rec.Item)
+	}
+	if err == nil && len(head) != seg.count {
+		err = fmt.Errorf("expected %v items got %v", seg.count, len(head))
+	}
+	self.segments[0] = nil
+	self.segments = self.segments[1:]
+	if rmErr := os.Remove(seg.path); rmErr != nil {
+		log.Warn("could not remove a segment", "path", seg.path, "err", rmErr)
+	}
+	if err != nil {
+		self.drop(head, seg.count)
+		return fmt.Errorf("reading %v: %v (dropped %v items)", seg.path, err, seg.count)
+	}
+	self.head = head
+	self.headBytes = seg.bytes
+	return nil
+}
+
+/* Forget the count items of a corrupt segment, read being the ones read. */
+func (self *SpillQueue) drop(read []*Item, count int) {
+	for _, stored := range read {
+		if item, err := self.codec.unpack(stored); err == nil {
+			self.index.remove(item)
+		}
+	}
+	self.length -= count
+}
+
+/* Check to see if it empty */
+func (self *SpillQueue) Empty() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.length <= 0
+}
+
+/* How many items are on the queue? */
+func (self *SpillQueue) Size() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.length
+}
+
+func (self *SpillQueue) Has(hash []byte) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.index.has(hash)
+}
+
+/*
+Compress the data of items of at least minSize bytes while they are on the
+queue (in memory and on disk). See Queue.SetCompression.  */
+func (self *SpillQueue) SetCompression(minSize int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.codec.minSize = minSize
+}
+
+func (self *SpillQueue) Stats() Stats {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	var disk int64
+	for _, seg := range self.segments {
+		disk += int64(seg.bytes)
+	}
+	return Stats{
+		Items:       self.length,
+		Bytes:       self.codec.bytes,
+		RawBytes:    self.codec.rawBytes,
+		Compressed:  self.codec.compressed,
+		MemoryBytes: int64(self.headBytes + self.tailBytes),
+		DiskBytes:   disk,
+		Segments:    len(self.segments),
+	}
+}
+
+/* Throw away everything on the queue and remove its directory. */
+func (self *SpillQueue) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.head, self.tail, self.segments = nil, nil, nil
+	self.headBytes, self.tailBytes, self.length = 0, 0, 0
+	self.index = make(index)
+	self.codec.reset()
+	return os.RemoveAll(self.dir)
+}
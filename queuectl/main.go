@@ -0,0 +1,462 @@
+/*
+A command line client for queued. queuectl talks to a running daemon so queues
+can be inspected and fixed (and scripted) without hand encoding the protocol.
+*/
+
+package main
+
+/* queued
+ * Author: Tim Henderson
+ * Email: tadh@case.edu
+ * Copyright 2013 All Right Reserved
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ *  * Neither the name of the queued nor the names of its contributors may be
+ *    used to endorse or promote products derived from this software without
+ *    specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+import (
+	"github.com/timtadh/getopt"
+)
+
+import (
+	"github.com/timtadh/queued/client"
+	"github.com/timtadh/queued/queue"
+)
+
+var ErrorCodes map[string]int = map[string]int{
+	"usage":   1,
+	"opts":    3,
+	"empty":   4,
+	"connect": 5,
+	"failed":  6,
+	"badfile": 7,
+}
+
+var UsageMessage string = "queuectl [options] <command> [args]"
+var ExtendedMessage string = `
+talks to a running queued daemon.
+
+Commands
+    enque [file ...]        enque the contents of each file (or stdin) as an
+                            item and print its id (or, if the queue dedupes
+                            and already has it, the id of the copy on it)
+    deque                   deque an item and write its data to stdout
+    size                    print the size of the queue
+    stats                   print what the queue is holding (its size, bytes,
+                            compression ratio ...)
+    has [file ...]          print whether the queue has an item with the
+                            contents of each file (or stdin). Only the hash is
+                            sent to the server
+    queues                  list the queues
+    drain <file>            deque every item on the queue and write them to
+                            file (- for stdout), one JSON item per line. An
+                            item which can't be written is put back
+    load <file>             enque every item in a file written by drain (- for
+                            stdin), keeping their data and headers. Items the
+                            queue drops as duplicates aren't counted
+
+Options
+    -h, --help              print this message
+    -s, --server=<addr>     the server's host:port (default localhost:9001)
+    -q, --queue=<name>      the queue to use (default "default")
+    -H, --header=<key=val>  add a header to enqued items. May be repeated
+    -l, --lines             enque (or check) each line as its own item
+    -j, --json              print JSON instead of plain text
+
+Exit Codes
+    4   deque found the queue empty
+    5   could not connect to the server
+    6   the server returned an error
+    7   a file could not be read or written
+`
+
+func Usage(code int) {
+	fmt.Fprintln(os.Stderr, UsageMessage)
+	if code == 0 {
+		fmt.Fprintln(os.Stderr, ExtendedMessage)
+		code = ErrorCodes["usage"]
+	} else {
+		fmt.Fprintln(os.Stderr, "Try -h or --help for help")
+	}
+	os.Exit(code)
+}
+
+type ctl struct {
+	c       *client.Client
+	queue   string
+	headers map[string]string
+	lines   bool
+	json    bool
+	out     *bufio.Writer
+}
+
+/* Report err and exit (after writing out what has been printed so far). */
+func (self *ctl) fail(code string, err error) {
+	self.out.Flush()
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(ErrorCodes[code])
+}
+
+/* Print a value, as JSON or (with fmt) as plain text. */
+func (self *ctl) print(v interface{}, plain string, args ...interface{}) {
+	if self.json {
+		data, err := json.Marshal(v)
+		if err != nil {
+			self.fail("failed", err)
+		}
+		self.out.Write(data)
+		self.out.WriteByte('\n')
+	} else {
+		fmt.Fprintf(self.out, plain, args...)
+	}
+}
+
+/*
+Call f with the contents of each of the named files (stdin if there are none).
+With --lines f is called with each line instead.  */
+func (self *ctl) each(files []string, f func(name string, data []byte)) {
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	for _, name := range files {
+		r := io.Reader(os.Stdin)
+		if name != "-" {
+			file, err := os.Open(name)
+			if err != nil {
+				self.fail("badfile", err)
+			}
+			defer file.Close()
+			r = file
+		}
+		if self.lines {
+			scanner := bufio.NewScanner(r)
+			scanner.Buffer(make([]byte, 64*1024), 1<<30)
+			for scanner.Scan() {
+				f(name, append([]byte(nil), scanner.Bytes()...))
+			}
+			if err := scanner.Err(); err != nil {
+				self.fail("badfile", err)
+			}
+		} else {
+			data, err := io.ReadAll(r)
+			if err != nil {
+				self.fail("badfile", err)
+			}
+			f(name, data)
+		}
+	}
+}
+
+func (self *ctl) enque(files []string) {
+	self.each(files, func(name string, data []byte) {
+		id, err := self.c.Enque(data, self.headers)
+		if err == client.ErrDuplicate {
+			self.print(map[string]string{"id": id, "file": name, "duplicate": "true"}, "%v (duplicate)\n", id)
+			return
+		} else if err != nil {
+			self.fail("failed", err)
+		}
+		self.print(map[string]string{"id": id, "file": name}, "%v\n", id)
+	})
+}
+
+func (self *ctl) deque() {
+	item, err := self.c.Deque()
+	if err == client.ErrEmpty {
+		self.fail("empty", err)
+	} else if err != nil {
+		self.fail("failed", err)
+	}
+	if self.json {
+		self.print(item, "")
+	} else {
+		self.out.Write(item.Data)
+	}
+	self.ack(item)
+}
+
+/* Let the next item of a message group go, once this one is written. */
+func (self *ctl) ack(item *queue.Item) {
+	if item.Headers[queue.GroupHeader] == "" {
+		return
+	}
+	if err := self.c.Ack(item.Id); err != nil {
+		self.fail("failed", err)
+	}
+}
+
+func (self *ctl) size() {
+	size, err := self.c.Size()
+	if err != nil {
+		self.fail("failed", err)
+	}
+	self.print(map[string]interface{}{"queue": self.queue, "size": size}, "%v\n", size)
+}
+
+func (self *ctl) stats() {
+	stats, err := self.c.Stats()
+	if err != nil {
+		self.fail("failed", err)
+	}
+	if self.json {
+		self.print(stats, "")
+		return
+	}
+	for _, key := range []string{
+		"items", "bytes", "raw_bytes", "compressed", "ratio",
+		"memory_bytes", "disk_bytes", "segments", "expired",
+	} {
+		if value, has := stats[key]; has {
+			fmt.Fprintf(self.out, "%-13v %v\n", key, value)
+		}
+	}
+}
+
+func (self *ctl) has(files []string) {
+	self.each(files, func(name string, data []byte) {
+		has, err := self.c.Has(data)
+		if err != nil {
+			self.fail("failed", err)
+		}
+		hash := fmt.Sprintf("%x", queue.Hash(data))
+		self.print(map[string]interface{}{"file": name, "sha256": hash, "has": has}, "%v %v\n", has, name)
+	})
+}
+
+func (self *ctl) queues() {
+	names, err := self.c.Queues()
+	if err != nil {
+		self.fail("failed", err)
+	}
+	if self.json {
+		self.print(names, "")
+		return
+	}
+	for _, name := range names {
+		fmt.Fprintln(self.out, name)
+	}
+}
+
+/*
+Deque every item and write it out. Each item is flushed before it is acked so
+an item is never lost to a failed write: one which can't be written is put
+back on the queue (see putBack) and drain fails.  */
+func (self *ctl) drain(path string) {
+	w := self.out
+	var file *os.File
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			self.fail("badfile", err)
+		}
+		file = f
+		w = bufio.NewWriter(file)
+	}
+	finish := func() error {
+		err := w.Flush()
+		if file != nil {
+			if e := file.Close(); err == nil {
+				err = e
+			}
+		}
+		return err
+	}
+	enc := json.NewEncoder(w)
+	count := 0
+	for {
+		item, err := self.c.Deque()
+		if err == client.ErrEmpty {
+			break
+		} else if err != nil {
+			if e := finish(); e != nil {
+				fmt.Fprintln(os.Stderr, e)
+			}
+			self.fail("failed", err)
+		}
+		err = enc.Encode(item)
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			self.putBack(item)
+			finish()
+			self.fail("badfile", err)
+		}
+		self.ack(item)
+		count += 1
+	}
+	if err := finish(); err != nil {
+		self.fail("badfile", err)
+	}
+	if path != "-" {
+		self.print(map[string]interface{}{"queue": self.queue, "drained": count}, "drained %v items\n", count)
+	}
+}
+
+/*
+Put back an item which was dequeued but couldn't be written out, at the front
+of the queue if it supports that. An item of a message group is left unacked
+instead, so the server puts it back at the head of its group when we hang up.  */
+func (self *ctl) putBack(item *queue.Item) {
+	if item.Headers[queue.GroupHeader] != "" {
+		return
+	}
+	_, err := self.c.EnqueFront(item.Data, item.Headers)
+	if err != nil && err != client.ErrDuplicate {
+		_, err = self.c.Enque(item.Data, item.Headers)
+	}
+	if err != nil && err != client.ErrDuplicate {
+		fmt.Fprintln(os.Stderr, "could not put back item", item.Id, err)
+	}
+}
+
+func (self *ctl) load(path string) {
+	r := io.Reader(os.Stdin)
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			self.fail("badfile", err)
+		}
+		defer file.Close()
+		r = file
+	}
+	dec := json.NewDecoder(r)
+	count := 0
+	for {
+		var item queue.Item
+		if err := dec.Decode(&item); err == io.EOF {
+			break
+		} else if err != nil {
+			self.fail("badfile", err)
+		}
+		if _, err := self.c.Enque(item.Data, item.Headers); err == client.ErrDuplicate {
+			continue
+		} else if err != nil {
+			self.fail("failed", err)
+		}
+		count += 1
+	}
+	self.print(map[string]interface{}{"queue": self.queue, "loaded": count}, "loaded %v items\n", count)
+}
+
+func main() {
+	short := "hs:q:H:lj"
+	long := []string{
+		"help",
+		"server=",
+		"queue=",
+		"header=",
+		"lines",
+		"json",
+	}
+	args, optargs, err := getopt.GetOpt(os.Args[1:], short, long)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		Usage(ErrorCodes["opts"])
+	}
+
+	addr := "localhost:9001"
+	self := &ctl{
+		queue:   "default",
+		headers: make(map[string]string),
+		out:     bufio.NewWriter(os.Stdout),
+	}
+	for _, oa := range optargs {
+		switch oa.Opt() {
+		case "-h", "--help":
+			Usage(0)
+		case "-s", "--server":
+			addr = oa.Arg()
+		case "-q", "--queue":
+			self.queue = oa.Arg()
+		case "-H", "--header":
+			kv := strings.SplitN(oa.Arg(), "=", 2)
+			if len(kv) != 2 || kv[0] == "" || strings.ContainsAny(kv[0], " \t") {
+				fmt.Fprintf(os.Stderr, "Error parsing '%v' expected key=value\n", oa.Arg())
+				Usage(ErrorCodes["opts"])
+			}
+			self.headers[kv[0]] = kv[1]
+		case "-l", "--lines":
+			self.lines = true
+		case "-j", "--json":
+			self.json = true
+		}
+	}
+
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "You must give a command")
+		Usage(ErrorCodes["opts"])
+	}
+	command, rest := args[0], args[1:]
+	nargs := map[string]int{"deque": 0, "size": 0, "stats": 0, "queues": 0, "drain": 1, "load": 1}
+	if n, has := nargs[command]; has && len(rest) != n {
+		fmt.Fprintf(os.Stderr, "%v takes %v arguments\n", command, n)
+		Usage(ErrorCodes["opts"])
+	}
+
+	self.c, err = client.Dial(addr)
+	if err != nil {
+		self.fail("connect", err)
+	}
+	defer self.c.Close()
+	defer self.out.Flush()
+	if command != "queues" {
+		if err := self.c.Use(self.queue); err != nil {
+			self.fail("failed", err)
+		}
+	}
+
+	switch command {
+	case "enque":
+		self.enque(rest)
+	case "deque":
+		self.deque()
+	case "size":
+		self.size()
+	case "stats":
+		self.stats()
+	case "has":
+		self.has(rest)
+	case "queues":
+		self.queues()
+	case "drain":
+		self.drain(rest[0])
+	case "load":
+		self.load(rest[0])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command '%v'\n", command)
+		Usage(ErrorCodes["opts"])
+	}
+}
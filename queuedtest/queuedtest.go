@@ -0,0 +1,112 @@
+/*
+Package queuedtest runs a queued server in the test's process for integration
+tests. The server listens on free ports on localhost and is stopped when the
+test finishes:
+
+    func TestWorker(t *testing.T) {
+        server := queuedtest.NewServer(t, nil)
+        c, err := client.Dial(server.Addr)
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer c.Close()
+        ...
+    }
+
+Pass a *config.Config to get the queues, limits and so on the daemon would
+have with that configuration file.
+*/
+package queuedtest
+
+/* queued
+ * Author: Tim Henderson
+ * Email: tadh@case.edu
+ * Copyright 2013 All Right Reserved
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ *  * Neither the name of the queued nor the names of its contributors may be
+ *    used to endorse or promote products derived from this software without
+ *    specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+import (
+	"github.com/timtadh/queued/config"
+	qnet "github.com/timtadh/queued/net"
+)
+
+/*
+A running server. Addr, RESPAddr and WSAddr are the host:port of its queued
+protocol, RESP (Redis) and WebSocket listeners.  */
+type Server struct {
+	*qnet.Server
+	Addr     string
+	RESPAddr string
+	WSAddr   string
+}
+
+/*
+Start a server configured by conf (the defaults if it is nil) and stop it
+when t is done. Clients should be closed by the test: stopping the server
+stops its listeners but not the connections it is serving. The test fails
+(via t.Fatal) if the server can't be started.  */
+func NewServer(t testing.TB, conf *config.Config) *Server {
+	t.Helper()
+	if conf == nil {
+		var err error
+		conf, err = config.Parse([]byte("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &Server{Server: qnet.NewServer(conf.Creator("default"))}
+	conf.Apply(s.Server)
+	t.Cleanup(s.stop)
+	listen := []struct {
+		addr *string
+		f    func(int) (*net.TCPAddr, error)
+	}{
+		{&s.Addr, s.Listen},
+		{&s.RESPAddr, s.ListenRESP},
+		{&s.WSAddr, s.ListenWebSocket},
+	}
+	for _, l := range listen {
+		addr, err := l.f(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		*l.addr = fmt.Sprintf("127.0.0.1:%d", addr.Port)
+	}
+	return s
+}
+
+func (self *Server) stop() {
+	self.SetWebhooks(nil)
+	self.Stop()
+}
@@ -0,0 +1,94 @@
+package queuedtest
+
+/* queued
+ * Author: Tim Henderson
+ * Email: tadh@case.edu
+ * Copyright 2013 All Right Reserved
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ *  * Neither the name of the queued nor the names of its contributors may be
+ *    used to endorse or promote products derived from this software without
+ *    specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+import "testing"
+
+import (
+	"bufio"
+	"net"
+)
+
+import (
+	"github.com/timtadh/queued/client"
+	"github.com/timtadh/queued/config"
+)
+
+func TestServer(t *testing.T) {
+	server := NewServer(t, nil)
+	c, err := client.Dial(server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Enque([]byte("hello"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if item, err := c.Deque(); err != nil || string(item.Data) != "hello" {
+		t.Fatal("bad deque", item, err)
+	}
+	con, err := net.Dial("tcp", server.RESPAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer con.Close()
+	con.Write([]byte("PING\r\n"))
+	if line, err := bufio.NewReader(con).ReadString('\n'); err != nil || line != "+PONG\r\n" {
+		t.Fatal("expected a PONG", line, err)
+	}
+}
+
+func TestConfiguredServer(t *testing.T) {
+	conf, err := config.Parse([]byte(`{"queues": {"jobs": {"max_size": 1}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(t, conf)
+	if _, has := server.Lookup("jobs"); !has {
+		t.Fatal("expected jobs to be declared")
+	}
+	c, err := client.Dial(server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Use("jobs"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Enque([]byte("a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Enque([]byte("b"), nil); err == nil {
+		t.Fatal("expected jobs to be full")
+	}
+}
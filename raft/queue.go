@@ -0,0 +1,281 @@
+package raft
+
+/* queued
+ * Author: Tim Henderson
+ * Email: tadh@case.edu
+ * Copyright 2013 All Right Reserved
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ *  * Neither the name of the queued nor the names of its contributors may be
+ *    used to endorse or promote products derived from this software without
+ *    specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+import (
+	"github.com/timtadh/queued/queue"
+)
+
+/*
+A set of named queues replicated by a Raft group. Every ENQUE and DEQUE is a
+command in the group's log, so it is only acknowledged once a majority of the
+nodes have it and every node applies them in the same order. The queues
+themselves are ordinary in memory queues, rebuilt from the log when a node
+restarts.
+
+An acknowledged ENQUE survives the loss of a minority of the nodes and puts its
+item on the queue once. Delivery is at most once though: a DEQUE takes its item
+off the queue when it is committed, so if its reply never reaches the client
+(the DEQUE timed out, or the client's connection died) the item is gone.  */
+type Queues struct {
+	node   *Node
+	lock   *sync.Mutex
+	queues map[string]*queue.Queue
+	ids    map[string]bool
+	recent []string
+	next   int
+	keep   int
+}
+
+type op struct {
+	Op    string      `json:"op"`
+	Queue string      `json:"queue"`
+	Dups  bool        `json:"dups,omitempty"`
+	Item  *queue.Item `json:"item,omitempty"`
+}
+
+/* How many times an ENQUE is proposed before its ErrTimeout is returned. */
+const proposeAttempts = 3
+
+/*
+How many Ids of items which have left the queues are remembered, so that an
+ENQUE proposed again after a timeout isn't applied once its item is gone.  */
+const keepIds = 1 << 16
+
+type dequeued struct {
+	item *queue.Item
+	err  error
+}
+
+/*
+Make the replicated queues and start the node which replicates them (see
+NewNode for the arguments).  */
+func NewQueues(id string, peers []string, transport Transport, storage Storage, config Config) (*Queues, error) {
+	self := &Queues{
+		lock:   new(sync.Mutex),
+		queues: make(map[string]*queue.Queue),
+		ids:    make(map[string]bool),
+		keep:   keepIds,
+	}
+	node, err := NewNode(id, peers, transport, storage, config, self.apply)
+	if err != nil {
+		return nil, err
+	}
+	self.node = node
+	node.Start()
+	return self, nil
+}
+
+func (self *Queues) Node() *Node {
+	return self.node
+}
+
+func (self *Queues) Stop() {
+	self.node.Stop()
+}
+
+/*
+The named queue. allowDups must be the same on every node (and every time the
+queue is asked for) since the queue is made by whichever command reaches it
+first.  */
+func (self *Queues) Queue(name string, allowDups bool) *Queue {
+	return &Queue{queues: self, name: name, allowDups: allowDups}
+}
+
+func (self *Queues) get(name string, allowDups bool) *queue.Queue {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	q, has := self.queues[name]
+	if !has {
+		q = queue.NewQueue(allowDups)
+		self.queues[name] = q
+	}
+	return q
+}
+
+/*
+Apply a committed command to this node's copy of the queues. An enque of an
+item whose Id is known does nothing, so a command proposed again after its
+first proposal timed out (but later committed anyway) isn't applied twice. An
+Id is known while its item is on a queue and for the next keepIds items to
+leave the queues after it.  */
+func (self *Queues) apply(command []byte) interface{} {
+	var o op
+	if err := json.Unmarshal(command, &o); err != nil {
+		return fmt.Errorf("bad command in the log, %v", err)
+	}
+	q := self.get(o.Queue, o.Dups)
+	switch o.Op {
+	case "enque":
+		if o.Item == nil {
+			return fmt.Errorf("enque without an item in the log")
+		}
+		self.lock.Lock()
+		applied := self.ids[o.Item.Id]
+		self.ids[o.Item.Id] = true
+		self.lock.Unlock()
+		if applied {
+			return nil
+		}
+		dup, err := q.EnqueUnique(o.Item)
+		if err != nil || dup != "" {
+			self.forget(o.Item.Id)
+		}
+		if err != nil {
+			return err
+		}
+		return dup
+	case "deque":
+		if q.Empty() {
+			return &dequeued{err: fmt.Errorf("queue is empty")}
+		}
+		item, err := q.Deque()
+		if err == nil {
+			self.forget(item.Id)
+		}
+		return &dequeued{item: item, err: err}
+	}
+	return fmt.Errorf("unknown command '%v' in the log", o.Op)
+}
+
+/*
+The item with id has left the queues (or never got on one). Its Id is kept with
+the last keep such Ids, the oldest of which is forgotten.  */
+func (self *Queues) forget(id string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if len(self.recent) < self.keep {
+		self.recent = append(self.recent, id)
+		return
+	}
+	delete(self.ids, self.recent[self.next])
+	self.recent[self.next] = id
+	self.next = (self.next + 1) % self.keep
+}
+
+func (self *Queues) propose(o *op) (interface{}, error) {
+	command, err := json.Marshal(o)
+	if err != nil {
+		return nil, err
+	}
+	return self.node.Propose(command)
+}
+
+/*
+One replicated queue, a net.Queue. ENQUE and DEQUE go through the leader and
+fail with a *NotLeaderError on the other nodes. Size and Has read this node's
+copy, which may be behind the leader's. Empty is always false on a node which
+isn't the leader, so that a DEQUE there is sent to the leader rather than being
+told the queue is empty.  */
+type Queue struct {
+	queues    *Queues
+	name      string
+	allowDups bool
+}
+
+func (self *Queue) Enque(item *queue.Item) error {
+	_, err := self.EnqueUnique(item)
+	return err
+}
+
+/*
+Enque, returning the Id of the copy already on the queue if the item was
+dropped as a duplicate (see net.UniqueQueue). If the proposal times out it is
+proposed again (up to proposeAttempts times in all), which is safe since the log
+only applies an item's Id once.  */
+func (self *Queue) EnqueUnique(item *queue.Item) (string, error) {
+	o := &op{Op: "enque", Queue: self.name, Dups: self.allowDups, Item: item}
+	r, err := self.queues.propose(o)
+	for i := 1; i < proposeAttempts && err == ErrTimeout; i++ {
+		r, err = self.queues.propose(o)
+	}
+	if err != nil {
+		return "", err
+	}
+	switch r := r.(type) {
+	case error:
+		return "", r
+	case string:
+		return r, nil
+	}
+	return "", nil
+}
+
+/*
+Deque the item at the head of the queue. The item is off the queue (on every
+node) once the DEQUE is committed, whether or not the caller gets it: if this
+fails with ErrTimeout the DEQUE may still be committed later, and then the item
+it took is gone without having been returned to anyone. A DEQUE can't be
+proposed again like an ENQUE since the second one would take another item.  */
+func (self *Queue) Deque() (*queue.Item, error) {
+	r, err := self.queues.propose(&op{Op: "deque", Queue: self.name, Dups: self.allowDups})
+	if err != nil {
+		return nil, err
+	}
+	switch r := r.(type) {
+	case *dequeued:
+		return r.item, r.err
+	case error:
+		return nil, r
+	}
+	return nil, fmt.Errorf("unexpected result %v", r)
+}
+
+func (self *Queue) local() *queue.Queue {
+	return self.queues.get(self.name, self.allowDups)
+}
+
+func (self *Queue) Empty() bool {
+	if state, _, _ := self.queues.node.Status(); state != Leader {
+		return false
+	}
+	return self.local().Empty()
+}
+
+func (self *Queue) Size() int {
+	return self.local().Size()
+}
+
+func (self *Queue) Has(hash []byte) bool {
+	return self.local().Has(hash)
+}
+
+func (self *Queue) Stats() queue.Stats {
+	return self.local().Stats()
+}
@@ -0,0 +1,687 @@
+/*
+Package raft is an implementation of the Raft consensus algorithm (Ongaro and
+Ousterhout, "In Search of an Understandable Consensus Algorithm") and, built on
+it, a set of named queues replicated across three or five queued processes.
+The queues don't lose acknowledged items, but deliver them at most once (see
+Queues).
+
+A Node is one member of a group. Commands are proposed to the leader, appended
+to its log, copied to the followers and applied (in log order, on every node)
+once a majority has them. Propose only returns once the command is committed
+and applied, so an acknowledged command survives the loss of any minority of
+the nodes. Proposals to a follower fail with a *NotLeaderError naming the
+leader (when there is one).
+
+Nodes talk through a Transport: Network connects nodes in the same process
+(and can partition them, for tests) and RPCTransport connects processes over
+TCP. The log and the vote are kept by a Storage: MemoryStorage or FileStorage.
+The log is never compacted.
+*/
+package raft
+
+/* queued
+ * Author: Tim Henderson
+ * Email: tadh@case.edu
+ * Copyright 2013 All Right Reserved
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ *  * Neither the name of the queued nor the names of its contributors may be
+ *    used to endorse or promote products derived from this software without
+ *    specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+var log *slog.Logger
+
+func init() {
+	SetLogger(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+}
+
+/*
+Set the logger for this package. Every record gets a pkg=queued/raft
+attribute.  */
+func SetLogger(logger *slog.Logger) {
+	log = logger.With("pkg", "queued/raft")
+}
+
+type State int
+
+const (
+	Follower State = iota
+	Candidate
+	Leader
+)
+
+func (self State) String() string {
+	switch self {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return fmt.Sprintf("State(%d)", int(self))
+}
+
+/* An entry in the log. Entries with a nil Command are no-ops. */
+type Entry struct {
+	Term    uint64
+	Index   uint64
+	Command []byte
+}
+
+type VoteArgs struct {
+	Term      uint64
+	Candidate string
+	LastIndex uint64
+	LastTerm  uint64
+}
+
+type VoteReply struct {
+	Term    uint64
+	Granted bool
+}
+
+type AppendArgs struct {
+	Term      uint64
+	Leader    string
+	PrevIndex uint64
+	PrevTerm  uint64
+	Entries   []Entry
+	Commit    uint64
+}
+
+/*
+When an append fails because the logs don't match Next is where the leader
+should try next.  */
+type AppendReply struct {
+	Term    uint64
+	Success bool
+	Next    uint64
+}
+
+/* How a node reaches the others. */
+type Transport interface {
+	RequestVote(to string, args *VoteArgs) (*VoteReply, error)
+	AppendEntries(to string, args *AppendArgs) (*AppendReply, error)
+}
+
+/*
+The proposal was sent to a node which isn't the leader. Leader is the leader
+the node knows of ("" during an election).  */
+type NotLeaderError struct {
+	Leader string
+}
+
+func (self *NotLeaderError) Error() string {
+	if self.Leader == "" {
+		return "no leader (election in progress)"
+	}
+	return "not the leader, the leader is " + self.Leader
+}
+
+/* Where to send the client instead (see net.Redirect). */
+func (self *NotLeaderError) Redirect() string {
+	return self.Leader
+}
+
+/*
+A proposal wasn't applied within the ProposeTimeout. The command is still in
+the leader's log and may be committed later.  */
+var ErrTimeout = errors.New("timed out waiting for the command to be committed")
+
+/*
+Timing. A follower which hasn't heard from a leader for between
+ElectionTimeout and twice that starts an election. The leader sends heartbeats
+every Heartbeat, which should be well under the election timeout. A Propose
+which isn't committed within ProposeTimeout fails (the command may still be
+committed later).  */
+type Config struct {
+	ElectionTimeout time.Duration
+	Heartbeat       time.Duration
+	ProposeTimeout  time.Duration
+	MaxEntries      int
+}
+
+func DefaultConfig() Config {
+	return Config{
+		ElectionTimeout: 300 * time.Millisecond,
+		Heartbeat:       50 * time.Millisecond,
+		ProposeTimeout:  5 * time.Second,
+		MaxEntries:      256,
+	}
+}
+
+type result struct {
+	value interface{}
+	err   error
+}
+
+type proposal struct {
+	term uint64
+	done chan result
+}
+
+/* A member of a Raft group. */
+type Node struct {
+	id        string
+	peers     []string
+	transport Transport
+	storage   Storage
+	apply     func(command []byte) interface{}
+	config    Config
+	lock      *sync.Mutex
+	state     State
+	term      uint64
+	votedFor  string
+	entries   []Entry
+	commit    uint64
+	applied   uint64
+	leader    string
+	deadline  time.Time
+	next      map[string]uint64
+	match     map[string]uint64
+	inflight  map[string]bool
+	again     map[string]bool
+	waiting   map[uint64]*proposal
+	committed chan struct{}
+	stop      chan struct{}
+	wg        *sync.WaitGroup
+	logger    *slog.Logger
+}
+
+/*
+Make a node of the group made up of it and peers. apply is called (from one
+goroutine, in log order) with every committed command. The node loads its log
+and vote from storage: after a restart the commands in its log are applied
+again once the group tells it they are committed, so apply should start from an
+empty state. Call Start to start the node.  */
+func NewNode(id string, peers []string, transport Transport, storage Storage, config Config, apply func([]byte) interface{}) (*Node, error) {
+	term, vote, err := storage.State()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := storage.Entries()
+	if err != nil {
+		return nil, err
+	}
+	if config.MaxEntries <= 0 {
+		config.MaxEntries = DefaultConfig().MaxEntries
+	}
+	if config.ProposeTimeout <= 0 {
+		config.ProposeTimeout = DefaultConfig().ProposeTimeout
+	}
+	others := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		if peer != id {
+			others = append(others, peer)
+		}
+	}
+	n := &Node{
+		id:        id,
+		peers:     others,
+		transport: transport,
+		storage:   storage,
+		apply:     apply,
+		config:    config,
+		lock:      new(sync.Mutex),
+		term:      term,
+		votedFor:  vote,
+		entries:   append([]Entry{{}}, entries...),
+		inflight:  make(map[string]bool),
+		again:     make(map[string]bool),
+		waiting:   make(map[uint64]*proposal),
+		committed: make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		wg:        new(sync.WaitGroup),
+		logger:    log.With("node", id),
+	}
+	return n, nil
+}
+
+func (self *Node) Start() {
+	self.lock.Lock()
+	self.resetDeadline()
+	self.lock.Unlock()
+	self.wg.Add(2)
+	go self.run()
+	go self.applier()
+}
+
+/* Stop the node. Proposals waiting on it fail. */
+func (self *Node) Stop() {
+	close(self.stop)
+	self.wg.Wait()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for index, p := range self.waiting {
+		p.done <- result{err: fmt.Errorf("node stopped")}
+		delete(self.waiting, index)
+	}
+}
+
+func (self *Node) Id() string {
+	return self.id
+}
+
+/* The node's state, term and the leader it knows of. */
+func (self *Node) Status() (State, uint64, string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.state, self.term, self.leader
+}
+
+func (self *Node) lastIndex() uint64 {
+	return uint64(len(self.entries) - 1)
+}
+
+func (self *Node) lastTerm() uint64 {
+	return self.entries[len(self.entries)-1].Term
+}
+
+func (self *Node) majority() int {
+	return (len(self.peers)+1)/2 + 1
+}
+
+func (self *Node) resetDeadline() {
+	d := self.config.ElectionTimeout
+	self.deadline = time.Now().Add(d + time.Duration(rand.Int63n(int64(d))))
+}
+
+/* Save the term and vote. The caller must hold the lock. */
+func (self *Node) persist() {
+	if err := self.storage.SetState(self.term, self.votedFor); err != nil {
+		self.logger.Error("could not save state", "err", err)
+		panic(err)
+	}
+}
+
+/* Step down to follower in term. The caller must hold the lock. */
+func (self *Node) becomeFollower(term uint64, leader string) {
+	if self.state == Leader {
+		self.logger.Info("stepping down", "term", term)
+	}
+	if term > self.term {
+		self.term = term
+		self.votedFor = ""
+		self.persist()
+	}
+	self.state = Follower
+	self.leader = leader
+}
+
+func (self *Node) run() {
+	defer self.wg.Done()
+	tick := self.config.Heartbeat
+	if tick <= 0 || tick > self.config.ElectionTimeout/2 {
+		tick = self.config.ElectionTimeout / 2
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-self.stop:
+			return
+		case <-ticker.C:
+		}
+		self.lock.Lock()
+		if self.state == Leader {
+			self.broadcast()
+		} else if time.Now().After(self.deadline) {
+			self.campaign()
+		}
+		self.lock.Unlock()
+	}
+}
+
+/* Start an election. The caller must hold the lock. */
+func (self *Node) campaign() {
+	self.state = Candidate
+	self.term += 1
+	self.votedFor = self.id
+	self.leader = ""
+	self.persist()
+	self.resetDeadline()
+	self.logger.Info("starting election", "term", self.term)
+	args := &VoteArgs{
+		Term:      self.term,
+		Candidate: self.id,
+		LastIndex: self.lastIndex(),
+		LastTerm:  self.lastTerm(),
+	}
+	votes := 1
+	if votes >= self.majority() {
+		self.becomeLeader()
+		return
+	}
+	for _, peer := range self.peers {
+		go func(peer string) {
+			reply, err := self.transport.RequestVote(peer, args)
+			if err != nil {
+				return
+			}
+			self.lock.Lock()
+			defer self.lock.Unlock()
+			if reply.Term > self.term {
+				self.becomeFollower(reply.Term, "")
+				return
+			}
+			if self.state != Candidate || self.term != args.Term || !reply.Granted {
+				return
+			}
+			votes += 1
+			if votes == self.majority() {
+				self.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+/* The caller must hold the lock. */
+func (self *Node) becomeLeader() {
+	self.logger.Info("elected leader", "term", self.term)
+	self.state = Leader
+	self.leader = self.id
+	self.next = make(map[string]uint64)
+	self.match = make(map[string]uint64)
+	for _, peer := range self.peers {
+		self.next[peer] = self.lastIndex() + 1
+		self.match[peer] = 0
+	}
+	// a no-op in the new term lets entries from earlier terms be committed
+	self.append(nil)
+	self.broadcast()
+}
+
+/* Add a command to the leader's log. The caller must hold the lock. */
+func (self *Node) append(command []byte) uint64 {
+	e := Entry{Term: self.term, Index: self.lastIndex() + 1, Command: command}
+	if err := self.storage.Append([]Entry{e}); err != nil {
+		self.logger.Error("could not save log", "err", err)
+		panic(err)
+	}
+	self.entries = append(self.entries, e)
+	self.advance()
+	return e.Index
+}
+
+/* Send any new entries (or a heartbeat) to every follower. */
+func (self *Node) broadcast() {
+	for _, peer := range self.peers {
+		if self.inflight[peer] {
+			self.again[peer] = true
+		} else {
+			self.inflight[peer] = true
+			go self.replicate(peer)
+		}
+	}
+}
+
+/* Bring peer's log up to date, one append at a time. */
+func (self *Node) replicate(peer string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	defer func() { self.inflight[peer] = false }()
+	for {
+		self.again[peer] = false
+		if self.state != Leader {
+			return
+		}
+		select {
+		case <-self.stop:
+			return
+		default:
+		}
+		next := self.next[peer]
+		end := self.lastIndex() + 1
+		if end-next > uint64(self.config.MaxEntries) {
+			end = next + uint64(self.config.MaxEntries)
+		}
+		args := &AppendArgs{
+			Term:      self.term,
+			Leader:    self.id,
+			PrevIndex: next - 1,
+			PrevTerm:  self.entries[next-1].Term,
+			Entries:   append([]Entry(nil), self.entries[next:end]...),
+			Commit:    self.commit,
+		}
+		self.lock.Unlock()
+		reply, err := self.transport.AppendEntries(peer, args)
+		self.lock.Lock()
+		if err != nil {
+			return
+		}
+		if reply.Term > self.term {
+			self.becomeFollower(reply.Term, "")
+			return
+		}
+		if self.state != Leader || self.term != args.Term {
+			return
+		}
+		if reply.Success {
+			match := args.PrevIndex + uint64(len(args.Entries))
+			if match > self.match[peer] {
+				self.match[peer] = match
+			}
+			self.next[peer] = match + 1
+			self.advance()
+		} else {
+			next := reply.Next
+			if next < 1 {
+				next = 1
+			}
+			if next > self.lastIndex()+1 {
+				next = self.lastIndex() + 1
+			}
+			self.next[peer] = next
+			self.again[peer] = true
+		}
+		if !self.again[peer] && self.next[peer] > self.lastIndex() {
+			return
+		}
+	}
+}
+
+/*
+Commit the entries (of this term) which a majority has. The caller must hold
+the lock.  */
+func (self *Node) advance() {
+	for n := self.lastIndex(); n > self.commit && self.entries[n].Term == self.term; n-- {
+		count := 1
+		for _, peer := range self.peers {
+			if self.match[peer] >= n {
+				count += 1
+			}
+		}
+		if count >= self.majority() {
+			self.setCommit(n)
+			return
+		}
+	}
+}
+
+func (self *Node) setCommit(index uint64) {
+	if index <= self.commit {
+		return
+	}
+	self.commit = index
+	select {
+	case self.committed <- struct{}{}:
+	default:
+	}
+}
+
+/* Apply committed entries and answer the proposals waiting on them. */
+func (self *Node) applier() {
+	defer self.wg.Done()
+	for {
+		select {
+		case <-self.stop:
+			return
+		case <-self.committed:
+		}
+		self.lock.Lock()
+		for self.applied < self.commit {
+			e := self.entries[self.applied+1]
+			self.applied += 1
+			self.lock.Unlock()
+			var value interface{}
+			if e.Command != nil {
+				value = self.apply(e.Command)
+			}
+			self.lock.Lock()
+			if p, has := self.waiting[e.Index]; has {
+				delete(self.waiting, e.Index)
+				if p.term == e.Term {
+					p.done <- result{value: value}
+				} else {
+					p.done <- result{err: fmt.Errorf("lost leadership before the command was committed")}
+				}
+			}
+		}
+		self.lock.Unlock()
+	}
+}
+
+/*
+Propose a command. It returns what apply returned for it once it has been
+committed and applied. Fails with a *NotLeaderError if this node isn't the
+leader, and with ErrTimeout if the command isn't applied within the
+ProposeTimeout (it is still in the log and may yet be committed and applied).  */
+func (self *Node) Propose(command []byte) (interface{}, error) {
+	if command == nil {
+		command = []byte{}
+	}
+	self.lock.Lock()
+	if self.state != Leader {
+		leader := self.leader
+		self.lock.Unlock()
+		return nil, &NotLeaderError{Leader: leader}
+	}
+	p := &proposal{term: self.term, done: make(chan result, 1)}
+	index := self.append(command)
+	self.waiting[index] = p
+	self.broadcast()
+	self.lock.Unlock()
+	timer := time.NewTimer(self.config.ProposeTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-p.done:
+		return r.value, r.err
+	case <-timer.C:
+		self.lock.Lock()
+		delete(self.waiting, index)
+		self.lock.Unlock()
+		return nil, ErrTimeout
+	}
+}
+
+/* Handle a RequestVote from a candidate. */
+func (self *Node) RequestVote(args *VoteArgs) *VoteReply {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if args.Term > self.term {
+		self.becomeFollower(args.Term, "")
+	}
+	reply := &VoteReply{Term: self.term}
+	upToDate := args.LastTerm > self.lastTerm() ||
+		(args.LastTerm == self.lastTerm() && args.LastIndex >= self.lastIndex())
+	if args.Term == self.term && upToDate &&
+		(self.votedFor == "" || self.votedFor == args.Candidate) {
+		self.votedFor = args.Candidate
+		self.persist()
+		self.resetDeadline()
+		reply.Granted = true
+	}
+	return reply
+}
+
+/* Handle an AppendEntries (or heartbeat) from the leader. */
+func (self *Node) AppendEntries(args *AppendArgs) *AppendReply {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if args.Term < self.term {
+		return &AppendReply{Term: self.term}
+	}
+	if args.Term > self.term || self.state != Follower || self.leader != args.Leader {
+		self.becomeFollower(args.Term, args.Leader)
+	}
+	self.resetDeadline()
+	reply := &AppendReply{Term: self.term}
+	if args.PrevIndex > self.lastIndex() {
+		reply.Next = self.lastIndex() + 1
+		return reply
+	}
+	if term := self.entries[args.PrevIndex].Term; term != args.PrevTerm {
+		// skip back over the whole conflicting term
+		i := args.PrevIndex
+		for i > 1 && self.entries[i-1].Term == term {
+			i--
+		}
+		reply.Next = i
+		return reply
+	}
+	for i, e := range args.Entries {
+		if e.Index <= self.lastIndex() {
+			if self.entries[e.Index].Term == e.Term {
+				continue
+			}
+			if e.Index <= self.commit {
+				panic(fmt.Errorf("raft: leader would overwrite committed entry %v", e.Index))
+			}
+			if err := self.storage.Truncate(e.Index); err != nil {
+				self.logger.Error("could not truncate log", "err", err)
+				panic(err)
+			}
+			self.entries = self.entries[:e.Index]
+		}
+		rest := args.Entries[i:]
+		if err := self.storage.Append(rest); err != nil {
+			self.logger.Error("could not save log", "err", err)
+			panic(err)
+		}
+		self.entries = append(self.entries, rest...)
+		break
+	}
+	last := args.PrevIndex + uint64(len(args.Entries))
+	if args.Commit > self.commit {
+		if args.Commit < last {
+			self.setCommit(args.Commit)
+		} else {
+			self.setCommit(last)
+		}
+	}
+	reply.Success = true
+	return reply
+}
@@ -0,0 +1,450 @@
+package raft
+
+/* queued
+ * Author: Tim Henderson
+ * Email: tadh@case.edu
+ * Copyright 2013 All Right Reserved
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ *  * Neither the name of the queued nor the names of its contributors may be
+ *    used to endorse or promote products derived from this software without
+ *    specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+import "testing"
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/timtadh/queued/net"
+	"github.com/timtadh/queued/net/queuetest"
+	"github.com/timtadh/queued/queue"
+)
+
+var testConfig = Config{
+	ElectionTimeout: 50 * time.Millisecond,
+	Heartbeat:       10 * time.Millisecond,
+	ProposeTimeout:  500 * time.Millisecond,
+}
+
+/* A node and what it has applied. */
+type member struct {
+	*Node
+	storage Storage
+	lock    *sync.Mutex
+	applied []string
+}
+
+func (self *member) commands() []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return append([]string(nil), self.applied...)
+}
+
+func newMember(t *testing.T, network *Network, id string, ids []string, storage Storage) *member {
+	m := &member{storage: storage, lock: new(sync.Mutex)}
+	node, err := NewNode(id, ids, network.Transport(id), storage, testConfig, func(cmd []byte) interface{} {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		m.applied = append(m.applied, string(cmd))
+		return len(m.applied)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Node = node
+	network.Add(node)
+	node.Start()
+	return m
+}
+
+func cluster(t *testing.T, n int) (*Network, []*member) {
+	network := NewNetwork()
+	ids := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		ids = append(ids, fmt.Sprintf("node-%d", i))
+	}
+	members := make([]*member, 0, n)
+	for _, id := range ids {
+		members = append(members, newMember(t, network, id, ids, NewMemoryStorage()))
+	}
+	return network, members
+}
+
+func stop(members []*member) {
+	for _, m := range members {
+		m.Stop()
+	}
+}
+
+/* Wait for exactly one leader among members. */
+func leader(t *testing.T, members []*member) *member {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		var leaders []*member
+		terms := make(map[uint64]int)
+		for _, m := range members {
+			state, term, _ := m.Status()
+			if state == Leader {
+				leaders = append(leaders, m)
+				terms[term] += 1
+			}
+		}
+		if len(leaders) == 1 {
+			return leaders[0]
+		}
+		for term, count := range terms {
+			if count > 1 {
+				t.Fatal("two leaders in term", term)
+			}
+		}
+	}
+	t.Fatal("no leader elected")
+	return nil
+}
+
+/* Wait for every member to have applied the same n commands. */
+func converge(t *testing.T, members []*member, n int) []string {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		done := true
+		for _, m := range members {
+			if len(m.commands()) != n {
+				done = false
+			}
+		}
+		if done {
+			break
+		}
+	}
+	first := members[0].commands()
+	if len(first) != n {
+		t.Fatalf("%v applied %v commands, expected %v", members[0].Id(), len(first), n)
+	}
+	for _, m := range members[1:] {
+		cmds := m.commands()
+		if fmt.Sprint(cmds) != fmt.Sprint(first) {
+			t.Fatalf("%v applied %v but %v applied %v", m.Id(), cmds, members[0].Id(), first)
+		}
+	}
+	return first
+}
+
+func TestElection(t *testing.T) {
+	_, members := cluster(t, 3)
+	defer stop(members)
+	l := leader(t, members)
+	for _, m := range members {
+		if m == l {
+			continue
+		}
+		// until the first heartbeat reaches it a follower doesn't know the leader
+		var err error
+		for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+			_, err = m.Propose([]byte("x"))
+			if nl, is := err.(*NotLeaderError); !is || nl.Redirect() != "" {
+				break
+			}
+		}
+		if nl, is := err.(*NotLeaderError); !is || nl.Redirect() != l.Id() {
+			t.Fatal("expected to be sent to the leader", err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		r, err := l.Propose([]byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.(int) != i+1 {
+			t.Fatal("bad result", r)
+		}
+	}
+	converge(t, members, 10)
+}
+
+func TestPartition(t *testing.T) {
+	network, members := cluster(t, 5)
+	defer stop(members)
+	old := leader(t, members)
+	if _, err := old.Propose([]byte("before")); err != nil {
+		t.Fatal(err)
+	}
+	// the old leader and one follower on one side, the other three on the other
+	minority := []*member{old}
+	var majority []*member
+	var majorityIds []string
+	for _, m := range members {
+		if m == old {
+			continue
+		} else if len(minority) < 2 {
+			minority = append(minority, m)
+		} else {
+			majority = append(majority, m)
+			majorityIds = append(majorityIds, m.Id())
+		}
+	}
+	network.Partition([]string{minority[0].Id(), minority[1].Id()}, majorityIds)
+
+	// the old leader can't commit anything without a majority
+	if _, err := old.Propose([]byte("lost")); err == nil {
+		t.Fatal("a minority committed a command")
+	}
+	l := leader(t, majority)
+	if _, err := l.Propose([]byte("during")); err != nil {
+		t.Fatal(err)
+	}
+
+	network.Heal()
+	l = leader(t, members)
+	if _, err := l.Propose([]byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	cmds := converge(t, members, 3)
+	if fmt.Sprint(cmds) != "[before during after]" {
+		t.Fatal("bad log", cmds)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	network, members := cluster(t, 3)
+	l := leader(t, members)
+	for i := 0; i < 5; i++ {
+		if _, err := l.Propose([]byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	converge(t, members, 5)
+	// crash a follower, it comes back with its storage but no state
+	var down *member
+	for _, m := range members {
+		if m != l {
+			down = m
+			break
+		}
+	}
+	network.Remove(down.Id())
+	down.Stop()
+	if _, err := l.Propose([]byte("5")); err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{members[0].Id(), members[1].Id(), members[2].Id()}
+	up := newMember(t, network, down.Id(), ids, down.storage)
+	for i, m := range members {
+		if m == down {
+			members[i] = up
+		}
+	}
+	defer stop(members)
+	if _, err := l.Propose([]byte("6")); err != nil {
+		t.Fatal(err)
+	}
+	converge(t, members, 7)
+}
+
+func TestFileStorage(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetState(3, "node-1")
+	s.Append([]Entry{{1, 1, []byte("a")}, {1, 2, nil}, {2, 3, []byte("c")}})
+	s.Truncate(3)
+	s.Append([]Entry{{3, 3, []byte("d")}})
+	s.Close()
+
+	s, err = NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	term, vote, err := s.State()
+	if err != nil || term != 3 || vote != "node-1" {
+		t.Fatal("bad state", term, vote, err)
+	}
+	entries, err := s.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || string(entries[0].Command) != "a" || entries[1].Command != nil ||
+		entries[2].Term != 3 || string(entries[2].Command) != "d" {
+		t.Fatal("bad entries", entries)
+	}
+}
+
+func TestQueues(t *testing.T) {
+	network := NewNetwork()
+	ids := []string{"a", "b", "c"}
+	all := make([]*Queues, 0, 3)
+	for _, id := range ids {
+		qs, err := NewQueues(id, ids, network.Transport(id), NewMemoryStorage(), testConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		network.Add(qs.Node())
+		defer qs.Stop()
+		all = append(all, qs)
+	}
+	var leader *Queues
+	for start := time.Now(); leader == nil && time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		for _, qs := range all {
+			if state, _, _ := qs.Node().Status(); state == Leader {
+				leader = qs
+			}
+		}
+	}
+	if leader == nil {
+		t.Fatal("no leader elected")
+	}
+	q := leader.Queue("billing", false)
+	for _, data := range []string{"a", "b", "a", "c"} {
+		if err := q.Enque(queue.NewItem([]byte(data), nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	item, err := q.Deque()
+	if err != nil || string(item.Data) != "a" {
+		t.Fatal("bad deque", item, err)
+	}
+	for _, qs := range all {
+		if qs == leader {
+			continue
+		}
+		if _, err := qs.Queue("billing", false).Deque(); err == nil {
+			t.Fatal("a follower dequeued")
+		}
+	}
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		done := true
+		for _, qs := range all {
+			if qs.Queue("billing", false).Size() != 2 {
+				done = false
+			}
+		}
+		if done {
+			return
+		}
+	}
+	t.Fatal("the followers' queues did not catch up")
+}
+
+/* A single node group, once it has elected itself. */
+func single(t *testing.T) *Queues {
+	network := NewNetwork()
+	qs, err := NewQueues("a", []string{"a"}, network.Transport("a"), NewMemoryStorage(), testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	network.Add(qs.Node())
+	t.Cleanup(qs.Stop)
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if state, _, _ := qs.Node().Status(); state == Leader {
+			return qs
+		} else if time.Since(start) > 5*time.Second {
+			t.Fatal("no leader elected")
+		}
+	}
+}
+
+func TestQueuesReplayedEnque(t *testing.T) {
+	qs := single(t)
+	q := qs.Queue("billing", true)
+	item := queue.NewItem([]byte("a"), nil)
+	if err := q.Enque(item); err != nil {
+		t.Fatal(err)
+	}
+	/* the same command committed again, as when a timed out proposal is retried */
+	command, err := json.Marshal(&op{Op: "enque", Queue: "billing", Dups: true, Item: item})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := qs.apply(command); r != nil {
+		t.Fatal("replayed enque returned", r)
+	}
+	if q.Size() != 1 {
+		t.Fatal("replayed enque was applied again, size", q.Size())
+	}
+	if got, err := q.Deque(); err != nil || got.Id != item.Id {
+		t.Fatal("bad deque", got, err)
+	}
+	qs.apply(command)
+	if !q.Empty() {
+		t.Fatal("replayed enque put back a dequeued item")
+	}
+	if err := q.Enque(queue.NewItem([]byte("a"), nil)); err != nil {
+		t.Fatal(err)
+	} else if q.Size() != 1 {
+		t.Fatal("a new item with the same data wasn't enqueued")
+	}
+}
+
+func TestQueuesForgetIds(t *testing.T) {
+	qs := single(t)
+	qs.keep = 2
+	q := qs.Queue("billing", true)
+	var items []*queue.Item
+	for i := 0; i < 5; i++ {
+		item := queue.NewItem([]byte(fmt.Sprint(i)), nil)
+		items = append(items, item)
+		if err := q.Enque(item); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := q.Deque(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	qs.lock.Lock()
+	known := len(qs.ids)
+	qs.lock.Unlock()
+	if known != 2 {
+		t.Fatal("expected only the last two Ids to be kept, got", known)
+	}
+	replay := func(item *queue.Item) {
+		command, err := json.Marshal(&op{Op: "enque", Queue: "billing", Dups: true, Item: item})
+		if err != nil {
+			t.Fatal(err)
+		}
+		qs.apply(command)
+	}
+	replay(items[4])
+	if !q.Empty() {
+		t.Fatal("a recently dequeued item was enqueued again")
+	}
+	replay(items[0])
+	if q.Size() != 1 {
+		t.Fatal("expected a forgotten Id to be enqueued again", q.Size())
+	}
+}
+
+func TestConformance(t *testing.T) {
+	qs := single(t)
+	n := 0
+	queuetest.Run(t, true, func(t *testing.T) net.Queue {
+		n += 1
+		return qs.Queue(fmt.Sprintf("conformance-%d", n), false)
+	})
+}
@@ -0,0 +1,283 @@
+package raft
+
+/* queued
+ * Author: Tim Henderson
+ * Email: tadh@case.edu
+ * Copyright 2013 All Right Reserved
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ *  * Neither the name of the queued nor the names of its contributors may be
+ *    used to endorse or promote products derived from this software without
+ *    specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+/*
+Where a node keeps the state it must not forget across a restart: its current
+term, who it voted for in that term and its log. Every method must have made
+the change durable before it returns.  */
+type Storage interface {
+	State() (term uint64, vote string, err error)
+	SetState(term uint64, vote string) error
+	Entries() ([]Entry, error)
+	Append(entries []Entry) error
+	/* Remove the entries from index on. */
+	Truncate(index uint64) error
+}
+
+/* Storage which forgets everything when the process exits. For tests. */
+type MemoryStorage struct {
+	lock    *sync.Mutex
+	term    uint64
+	vote    string
+	entries []Entry
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{lock: new(sync.Mutex)}
+}
+
+func (self *MemoryStorage) State() (uint64, string, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.term, self.vote, nil
+}
+
+func (self *MemoryStorage) SetState(term uint64, vote string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.term = term
+	self.vote = vote
+	return nil
+}
+
+func (self *MemoryStorage) Entries() ([]Entry, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return append([]Entry(nil), self.entries...), nil
+}
+
+func (self *MemoryStorage) Append(entries []Entry) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.entries = append(self.entries, entries...)
+	return nil
+}
+
+func (self *MemoryStorage) Truncate(index uint64) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for i, e := range self.entries {
+		if e.Index >= index {
+			self.entries = self.entries[:i]
+			break
+		}
+	}
+	return nil
+}
+
+/*
+Storage in a directory. The term and vote are in a small JSON file which is
+replaced whenever they change and the log is a file of JSON entries, one per
+line, which is appended to (and synced) as entries are added.  */
+type FileStorage struct {
+	lock    *sync.Mutex
+	dir     string
+	log     *os.File
+	entries []Entry
+}
+
+type fileState struct {
+	Term uint64 `json:"term"`
+	Vote string `json:"vote"`
+}
+
+/* Open (creating if need be) the storage in dir. */
+func NewFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	self := &FileStorage{lock: new(sync.Mutex), dir: dir}
+	f, err := os.OpenFile(filepath.Join(dir, "log"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<30)
+	for s.Scan() {
+		var e Entry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			// a torn write at the end of the log, from a crash
+			break
+		}
+		self.entries = append(self.entries, e)
+	}
+	if err := s.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	self.log = f
+	if err := self.rewrite(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return self, nil
+}
+
+func (self *FileStorage) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.log.Close()
+}
+
+func (self *FileStorage) State() (uint64, string, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	data, err := os.ReadFile(filepath.Join(self.dir, "state"))
+	if os.IsNotExist(err) {
+		return 0, "", nil
+	} else if err != nil {
+		return 0, "", err
+	}
+	var state fileState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return 0, "", fmt.Errorf("bad raft state file, %v", err)
+	}
+	return state.Term, state.Vote, nil
+}
+
+func (self *FileStorage) SetState(term uint64, vote string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	data, err := json.Marshal(fileState{Term: term, Vote: vote})
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(self.dir, "state"), data)
+}
+
+func (self *FileStorage) Entries() ([]Entry, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return append([]Entry(nil), self.entries...), nil
+}
+
+func (self *FileStorage) Append(entries []Entry) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	w := bufio.NewWriter(self.log)
+	for _, e := range entries {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := self.log.Sync(); err != nil {
+		return err
+	}
+	self.entries = append(self.entries, entries...)
+	return nil
+}
+
+func (self *FileStorage) Truncate(index uint64) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for i, e := range self.entries {
+		if e.Index >= index {
+			self.entries = self.entries[:i]
+			break
+		}
+	}
+	return self.rewrite()
+}
+
+/*
+Replace the log file with the entries in memory. The caller must hold the lock
+(or be the constructor).  */
+func (self *FileStorage) rewrite() error {
+	path := filepath.Join(self.dir, "log")
+	tmp, err := os.OpenFile(path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for _, e := range self.entries {
+		data, err := json.Marshal(e)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		w.Write(data)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		tmp.Close()
+		return err
+	}
+	self.log.Close()
+	self.log = tmp
+	_, err = self.log.Seek(0, 2)
+	return err
+}
+
+/* Write a file so that it is either all there or not changed. */
+func writeFile(path string, data []byte) error {
+	f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,273 @@
+package raft
+
+/* queued
+ * Author: Tim Henderson
+ * Email: tadh@case.edu
+ * Copyright 2013 All Right Reserved
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  * Redistributions of source code must retain the above copyright notice,
+ *    this list of conditions and the following disclaimer.
+ *
+ *  * Redistributions in binary form must reproduce the above copyright notice,
+ *    this list of conditions and the following disclaimer in the documentation
+ *    and/or other materials provided with the distribution.
+ *
+ *  * Neither the name of the queued nor the names of its contributors may be
+ *    used to endorse or promote products derived from this software without
+ *    specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+/*
+An in process network of nodes. Messages are delivered by calling the other
+node directly unless the network has been partitioned between the two nodes.
+For tests.  */
+type Network struct {
+	lock  *sync.RWMutex
+	nodes map[string]*Node
+	group map[string]int
+	delay time.Duration
+}
+
+func NewNetwork() *Network {
+	return &Network{
+		lock:  new(sync.RWMutex),
+		nodes: make(map[string]*Node),
+		group: make(map[string]int),
+	}
+}
+
+/* The transport for the node with the given id. */
+func (self *Network) Transport(id string) Transport {
+	return &memTransport{network: self, from: id}
+}
+
+/* Connect a node to the network. */
+func (self *Network) Add(node *Node) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.nodes[node.Id()] = node
+}
+
+/* Disconnect a node (eg. because it crashed). */
+func (self *Network) Remove(id string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.nodes, id)
+}
+
+/*
+Split the network: nodes can only reach nodes in the same group. Nodes which
+aren't in any group are on their own.  */
+func (self *Network) Partition(groups ...[]string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.group = make(map[string]int)
+	for i, group := range groups {
+		for _, id := range group {
+			self.group[id] = i + 1
+		}
+	}
+	for id := range self.nodes {
+		if _, has := self.group[id]; !has {
+			self.group[id] = -len(self.group) - 1
+		}
+	}
+}
+
+/* Undo any partition. */
+func (self *Network) Heal() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.group = make(map[string]int)
+}
+
+/* Delay every message by d. */
+func (self *Network) SetDelay(d time.Duration) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.delay = d
+}
+
+func (self *Network) route(from, to string) (*Node, error) {
+	self.lock.RLock()
+	node, has := self.nodes[to]
+	delay := self.delay
+	reachable := self.group[from] == self.group[to]
+	self.lock.RUnlock()
+	if !has || !reachable {
+		return nil, fmt.Errorf("%v is unreachable from %v", to, from)
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	return node, nil
+}
+
+type memTransport struct {
+	network *Network
+	from    string
+}
+
+func (self *memTransport) RequestVote(to string, args *VoteArgs) (*VoteReply, error) {
+	node, err := self.network.route(self.from, to)
+	if err != nil {
+		return nil, err
+	}
+	reply := node.RequestVote(args)
+	if _, err := self.network.route(to, self.from); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (self *memTransport) AppendEntries(to string, args *AppendArgs) (*AppendReply, error) {
+	node, err := self.network.route(self.from, to)
+	if err != nil {
+		return nil, err
+	}
+	reply := node.AppendEntries(args)
+	if _, err := self.network.route(to, self.from); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+/* The net/rpc service a node is served as. */
+type rpcNode struct {
+	node *Node
+}
+
+func (self *rpcNode) RequestVote(args *VoteArgs, reply *VoteReply) error {
+	*reply = *self.node.RequestVote(args)
+	return nil
+}
+
+func (self *rpcNode) AppendEntries(args *AppendArgs, reply *AppendReply) error {
+	*reply = *self.node.AppendEntries(args)
+	return nil
+}
+
+/*
+Serve the node's side of RPCTransport on ln. This blocks until ln is closed.  */
+func Serve(ln net.Listener, node *Node) {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Raft", &rpcNode{node}); err != nil {
+		panic(err)
+	}
+	server.Accept(ln)
+}
+
+/*
+A transport between processes, using net/rpc over TCP. addrs maps each node's
+id to the address it is served (see Serve) on. Connections are made when they
+are first needed and remade after an error.  */
+type RPCTransport struct {
+	lock    *sync.Mutex
+	addrs   map[string]string
+	clients map[string]*rpc.Client
+	timeout time.Duration
+}
+
+func NewRPCTransport(addrs map[string]string, timeout time.Duration) *RPCTransport {
+	return &RPCTransport{
+		lock:    new(sync.Mutex),
+		addrs:   addrs,
+		clients: make(map[string]*rpc.Client),
+		timeout: timeout,
+	}
+}
+
+func (self *RPCTransport) client(to string) (*rpc.Client, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if c, has := self.clients[to]; has {
+		return c, nil
+	}
+	addr, has := self.addrs[to]
+	if !has {
+		return nil, fmt.Errorf("unknown node %v", to)
+	}
+	con, err := net.DialTimeout("tcp", addr, self.timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := rpc.NewClient(con)
+	self.clients[to] = c
+	return c, nil
+}
+
+func (self *RPCTransport) drop(to string, c *rpc.Client) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.clients[to] == c {
+		delete(self.clients, to)
+	}
+	c.Close()
+}
+
+func (self *RPCTransport) call(to, method string, args, reply interface{}) error {
+	c, err := self.client(to)
+	if err != nil {
+		return err
+	}
+	timer := time.NewTimer(self.timeout)
+	defer timer.Stop()
+	select {
+	case call := <-c.Go(method, args, reply, make(chan *rpc.Call, 1)).Done:
+		if call.Error != nil {
+			self.drop(to, c)
+		}
+		return call.Error
+	case <-timer.C:
+		self.drop(to, c)
+		return fmt.Errorf("%v to %v timed out", method, to)
+	}
+}
+
+func (self *RPCTransport) RequestVote(to string, args *VoteArgs) (*VoteReply, error) {
+	reply := new(VoteReply)
+	if err := self.call(to, "Raft.RequestVote", args, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (self *RPCTransport) AppendEntries(to string, args *AppendArgs) (*AppendReply, error) {
+	reply := new(AppendReply)
+	if err := self.call(to, "Raft.AppendEntries", args, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (self *RPCTransport) Close() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for to, c := range self.clients {
+		c.Close()
+		delete(self.clients, to)
+	}
+}